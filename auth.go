@@ -0,0 +1,129 @@
+package rquent
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Credentials to authenticate downloads from a host with: a bearer token, or a username and password
+// for basic auth
+type Credential struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// Describes the credential without its secrets, so it's safe to log
+func (c Credential) String() string {
+	switch {
+	case c.Token != "":
+		return "bearer token"
+	case c.Username != "":
+		return "basic auth for " + c.Username
+	}
+	return "no credentials"
+}
+
+// Keeps %#v from printing the secrets too
+func (c Credential) GoString() string {
+	return c.String()
+}
+
+func (c Credential) validate() error {
+	if (c.Token == "") == (c.Username == "") {
+		return errors.New("needs either a token or a username")
+	}
+	if c.Token != "" && c.Password != "" {
+		return errors.New("has a password, which is only used with a username")
+	}
+	return nil
+}
+
+// The value of the Authorization header for the credential
+func (c Credential) authorization() string {
+	if c.Token != "" {
+		return "Bearer " + c.Token
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+}
+
+// Read credentials keyed by host from JSON like {"images.example.com": {"token": "$IMAGES_TOKEN"}}
+// Environment variables in the values are expanded (see os.ExpandEnv), so secrets can be kept out of
+// the file. A host with a port only matches urls with that port, one without matches any port
+func ReadCredentials(r io.Reader) (map[string]Credential, error) {
+	var creds map[string]Credential
+	if err := json.NewDecoder(r).Decode(&creds); err != nil {
+		return nil, errors.New("Failed to parse credentials: " + err.Error())
+	}
+	for host, c := range creds {
+		creds[host] = Credential{
+			Username: os.ExpandEnv(c.Username),
+			Password: os.ExpandEnv(c.Password),
+			Token:    os.ExpandEnv(c.Token),
+		}
+	}
+	return creds, nil
+}
+
+// Credentials by lowercased host; safe for use by multiple workers once built
+type credentialStore map[string]Credential
+
+func newCredentialStore(creds map[string]Credential) (credentialStore, error) {
+	store := make(credentialStore, len(creds))
+	for host, c := range creds {
+		if host == "" {
+			return nil, errors.New("Pipeline credentials must be keyed by a host")
+		}
+		// the error doesn't include the credential, only what's wrong with it
+		if err := c.validate(); err != nil {
+			return nil, errors.New("Pipeline credentials for " + host + " " + err.Error())
+		}
+		store[strings.ToLower(host)] = c
+	}
+	return store, nil
+}
+
+// The Authorization header for requests to u, or "" if its host has no credentials
+func (s credentialStore) authorization(u *url.URL) string {
+	if len(s) == 0 {
+		return ""
+	}
+	c, ok := s[strings.ToLower(u.Host)]
+	if !ok {
+		c, ok = s[strings.ToLower(u.Hostname())]
+	}
+	if !ok {
+		return ""
+	}
+	return c.authorization()
+}
+
+// Send a login request (a POST of a login form, say) with the pipeline's client, so the session cookies
+// it responds with are kept in the jar from WithCookieJar and sent with the downloads of the run
+// Call it after Init and before Run; it fails if there's no jar or the response is an error status
+func (pipe *RqPipeline) Login(req *http.Request) error {
+	if pipe.pool.jar == nil {
+		return errors.New("Pipeline has no cookie jar set. Use method WithCookieJar to set it.")
+	}
+	if pipe.pool.downloader == nil {
+		return errors.New("Pipeline must be initialized with Init before logging in")
+	}
+	resp, err := pipe.pool.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to log in: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("Failed to log in: %v responded with %v", req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package rquent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadCredentials(t *testing.T) {
+	// Test values are expanded from the environment
+	os.Setenv("RQUENT_TEST_TOKEN", "secret")
+	defer os.Unsetenv("RQUENT_TEST_TOKEN")
+	creds, err := ReadCredentials(strings.NewReader(`{
+		"a.com": {"token": "$RQUENT_TEST_TOKEN"},
+		"b.com:8080": {"username": "user", "password": "pass"}
+	}`))
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if creds["a.com"].Token != "secret" || creds["b.com:8080"].Username != "user" {
+		t.Errorf("Expected (expanded credentials) Got (%v)", creds)
+	}
+
+	if _, err := ReadCredentials(strings.NewReader(`["a.com"]`)); err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestCredentialRedacted(t *testing.T) {
+	c := Credential{Username: "user", Password: "pass"}
+	for _, s := range []string{fmt.Sprint(c), fmt.Sprintf("%+v", c), fmt.Sprintf("%#v", c)} {
+		if strings.Contains(s, "pass") {
+			t.Errorf("Expected (no password) Got (%v)", s)
+		}
+	}
+}
+
+func TestCredentialStoreAuthorization(t *testing.T) {
+	store, err := newCredentialStore(map[string]Credential{
+		"A.com":      {Token: "t"},
+		"b.com:8080": {Username: "user", Password: "pass"},
+	})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	for _, test := range []struct {
+		url      string
+		expected string
+	}{
+		{"https://a.com/x.jpg", "Bearer t"},
+		{"https://a.com:8443/x.jpg", "Bearer t"},
+		{"http://b.com:8080/x.jpg", "Basic dXNlcjpwYXNz"},
+		{"http://b.com/x.jpg", ""},
+		{"http://c.com/x.jpg", ""},
+	} {
+		u, _ := url.Parse(test.url)
+		if auth := store.authorization(u); auth != test.expected {
+			t.Errorf("Expected (%v) Got (%v) for %v", test.expected, auth, test.url)
+		}
+	}
+
+	for _, bad := range []Credential{{}, {Token: "t", Username: "user"}, {Token: "t", Password: "pass"}} {
+		if _, err := newCredentialStore(map[string]Credential{"a.com": bad}); err == nil {
+			t.Errorf("Expected (error for %v) Got (nil)", bad)
+		}
+	}
+}
+
+func TestPipelineRunCredentials(t *testing.T) {
+	// Test only the host with credentials gets them
+	handler := func(token string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != token {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			data, _ := ioutil.ReadFile(testImagePathValid)
+			w.Write(data)
+		}
+	}
+	private := httptest.NewServer(handler("Bearer t"))
+	defer private.Close()
+	public := httptest.NewServer(handler(""))
+	defer public.Close()
+	privateURL, _ := url.Parse(private.URL)
+
+	b := new(bytes.Buffer)
+	errBuf := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader(private.URL + "/a.jpg\n" + public.URL + "/b.jpg")).
+		WithOutput(b).
+		WithErrorOutput(errBuf).
+		WithDownloadConfig(DownloadConfig{Retries: 0}).
+		WithCredentials(map[string]Credential{privateURL.Host: {Token: "t"}}).
+		Init()
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, _ := pipeline.Run()
+	if result.Succeeded != 2 {
+		t.Errorf("Expected (2 succeeded) Got (%+v, errors %v)", result, errBuf.String())
+	}
+}
+
+func TestPipelineRunLogin(t *testing.T) {
+	// Test the session cookie from logging in is sent with downloads
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			if r.FormValue("password") != "p" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s"})
+			return
+		}
+		if c, err := r.Cookie("session"); err != nil || c.Value != "s" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		data, _ := ioutil.ReadFile(testImagePathValid)
+		w.Write(data)
+	}))
+	defer s.Close()
+
+	jar, _ := cookiejar.New(nil)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader(s.URL + "/a.jpg")).
+		WithOutput(new(bytes.Buffer)).
+		WithCookieJar(jar).
+		Init()
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	login := func(password string) error {
+		req, _ := http.NewRequest(http.MethodPost, s.URL+"/login", strings.NewReader("password="+password))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return pipeline.Login(req)
+	}
+	if err := login("wrong"); err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+	if err := login("p"); err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if result, _ := pipeline.Run(); result.Succeeded != 1 {
+		t.Errorf("Expected (1 succeeded) Got (%+v)", result)
+	}
+}
+
+func TestLoginNoCookieJar(t *testing.T) {
+	pipeline, _ := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithOutput(new(bytes.Buffer)).
+		Init()
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/login", nil)
+	if err := pipeline.Login(req); err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
@@ -0,0 +1,144 @@
+package rquent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// Returned by conditional downloads when the image hasn't changed since the validators were given
+var errNotModified = errors.New("Image not modified")
+
+// Validators of a response, for asking the server later whether the image has changed
+type validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func responseValidators(resp *http.Response) validators {
+	return validators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+}
+
+func (v validators) empty() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+// Headers making a request conditional on the image having changed; nil if there are no validators
+func (v validators) header() http.Header {
+	if v.empty() {
+		return nil
+	}
+	header := http.Header{}
+	if v.ETag != "" {
+		header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		header.Set("If-Modified-Since", v.LastModified)
+	}
+	return header
+}
+
+// Summary of an image saved by a previous run, with the validators of the response it came from
+type cacheEntry struct {
+	URL        string          `json:"url"`
+	Validators validators      `json:"validators"`
+	Config     SummarizeConfig `json:"config"` // the summary is only reused with the same config
+	Width      int             `json:"width"`
+	Height     int             `json:"height"`
+	Summary    ColorSummary    `json:"summary"`
+	Size       int             `json:"size"`
+	Format     string          `json:"format"`
+}
+
+// On-disk cache of summaries keyed by url, one JSON file per url in dir
+type summaryCache struct {
+	dir string
+	cfg SummarizeConfig
+}
+
+func newSummaryCache(dir string, cfg SummarizeConfig) (*summaryCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// decoders only change which images can be decoded, not how they're counted, and can't be compared
+	cfg.decoders = nil
+	return &summaryCache{dir: dir, cfg: cfg}, nil
+}
+
+func (c *summaryCache) path(imgURL string) string {
+	sum := sha256.Sum256([]byte(imgURL))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Get the cached entry for a url; false if there isn't a usable one
+func (c *summaryCache) load(imgURL string) (cacheEntry, bool) {
+	var entry cacheEntry
+	b, err := ioutil.ReadFile(c.path(imgURL))
+	if err != nil {
+		return entry, false
+	}
+	if err := json.Unmarshal(b, &entry); err != nil || entry.URL != imgURL || entry.Validators.empty() {
+		return cacheEntry{}, false
+	}
+	if !reflect.DeepEqual(entry.Config, c.cfg) {
+		// counted differently, so the image has to be summarized again
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// Save the summary of an image along with the validators it was downloaded with
+func (c *summaryCache) store(img RqImage) error {
+	b, err := json.Marshal(cacheEntry{
+		URL:        img.URL,
+		Validators: img.validators,
+		Config:     c.cfg,
+		Width:      img.width,
+		Height:     img.height,
+		Summary:    img.summary,
+		Size:       img.size,
+		Format:     img.format,
+	})
+	if err != nil {
+		return err
+	}
+	// write to a temp file first so an interrupted run never leaves a partial entry
+	tmp, err := ioutil.TempFile(c.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(img.URL))
+}
+
+// Get the cached entry to revalidate a url with, if the downloader has a cache
+func (d *downloader) loadCached(imgURL string) (cacheEntry, bool) {
+	if d.cache == nil || isDataURI(imgURL) {
+		return cacheEntry{}, false
+	}
+	return d.cache.load(imgURL)
+}
+
+// Use a cached summary for an image the server says hasn't changed
+func (entry cacheEntry) apply(img *RqImage) {
+	img.width = entry.Width
+	img.height = entry.Height
+	img.summary = entry.Summary
+	img.size = entry.Size
+	img.format = entry.Format
+	img.validators = entry.Validators
+	img.cached = true
+}
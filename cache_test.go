@@ -0,0 +1,95 @@
+package rquent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// create a server for the valid image that answers requests with its ETag with 304 Not Modified
+func etagServer(downloads *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(downloads, 1)
+		data, _ := ioutil.ReadFile(testImagePathValid)
+		w.Write(data)
+	}))
+}
+
+func TestValidatorsHeader(t *testing.T) {
+	if header := (validators{}).header(); header != nil {
+		t.Errorf("Expected (nil) Got (%v)", header)
+	}
+	header := validators{ETag: `"v1"`, LastModified: "Wed, 21 Oct 2015 07:28:00 GMT"}.header()
+	if header.Get("If-None-Match") != `"v1"` || header.Get("If-Modified-Since") != "Wed, 21 Oct 2015 07:28:00 GMT" {
+		t.Errorf("Expected (conditional headers) Got (%v)", header)
+	}
+}
+
+func TestPipelineRunCache(t *testing.T) {
+	// Test a re-run reuses the cached summary of an unchanged image, unless the config changed
+	var downloads int32
+	s := etagServer(&downloads)
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "rquent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	run := func(cfg SummarizeConfig, inMemory bool) string {
+		b := new(bytes.Buffer)
+		pipeline, err := NewPipeline(testPipeConfig).
+			WithSource(strings.NewReader(s.URL + "/image.jpg")).
+			WithOutput(b).
+			WithSummarizeConfig(cfg).
+			WithInMemory(inMemory).
+			WithCache(dir).
+			Init()
+		if err != nil {
+			t.Fatalf("Expected (nil) Got (%v)", err)
+		}
+		if result, _ := pipeline.Run(); result.Succeeded != 1 {
+			t.Errorf("Expected (1 succeeded) Got (%+v)", result)
+		}
+		return b.String()
+	}
+
+	first := run(testSummarizeConfig, false)
+	for _, inMemory := range []bool{false, true} {
+		if again := run(testSummarizeConfig, inMemory); again != first {
+			t.Errorf("Expected (%v) Got (%v)", first, again)
+		}
+	}
+	if downloads := atomic.LoadInt32(&downloads); downloads != 1 {
+		t.Errorf("Expected (1 download) Got (%v)", downloads)
+	}
+
+	cfg := testSummarizeConfig
+	cfg.K += 1
+	run(cfg, false)
+	if downloads := atomic.LoadInt32(&downloads); downloads != 2 {
+		t.Errorf("Expected (2 downloads after changing the config) Got (%v)", downloads)
+	}
+}
+
+func TestMakePipelineCacheSummarizer(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithOutput(new(bytes.Buffer)).
+		WithSummarizer(cornerSummarizer{}).
+		WithCache(os.TempDir()).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/macintoshpie/rquent"
+)
+
+// Fetchers for object storage urls by scheme, added by the files built with their tags (-tags s3 or
+// -tags gcs); without them, s3:// and gs:// urls are rejected as unsupported
+var fetchers = map[string]rquent.Fetcher{}
+
+// Split an object storage url like s3://bucket/path/to/key into its bucket and key
+func objectPath(rawURL string) (string, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return "", "", errors.New("object url must be formatted as " + u.Scheme + "://bucket/key")
+	}
+	return u.Host, key, nil
+}
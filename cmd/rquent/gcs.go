@@ -0,0 +1,51 @@
+//go:build gcs
+// +build gcs
+
+package main
+
+// Reads gs://bucket/object urls from Google Cloud Storage, with Application Default Credentials.
+// Build with `-tags gcs` to enable.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/macintoshpie/rquent"
+)
+
+// Client is created on the first url, so a run without gs urls doesn't need Google credentials
+type gcsFetcher struct {
+	once   sync.Once
+	client *storage.Client
+	err    error
+}
+
+func (f *gcsFetcher) Fetch(ctx context.Context, rawURL string) (io.ReadCloser, int64, error) {
+	bucket, object, err := objectPath(rawURL)
+	if err != nil {
+		return nil, -1, err
+	}
+	f.once.Do(func() {
+		f.client, f.err = storage.NewClient(context.Background())
+	})
+	if f.err != nil {
+		return nil, -1, f.err
+	}
+
+	r, err := f.client.Bucket(bucket).Object(object).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, storage.ErrBucketNotExist) {
+		return nil, -1, &rquent.DownloadError{StatusCode: http.StatusNotFound, URL: rawURL}
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+	return r, r.Attrs.Size, nil
+}
+
+func init() {
+	fetchers["gs"] = &gcsFetcher{}
+}
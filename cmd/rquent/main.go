@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/macintoshpie/rquent"
+)
+
+// Repeatable flag of "Name: value" http headers
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headerFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return errors.New("header must be formatted as \"Name: value\"")
+	}
+	http.Header(h).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// Split -workers n between the stages in the ratio of the default counts; counts that aren't positive
+// are left for the pipeline to reject
+func workerCounts(n int) (int, int, int) {
+	others := n / 5
+	if others < 1 && n > 0 {
+		others = 1
+	}
+	return n, others, others
+}
+
+// Context that's cancelled on the first SIGINT or SIGTERM, so the pipeline stops, flushes the results so
+// far and removes its temp files; a second signal exits immediately. stop releases the signals
+func interruptContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Printf("Received %v, stopping after cleaning up (again to exit now)", sig)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case <-sigs:
+			log.Fatalln("Interrupted again, exiting without cleaning up")
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		close(done)
+		cancel()
+	}
+}
+
+// Open a source file, decompressing it if it's gzipped (detected from its first bytes, whatever its name)
+func openSource(path string) (io.Reader, func() error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(f)
+	if magic, _ := r.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return gz, f.Close, nil
+	}
+	return r, f.Close, nil
+}
+
+func main() {
+	var imagesPath *string = flag.String("urls", "", "source file for images, optionally gzipped (required)")
+	var dir *string = flag.String("dir", "", "summarize the images under this directory instead of reading urls")
+	var pattern *string = flag.String("pattern", "", "only summarize files under -dir whose names match this pattern, e.g. *.jpg")
+	var csvColumn *int = flag.Int("csvcolumn", -1, "read urls from this (0-based) column of a CSV source instead of one per line")
+	var csvHeader *bool = flag.Bool("csvheader", false, "skip the first row of a CSV source")
+	var limit *int = flag.Int("limit", 0, "only process the first N urls of the source (0 for all of them)")
+	var csvoutPath *string = flag.String("out", "results.csv", "destination for results")
+	var rotate *int = flag.Int("rotate", 0, "split results into files of this many lines (results.000.csv, ...) in the -out directory")
+	var outFormat *string = flag.String("format", "csv", "format of results (csv or jsonl)")
+	var maxLine *int = flag.Int("maxline", rquent.DefaultMaxLineLength, "longest line of the source in bytes, e.g. for long signed urls or data URIs")
+	var delimiter *string = flag.String("delimiter", ",", "character separating the fields of csv results, e.g. \"\\t\" or tab for tab separated values")
+	var outHeader *bool = flag.Bool("outheader", false, "write a header row naming the columns of csv results")
+	var quiet *bool = flag.Bool("quiet", false, "only log failed images and completion, not the progress or retried errors of each image")
+	var upperHex *bool = flag.Bool("upperhex", false, "write colors with uppercase hex digits")
+	var hexAlpha *bool = flag.Bool("hexalpha", false, "write colors with their alpha channel (#rrggbbaa)")
+	var hsl *bool = flag.Bool("hsl", false, "also write each color as a CSS hsl string, e.g. hsl(0,100%,50%)")
+	var flushInterval *time.Duration = flag.Duration("flush", rquent.DefaultFlushInterval, "how often buffered results are written to the output (0 writes each one immediately)")
+	var syncOutput *bool = flag.Bool("sync", false, "sync the output to disk whenever results are flushed")
+	var ordered *int = flag.Int("ordered", 0, "write results in source order, buffering up to this many results that finish early (0 writes them as they finish)")
+	var resume *bool = flag.Bool("resume", false, "append to the existing output, skipping urls it already has results for")
+	var cacheDir *string = flag.String("cache", "", "keep summaries in this directory and only download images again if the server says they changed")
+	var webhookURL *string = flag.String("webhook", "", "also POST each result as JSON to this url as it finishes")
+	var errorsPath *string = flag.String("errors", "", "destination for failed and unprocessed urls (optional)")
+	var deadline *time.Duration = flag.Duration("deadline", 0, "stop the run after this long, e.g. 30m (0 for no limit)")
+	var stallWarning *time.Duration = flag.Duration("stallwarning", 0, "log a warning when no image finishes for this long, e.g. 5m (0 for none)")
+	var nDownload *int = flag.Int("download", 10, "number of workers downloading images")
+	var nSummarize *int = flag.Int("summarize", 2, "number of workers summarizing images")
+	var nCleanup *int = flag.Int("cleanup", 2, "number of workers cleaning up images")
+	var nWorkers *int = flag.Int("workers", 0, "shorthand for -download N with a fifth as many (at least 1) -summarize and -cleanup workers; the specific flags override it")
+	var downloadBuffer *int = flag.Int("downloadbuffer", 0, "number of urls that can wait for a download worker (0 for unbuffered)")
+	var summarizeBuffer *int = flag.Int("summarizebuffer", 0, "number of downloaded images that can wait for a summarize worker (0 for unbuffered)")
+	var cleanupBuffer *int = flag.Int("cleanupbuffer", 0, "number of summarized images that can wait for a cleanup worker (0 for unbuffered)")
+	var saveBuffer *int = flag.Int("savebuffer", 0, "number of results that can wait to be written (0 for unbuffered)")
+	var nColors *int = flag.Int("k", rquent.DefaultK, "number of prevalent colors to find per image")
+	var minAlpha *uint = flag.Uint("minalpha", 0, "skip pixels with alpha below this value (0-255)")
+	var quantize *int = flag.Int("quantize", 0, "round color channels to this many bits (1-8) before counting (0 counts exact colors)")
+	var stride *int = flag.Int("stride", 1, "only count every Nth pixel in each dimension (faster but less accurate)")
+	var formats *string = flag.String("formats", "", "only decode images in these comma separated formats, e.g. jpeg,png (empty for every supported format)")
+	var minFraction *float64 = flag.Float64("minfraction", 0, "leave out colors covering less than this fraction of the counted pixels, e.g. 0.05")
+	var cropFraction *float64 = flag.Float64("crop", 0, "only count the centered region covering this fraction of the width and height, e.g. 0.5 (0 for the whole image)")
+	var maxDimension *int = flag.Int("maxdim", 0, "shrink images so neither side is longer than this before counting colors (0 for full resolution)")
+	var orientation *bool = flag.Bool("orientation", false, "also output the EXIF orientation (1-8) of JPEGs, left empty when they have none")
+	var fractions *bool = flag.Bool("fractions", false, "write the fraction of the image each color covers after it, e.g. #ff0000:0.62")
+	var average *bool = flag.Bool("average", false, "also output the average color of each image")
+	var composite *bool = flag.Bool("composite", false, "blend semi-transparent pixels over -background before counting instead of counting them as opaque")
+	var background *string = flag.String("background", "#ffffff", "hex color semi-transparent pixels are blended over with -composite")
+	var colorModel *string = flag.String("colormodel", "", "convert pixels to gray or sepia before counting colors (empty counts them as they are)")
+	var mergeDistance *float64 = flag.Float64("merge", 0, "merge colors within this CIE Lab distance (Delta E) before choosing the top k (0 to disable)")
+	var weightSaturation *bool = flag.Bool("saturation", false, "rank colors by count weighted by saturation, so vivid colors beat dull grays")
+	var penalizeExtremes *bool = flag.Bool("extremes", false, "rank colors near black or white lower")
+	var allFrames *bool = flag.Bool("allframes", false, "count every frame of animated gifs instead of only the first (also outputs the number of frames)")
+	var retries *int = flag.Int("retries", 0, "number of times to retry a download after a transient failure")
+	var requeueDelay *time.Duration = flag.Duration("requeuedelay", 0, "wait this long before requeuing a failed job into its stage")
+	var retryBudget *int = flag.Int("retrybudget", 0, "fail jobs instead of requeuing them once this many have been requeued in total (0 for no limit)")
+	var maxRequeueDelay *time.Duration = flag.Duration("maxrequeuedelay", 0, "double -requeuedelay with each failure of a job up to this long (0 keeps it constant)")
+	var maxBytes *int64 = flag.Int64("maxbytes", 0, "largest image in bytes that will be downloaded (0 for no limit)")
+	var maxPixels *int64 = flag.Int64("maxpixels", 0, "reject images whose header declares more pixels than this before decoding them (0 for no limit)")
+	var maxTotalBytes *int64 = flag.Int64("maxtotalbytes", 0, "stop starting downloads once this many bytes have been downloaded in total (0 for no limit)")
+	var timeout *time.Duration = flag.Duration("timeout", rquent.DefaultTimeout, "time allowed for each download, including reading the image (0 for no limit)")
+	var connectTimeout *time.Duration = flag.Duration("connecttimeout", 0, "time allowed to connect to a host (0 for the default)")
+	var tlsTimeout *time.Duration = flag.Duration("tlstimeout", 0, "time allowed for the TLS handshake (0 for the default)")
+	var headerTimeout *time.Duration = flag.Duration("headertimeout", 0, "time allowed waiting for response headers (0 for no limit)")
+	var maxRedirects *int = flag.Int("maxredirects", rquent.DefaultMaxRedirects, "number of redirects to follow before giving up on a download")
+	var rateLimit *float64 = flag.Float64("ratelimit", 0, "maximum download requests per second across all workers (0 for no limit)")
+	var proxy *string = flag.String("proxy", "", "send downloads through this proxy url (default uses HTTP_PROXY and HTTPS_PROXY)")
+	var dryRun *bool = flag.Bool("dryrun", false, "only check urls are reachable images (writing their content type and size) without downloading them")
+	var perHost *int = flag.Int("perhost", 0, "maximum simultaneous downloads from any one host (0 for no limit)")
+	var idleConns *int = flag.Int("idleconns", 0, "idle connections to keep open to each host for reuse (0 for the default of 2)")
+	var maxConns *int = flag.Int("maxconns", 0, "maximum open connections to each host, at least -perhost (0 for no limit)")
+	var robots *bool = flag.Bool("robots", false, "skip urls disallowed by each host's robots.txt and wait its crawl-delay between requests")
+	var startJitter *time.Duration = flag.Duration("startjitter", 0, "delay each download worker's first request by a random interval up to this long, e.g. 500ms")
+	var inMemory *bool = flag.Bool("inmemory", false, "decode images in memory instead of saving them to temp files")
+	var swatchDir *string = flag.String("swatches", "", "write a PNG swatch of each image's colors into this directory")
+	var keepDir *string = flag.String("keep", "", "move downloaded images into this directory instead of deleting them")
+	var dedup *bool = flag.Bool("dedup", false, "summarize images with the same content once, even under different urls")
+	var headers = headerFlag{}
+	flag.Var(headers, "header", "`Name: value` header to send with downloads (repeatable)")
+	var credsPath *string = flag.String("credentials", "", "JSON file of credentials by host, e.g. {\"a.com\": {\"token\": \"$A_TOKEN\"}}")
+	var loginURL *string = flag.String("login", "", "POST -loginform to this url before the run and send the cookies it sets with downloads")
+	var loginForm *string = flag.String("loginform", "", "url encoded form to log in with, e.g. \"user=me&password=$PASSWORD\" (environment variables are expanded)")
+	var insecure *bool = flag.Bool("insecure", false, "don't verify the certificates of https servers (anyone in between can then serve their own images)")
+	var caCert *string = flag.String("cacert", "", "verify https servers with the PEM certificates in this file instead of the system's")
+	var metricsAddr *string = flag.String("metrics", "", "serve Prometheus metrics at /metrics on this address while running, e.g. :9090")
+	var size *bool = flag.Bool("size", false, "write the size in bytes of each image as a column after its height")
+	var imageFormat *bool = flag.Bool("imageformat", false, "write the format each image was decoded from (jpeg, png, gif, ...) as a column after its height and size")
+	var timings *bool = flag.Bool("timings", false, "write how long each image spent downloading and summarizing as download_ms and summarize_ms columns")
+	var showVersion *bool = flag.Bool("version", false, "print the version and exit")
+	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
+	var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
+
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	log.Println(versionString())
+
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	if setFlags["workers"] {
+		download, summarize, cleanup := workerCounts(*nWorkers)
+		if !setFlags["download"] {
+			*nDownload = download
+		}
+		if !setFlags["summarize"] {
+			*nSummarize = summarize
+		}
+		if !setFlags["cleanup"] {
+			*nCleanup = cleanup
+		}
+	}
+
+	if *cpuprofile != "" {
+		f, err := os.Create(*cpuprofile)
+		if err != nil {
+			log.Fatal("could not create CPU profile: ", err)
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatal("could not start CPU profile: ", err)
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	if *minAlpha > 255 {
+		log.Println("minalpha must be between 0 and 255")
+		flag.Usage()
+		return
+	}
+
+	format, err := rquent.ParseOutputFormat(*outFormat)
+	if err != nil {
+		log.Println(err)
+		flag.Usage()
+		return
+	}
+
+	if *delimiter == `\t` || strings.EqualFold(*delimiter, "tab") {
+		*delimiter = "\t"
+	}
+	if utf8.RuneCountInString(*delimiter) != 1 {
+		log.Printf("delimiter must be a single character, got %q", *delimiter)
+		flag.Usage()
+		return
+	}
+	delimiterRune, _ := utf8.DecodeRuneInString(*delimiter)
+
+	// Setup input and output files
+	var csvoutFile *os.File
+	if *rotate > 0 {
+		err = os.MkdirAll(*csvoutPath, 0755)
+	} else if *resume {
+		csvoutFile, err = rquent.OpenResumeFile(*csvoutPath)
+	} else {
+		csvoutFile, err = os.Create(*csvoutPath)
+	}
+	if err != nil {
+		log.Printf("Failed to open output file (%v): %v", *csvoutPath, err)
+		flag.Usage()
+		return
+	}
+	if csvoutFile != nil {
+		defer csvoutFile.Close()
+	}
+
+	var errorsFile *os.File
+	if *errorsPath != "" {
+		errorsFile, err = os.Create(*errorsPath)
+		if err != nil {
+			log.Printf("Failed to open errors file (%v): %v", *errorsPath, err)
+			flag.Usage()
+			return
+		}
+		defer errorsFile.Close()
+	}
+
+	var imagesFile io.Reader
+	if *dir == "" {
+		var closeImages func() error
+		imagesFile, closeImages, err = openSource(*imagesPath)
+		if err != nil {
+			log.Printf("Failed to open source file (%v): %v", *imagesPath, err)
+			flag.Usage()
+			return
+		}
+		defer closeImages()
+	}
+
+	var proxyURL *url.URL
+	if *proxy != "" {
+		proxyURL, err = url.Parse(*proxy)
+		if err != nil {
+			log.Printf("Failed to parse proxy url (%v): %v", *proxy, err)
+			flag.Usage()
+			return
+		}
+	}
+
+	var rootCAs *x509.CertPool
+	if *caCert != "" {
+		pem, err := ioutil.ReadFile(*caCert)
+		if err != nil {
+			log.Printf("Failed to read CA certificates (%v): %v", *caCert, err)
+			flag.Usage()
+			return
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			log.Printf("No PEM certificates found in %v", *caCert)
+			flag.Usage()
+			return
+		}
+	}
+
+	var creds map[string]rquent.Credential
+	if *credsPath != "" {
+		f, err := os.Open(*credsPath)
+		if err != nil {
+			log.Printf("Failed to open credentials (%v): %v", *credsPath, err)
+			flag.Usage()
+			return
+		}
+		creds, err = rquent.ReadCredentials(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Failed to read credentials (%v): %v", *credsPath, err)
+			flag.Usage()
+			return
+		}
+	}
+
+	var allowedFormats []string
+	for _, name := range strings.Split(*formats, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			allowedFormats = append(allowedFormats, name)
+		}
+	}
+
+	var model color.Model
+	switch strings.ToLower(*colorModel) {
+	case "":
+	case "gray", "grey", "grayscale":
+		model = color.GrayModel
+	case "sepia":
+		model = rquent.SepiaModel
+	default:
+		log.Printf("Unknown color model: %v", *colorModel)
+		flag.Usage()
+		return
+	}
+
+	backgroundColor, err := rquent.ParseHexColor(*background)
+	if err != nil {
+		log.Println(err)
+		flag.Usage()
+		return
+	}
+
+	// Create and configure the pipeline
+	summarizeCfg := rquent.SummarizeConfig{
+		K:                *nColors,
+		MinAlpha:         uint8(*minAlpha),
+		QuantizeBits:     *quantize,
+		SampleStride:     *stride,
+		MaxDimension:     *maxDimension,
+		CropFraction:     *cropFraction,
+		MinFraction:      *minFraction,
+		AllowedFormats:   allowedFormats,
+		MaxPixels:        *maxPixels,
+		Average:          *average,
+		Fractions:        *fractions,
+		Orientation:      *orientation,
+		MergeDistance:    *mergeDistance,
+		AllFrames:        *allFrames,
+		WeightSaturation: *weightSaturation,
+		PenalizeExtremes: *penalizeExtremes,
+		ColorModel:       model,
+		Composite:        *composite,
+		Background:       backgroundColor,
+	}
+	downloadCfg := rquent.DefaultDownloadConfig
+	downloadCfg.Retries = *retries
+	downloadCfg.MaxBytes = *maxBytes
+	downloadCfg.MaxTotalBytes = *maxTotalBytes
+	downloadCfg.MaxRedirects = *maxRedirects
+	downloadCfg.RequestsPerSecond = *rateLimit
+	downloadCfg.ConnectTimeout = *connectTimeout
+	downloadCfg.TLSHandshakeTimeout = *tlsTimeout
+	downloadCfg.ResponseHeaderTimeout = *headerTimeout
+	pipeCfg := rquent.PipeConfig{
+		Download:        *nDownload,
+		Summarize:       *nSummarize,
+		Cleanup:         *nCleanup,
+		DownloadBuffer:  *downloadBuffer,
+		SummarizeBuffer: *summarizeBuffer,
+		CleanupBuffer:   *cleanupBuffer,
+		SaveBuffer:      *saveBuffer,
+	}
+	logLevel := rquent.LogLevelDebug
+	if *quiet {
+		logLevel = rquent.LogLevelInfo
+	}
+	pipeline := rquent.NewPipeline(pipeCfg)
+	if *dir != "" {
+		pipeline.WithDirectory(*dir, *pattern)
+	} else if *csvColumn >= 0 {
+		pipeline.WithCSVSource(imagesFile, *csvColumn, *csvHeader)
+	} else {
+		pipeline.WithSource(imagesFile)
+	}
+	if *resume {
+		pipeline.WithResume(csvoutFile)
+	}
+	if errorsFile != nil {
+		pipeline.WithErrorOutput(errorsFile)
+	}
+	if *stallWarning > 0 {
+		pipeline.WithWatchdog(*stallWarning, nil)
+	}
+	if *loginURL != "" {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		pipeline.WithCookieJar(jar)
+	}
+	if *webhookURL != "" {
+		// its own client, so -timeout and the download transport settings don't apply
+		pipeline.WithWebhook(*webhookURL, nil)
+	}
+	if *rotate > 0 {
+		pipeline.WithRotatingOutput(*csvoutPath, *rotate)
+	} else {
+		pipeline.WithOutput(csvoutFile)
+	}
+	pipeline, err = pipeline.
+		WithFormat(format).
+		WithDelimiter(delimiterRune).
+		WithHeader(*outHeader).
+		WithHexFormat(rquent.HexFormat{Uppercase: *upperHex, Alpha: *hexAlpha}).
+		WithHSL(*hsl).
+		WithTimings(*timings).
+		WithSize(*size).
+		WithImageFormat(*imageFormat).
+		WithCache(*cacheDir).
+		WithOrderedOutput(*ordered).
+		WithFlushInterval(*flushInterval).
+		WithSyncOutput(*syncOutput).
+		WithInMemory(*inMemory).
+		WithKeepImages(*keepDir).
+		WithSwatches(*swatchDir).
+		WithContentDedup(*dedup).
+		WithDryRun(*dryRun).
+		WithDownloadConfig(downloadCfg).
+		WithTimeout(*timeout).
+		WithHeaders(http.Header(headers)).
+		WithCredentials(creds).
+		WithFetchers(fetchers).
+		WithProxy(proxyURL).
+		WithInsecureSkipVerify(*insecure).
+		WithRootCAs(rootCAs).
+		WithMaxConcurrentHosts(*perHost).
+		WithMaxIdleConnsPerHost(*idleConns).
+		WithMaxConnsPerHost(*maxConns).
+		WithRobotsTxt(*robots).
+		WithStartupJitter(*startJitter).
+		WithRetryDelay(*requeueDelay, *maxRequeueDelay).
+		WithRetryBudget(*retryBudget).
+		WithDeadline(*deadline).
+		WithLimit(*limit).
+		WithMaxLineLength(*maxLine).
+		WithSummarizeConfig(summarizeCfg).
+		WithLogger(rquent.NewStdLogger(nil, logLevel)).
+		Init()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *loginURL != "" {
+		req, err := http.NewRequest(http.MethodPost, *loginURL, strings.NewReader(os.ExpandEnv(*loginForm)))
+		if err != nil {
+			log.Fatalln("Failed to log in: ", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err := pipeline.Login(req); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	stopMetrics, err := serveMetrics(*metricsAddr, pipeline)
+	if err != nil {
+		log.Fatalln("Failed to serve metrics: ", err)
+	}
+
+	// Run it
+	ctx, stopInterrupts := interruptContext()
+	result, runErr := pipeline.RunContext(ctx)
+	stopInterrupts()
+	stopMetrics()
+	log.Printf("%v succeeded, %v failed, %v skipped", result.Succeeded, result.Failed, result.Skipped)
+	log.Printf("Errors by type: %v", result.ErrorSummary())
+	log.Printf("%v bytes downloaded", pipeline.Stats().Bytes)
+	if over := pipeline.Stats().OverRetryBudget; over > 0 {
+		log.Printf("%v errors not retried because the retry budget was used up", over)
+	}
+	if *resume {
+		log.Printf("%v already done by the resumed run", result.Resumed)
+	}
+
+	if *memprofile != "" {
+		f, err := os.Create(*memprofile)
+		if err != nil {
+			log.Fatal("could not create memory profile: ", err)
+		}
+		defer f.Close()
+		runtime.GC() // get up-to-date statistics
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			log.Fatal("could not write memory profile: ", err)
+		}
+	}
+
+	if runErr != nil {
+		log.Fatalln("Pipeline did not complete: ", runErr)
+	}
+}
@@ -0,0 +1,104 @@
+//go:build prometheus
+// +build prometheus
+
+package main
+
+// Serves the pipeline's metrics for Prometheus. Build with `-tags prometheus` to enable.
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/macintoshpie/rquent"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Histogram of summarize durations in seconds
+type summarizeHistogram struct {
+	prometheus.Histogram
+}
+
+func (h summarizeHistogram) ObserveSummarize(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// Collects the errors of a pipeline by type
+type errorsCollector struct {
+	pipeline *rquent.RqPipeline
+	desc     *prometheus.Desc
+}
+
+func (c errorsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c errorsCollector) Collect(ch chan<- prometheus.Metric) {
+	for errorType, n := range c.pipeline.Stats().Errors {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(n), errorType.String())
+	}
+}
+
+// Register the pipeline's counters and a summarize duration histogram with reg
+// Must be called before the pipeline runs so the histogram sees every job
+func registerMetrics(reg prometheus.Registerer, pipeline *rquent.RqPipeline) error {
+	counter := func(name string, help string, value func(rquent.RqStats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(
+			prometheus.CounterOpts{Namespace: "rquent", Name: name, Help: help},
+			func() float64 { return float64(value(pipeline.Stats())) },
+		)
+	}
+	summarize := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "rquent",
+		Name:      "summarize_duration_seconds",
+		Help:      "Time spent summarizing each image, including decoding it.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	collectors := []prometheus.Collector{
+		counter("read_total", "Entries read from the source.", func(s rquent.RqStats) uint64 { return s.Read }),
+		counter("downloaded_total", "Images downloaded.", func(s rquent.RqStats) uint64 { return s.Downloaded }),
+		counter("downloaded_bytes_total", "Bytes of images downloaded.", func(s rquent.RqStats) uint64 { return s.Bytes }),
+		counter("summarized_total", "Images summarized.", func(s rquent.RqStats) uint64 { return s.Summarized }),
+		counter("saved_total", "Results written to the output.", func(s rquent.RqStats) uint64 { return s.Saved }),
+		counter("failed_total", "Images that failed.", func(s rquent.RqStats) uint64 { return s.Failed }),
+		errorsCollector{
+			pipeline: pipeline,
+			desc:     prometheus.NewDesc("rquent_errors_total", "Job errors by type, including retried ones.", []string{"type"}, nil),
+		},
+		summarize,
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	pipeline.WithMetrics(summarizeHistogram{summarize})
+	return nil
+}
+
+// Serve the pipeline's metrics on addr at /metrics until the returned function is called
+func serveMetrics(addr string, pipeline *rquent.RqPipeline) (func(), error) {
+	if addr == "" {
+		return func() {}, nil
+	}
+	reg := prometheus.NewRegistry()
+	if err := registerMetrics(reg, pipeline); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
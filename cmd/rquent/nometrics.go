@@ -0,0 +1,18 @@
+//go:build !prometheus
+// +build !prometheus
+
+package main
+
+import (
+	"errors"
+
+	"github.com/macintoshpie/rquent"
+)
+
+// Metrics require the Prometheus client, so without the prometheus build tag asking for them fails
+func serveMetrics(addr string, pipeline *rquent.RqPipeline) (func(), error) {
+	if addr == "" {
+		return func() {}, nil
+	}
+	return nil, errors.New("metrics aren't supported by this build; build with -tags prometheus to enable them")
+}
@@ -0,0 +1,65 @@
+//go:build s3
+// +build s3
+
+package main
+
+// Reads s3://bucket/key urls from Amazon S3, with the credentials and region of the AWS SDK's
+// default config (environment, shared config files or an instance role). Build with `-tags s3` to enable.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/macintoshpie/rquent"
+)
+
+// Client is created on the first url, so a run without s3 urls doesn't need AWS credentials
+type s3Fetcher struct {
+	once   sync.Once
+	client *s3.Client
+	err    error
+}
+
+func (f *s3Fetcher) Fetch(ctx context.Context, rawURL string) (io.ReadCloser, int64, error) {
+	bucket, key, err := objectPath(rawURL)
+	if err != nil {
+		return nil, -1, err
+	}
+	f.once.Do(func() {
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			f.err = err
+			return
+		}
+		f.client = s3.NewFromConfig(cfg)
+	})
+	if f.err != nil {
+		return nil, -1, f.err
+	}
+
+	out, err := f.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	var noKey *types.NoSuchKey
+	var noBucket *types.NoSuchBucket
+	if errors.As(err, &noKey) || errors.As(err, &noBucket) {
+		return nil, -1, &rquent.DownloadError{StatusCode: http.StatusNotFound, URL: rawURL}
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+	size := int64(-1)
+	if out.ContentLength != nil {
+		size = *out.ContentLength
+	}
+	return out.Body, size, nil
+}
+
+func init() {
+	fetchers["s3"] = &s3Fetcher{}
+}
@@ -0,0 +1,7 @@
+//go:build webp
+// +build webp
+
+package main
+
+// Registers the webp decoder with the image package. Build with `-tags webp` to enable.
+import _ "golang.org/x/image/webp"
@@ -0,0 +1,198 @@
+package rquent
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// Color in the CIE L*a*b* space, where euclidean distance approximates perceived difference
+type labColor struct {
+	L, A, B float64
+}
+
+// Convert an sRGB channel value to linear light
+func linearize(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func labF(t float64) float64 {
+	const delta = 6.0 / 29
+	if t > delta*delta*delta {
+		return math.Cbrt(t)
+	}
+	return t/(3*delta*delta) + 4.0/29
+}
+
+// Convert a color to L*a*b* (D65 white point), ignoring alpha
+func toLab(c color.NRGBA) labColor {
+	r, g, b := linearize(c.R), linearize(c.G), linearize(c.B)
+
+	// linear sRGB to XYZ, normalized by the D65 white point
+	x := (0.4124564*r + 0.3575761*g + 0.1804375*b) / 0.95047
+	y := 0.2126729*r + 0.7151522*g + 0.0721750*b
+	z := (0.0193339*r + 0.1191920*g + 0.9503041*b) / 1.08883
+
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return labColor{
+		L: 116*fy - 16,
+		A: 500 * (fx - fy),
+		B: 200 * (fy - fz),
+	}
+}
+
+// CIE76 color difference; about 2.3 is a just noticeable difference
+func deltaE(a, b labColor) float64 {
+	dL, dA, dB := a.L-b.L, a.A-b.A, a.B-b.B
+	return math.Sqrt(dL*dL + dA*dA + dB*dB)
+}
+
+// Merge colors within distance (Delta E) of a more prevalent color into that color's count
+// Colors are visited most prevalent first, and each joins the closest existing bucket in range,
+// so the most prevalent color of a bucket represents it. This is O(colors * buckets), so it's
+// best combined with quantization on photographic images.
+func mergeSimilarColors(counts map[color.NRGBA]uint64, distance float64) map[color.NRGBA]uint64 {
+	sorted := make([]colorCount, 0, len(counts))
+	for c, n := range counts {
+		sorted = append(sorted, colorCount{c, n})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return lessPrevalent(sorted[j], sorted[i])
+	})
+
+	type bucket struct {
+		color color.NRGBA
+		lab   labColor
+	}
+	var buckets []bucket
+	merged := make(map[color.NRGBA]uint64)
+	for _, cc := range sorted {
+		lab := toLab(cc.color)
+		closest, closestDist := -1, distance
+		for i, b := range buckets {
+			if d := deltaE(lab, b.lab); d <= closestDist {
+				closest, closestDist = i, d
+			}
+		}
+
+		if closest == -1 {
+			buckets = append(buckets, bucket{cc.color, lab})
+			merged[cc.color] = cc.count
+		} else {
+			merged[buckets[closest].color] += cc.count
+		}
+	}
+	return merged
+}
+
+// Saturation and lightness of a color in the HSL model, each in [0, 1]
+func saturationLightness(c color.NRGBA) (float64, float64) {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	l := (max + min) / 2
+	if max == min {
+		// gray
+		return 0, l
+	}
+	if l > 0.5 {
+		return (max - min) / (2 - max - min), l
+	}
+	return (max - min) / (max + min), l
+}
+
+// Hue of a color in the HSL model, in degrees [0, 360); 0 for grays
+func hue(c color.NRGBA) float64 {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	max := math.Max(r, math.Max(g, b))
+	d := max - math.Min(r, math.Min(g, b))
+	if d == 0 {
+		return 0
+	}
+	var h float64
+	switch max {
+	case r:
+		h = math.Mod((g-b)/d+6, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	return h * 60
+}
+
+// Get NRGBA color as a CSS hsl string (e.g. hsl(0,100%,50%)), ignoring alpha
+func hslString(c color.NRGBA) string {
+	s, l := saturationLightness(c)
+	h := int(math.Round(hue(c))) % 360
+	return fmt.Sprintf("hsl(%d,%d%%,%d%%)", h, int(math.Round(s*100)), int(math.Round(l*100)))
+}
+
+// Lowest weight given to a color, so dull colors can still be picked when there's nothing better
+const minColorWeight = 0.1
+
+// Weighted counts are scaled up so small counts keep their resolution when rounded
+const colorWeightScale = 1024
+
+// Weight of a color for ranking: its saturation, and how far it is from black or white
+// Each factor is only applied if enabled; the result is in [minColorWeight, 1]
+func colorWeight(c color.NRGBA, saturation bool, extremes bool) float64 {
+	s, l := saturationLightness(c)
+	weight := 1.0
+	if saturation {
+		weight *= s
+	}
+	if extremes {
+		// 1 at mid lightness down to 0 at black and white
+		weight *= 1 - math.Abs(2*l-1)
+	}
+	return minColorWeight + (1-minColorWeight)*weight
+}
+
+// Scale each color's count by its colorWeight, so the top k are the most prevalent vivid colors
+// rather than whatever covers the most pixels (often a dull background)
+func weightColors(counts map[color.NRGBA]uint64, saturation bool, extremes bool) map[color.NRGBA]uint64 {
+	weighted := make(map[color.NRGBA]uint64, len(counts))
+	for c, n := range counts {
+		weighted[c] = uint64(float64(n) * colorWeight(c, saturation, extremes) * colorWeightScale)
+	}
+	return weighted
+}
+
+// Blend a color over an opaque background by its alpha, giving the opaque color it appears as
+func compositeOver(c color.Color, bg color.NRGBA) color.NRGBA {
+	// RGBA is alpha-premultiplied, so only the background needs scaling
+	r, g, b, a := c.RGBA()
+	over := func(v uint32, bgv uint8) uint8 {
+		return uint8((v + uint32(bgv)*0x101*(0xffff-a)/0xffff) >> 8)
+	}
+	return color.NRGBA{R: over(r, bg.R), G: over(g, bg.G), B: over(b, bg.B), A: 255}
+}
+
+// Converts colors to sepia tones with the usual sepia matrix, keeping alpha; use as
+// SummarizeConfig.ColorModel to find the prevalent colors of a sepia version of an image
+var SepiaModel color.Model = color.ModelFunc(sepiaModel)
+
+func sepiaModel(c color.Color) color.Color {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	r, g, b := float64(n.R), float64(n.G), float64(n.B)
+	return color.NRGBA{
+		R: clampChannel(0.393*r + 0.769*g + 0.189*b),
+		G: clampChannel(0.349*r + 0.686*g + 0.168*b),
+		B: clampChannel(0.272*r + 0.534*g + 0.131*b),
+		A: n.A,
+	}
+}
+
+// Round a channel value, capping it at 255
+func clampChannel(v float64) uint8 {
+	if v >= 255 {
+		return 255
+	}
+	return uint8(math.Round(v))
+}
@@ -0,0 +1,155 @@
+package rquent
+
+import (
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestToLab(t *testing.T) {
+	white := toLab(color.NRGBA{255, 255, 255, 255})
+	if math.Abs(white.L-100) > 0.01 || math.Abs(white.A) > 0.01 || math.Abs(white.B) > 0.01 {
+		t.Errorf("Expected (100, 0, 0) Got (%v)", white)
+	}
+
+	// reference value for pure red
+	r := toLab(red)
+	if math.Abs(r.L-53.24) > 0.01 || math.Abs(r.A-80.09) > 0.01 || math.Abs(r.B-67.20) > 0.01 {
+		t.Errorf("Expected (53.24, 80.09, 67.20) Got (%v)", r)
+	}
+}
+
+func TestMergeSimilarColors(t *testing.T) {
+	nearRed := color.NRGBA{254, 0, 0, 255}
+	counts := map[color.NRGBA]uint64{red: 5, nearRed: 4, blue: 6}
+
+	merged := mergeSimilarColors(counts, 2.3)
+	if len(merged) != 2 {
+		t.Fatalf("Expected (2 colors) Got (%v)", merged)
+	}
+	if merged[red] != 9 || merged[blue] != 6 {
+		t.Errorf("Expected (red 9, blue 6) Got (%v)", merged)
+	}
+}
+
+func TestGetPrevalentColorsMergeDistance(t *testing.T) {
+	const width, height = 100, 10
+	colors := []colorFreq{
+		colorFreq{blue, .4},
+		colorFreq{red, .35},
+		colorFreq{color.NRGBA{254, 1, 0, 255}, .25},
+	}
+	colorImg := newColorsImage(width, height, colors, false)
+
+	summary, _ := getPrevalentColors(&colorImg, SummarizeConfig{K: 3, MergeDistance: 2.3})
+	if summary.Colors[0] != red || summary.Colors[1] != blue {
+		t.Errorf("Expected ([%v %v ...]) Got (%v)", red, blue, summary.Colors)
+	}
+	if summary.Colors[2] != PlaceholderColor {
+		t.Errorf("Expected (colors[2] == placeholder) Got (%v)", summary.Colors[2])
+	}
+}
+
+func TestColorWeight(t *testing.T) {
+	gray := color.NRGBA{128, 128, 128, 255}
+	if w := colorWeight(gray, true, false); w != minColorWeight {
+		t.Errorf("Expected (gray weight %v) Got (%v)", minColorWeight, w)
+	}
+	if w := colorWeight(red, true, false); w != 1 {
+		t.Errorf("Expected (red weight 1) Got (%v)", w)
+	}
+	if w := colorWeight(white, false, true); w != minColorWeight {
+		t.Errorf("Expected (white weight %v) Got (%v)", minColorWeight, w)
+	}
+	if w := colorWeight(gray, false, false); w != 1 {
+		t.Errorf("Expected (unweighted 1) Got (%v)", w)
+	}
+}
+
+func TestGetPrevalentColorsWeightSaturation(t *testing.T) {
+	const width, height = 100, 10
+	gray := color.NRGBA{128, 128, 128, 255}
+	colors := []colorFreq{
+		colorFreq{gray, .6},
+		colorFreq{red, .4},
+	}
+	colorImg := newColorsImage(width, height, colors, false)
+
+	// raw counts by default
+	summary, _ := getPrevalentColors(&colorImg, SummarizeConfig{K: 2})
+	if summary.Colors[0] != gray {
+		t.Errorf("Expected (colors[0] == %v) Got (%v)", gray, summary.Colors)
+	}
+
+	summary, _ = getPrevalentColors(&colorImg, SummarizeConfig{K: 2, WeightSaturation: true})
+	if summary.Colors[0] != red || summary.Colors[1] != gray {
+		t.Errorf("Expected ([%v %v]) Got (%v)", red, gray, summary.Colors)
+	}
+}
+
+func TestGetPrevalentColorsPenalizeExtremes(t *testing.T) {
+	const width, height = 100, 10
+	gray := color.NRGBA{128, 128, 128, 255}
+	colors := []colorFreq{
+		colorFreq{white, .6},
+		colorFreq{gray, .4},
+	}
+	colorImg := newColorsImage(width, height, colors, false)
+
+	summary, _ := getPrevalentColors(&colorImg, SummarizeConfig{K: 2, PenalizeExtremes: true})
+	if summary.Colors[0] != gray || summary.Colors[1] != white {
+		t.Errorf("Expected ([%v %v]) Got (%v)", gray, white, summary.Colors)
+	}
+}
+
+func TestHSLString(t *testing.T) {
+	for _, test := range []struct {
+		c        color.NRGBA
+		expected string
+	}{
+		{red, "hsl(0,100%,50%)"},
+		{green, "hsl(120,100%,50%)"},
+		{blue, "hsl(240,100%,50%)"},
+		{color.NRGBA{255, 255, 255, 255}, "hsl(0,0%,100%)"},
+		{color.NRGBA{128, 128, 128, 255}, "hsl(0,0%,50%)"},
+		{color.NRGBA{255, 0, 255, 255}, "hsl(300,100%,50%)"},
+		{color.NRGBA{51, 102, 153, 255}, "hsl(210,50%,40%)"},
+	} {
+		if got := hslString(test.c); got != test.expected {
+			t.Errorf("Expected (%v) Got (%v)", test.expected, got)
+		}
+	}
+}
+
+func TestSepiaModel(t *testing.T) {
+	for _, test := range []struct {
+		in       color.Color
+		expected color.NRGBA
+	}{
+		{white, color.NRGBA{255, 255, 239, 255}},
+		{black, black},
+		{color.NRGBA{100, 50, 20, 128}, color.NRGBA{82, 73, 57, 128}},
+	} {
+		if c := SepiaModel.Convert(test.in); c != test.expected {
+			t.Errorf("Expected (%v) Got (%v)", test.expected, c)
+		}
+	}
+}
+
+func TestCompositeOver(t *testing.T) {
+	halfRed := color.NRGBA{255, 0, 0, 128}
+	for _, test := range []struct {
+		in       color.Color
+		bg       color.NRGBA
+		expected color.NRGBA
+	}{
+		{halfRed, white, color.NRGBA{255, 127, 127, 255}},
+		{halfRed, black, color.NRGBA{128, 0, 0, 255}},
+		{color.NRGBA{}, white, white},
+		{red, black, red},
+	} {
+		if c := compositeOver(test.in, test.bg); c != test.expected {
+			t.Errorf("Expected (%v) Got (%v)", test.expected, c)
+		}
+	}
+}
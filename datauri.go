@@ -0,0 +1,68 @@
+package rquent
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Returned for data: URIs that can't be decoded; retrying won't change them
+var errInvalidDataURI = errors.New("Invalid data URI")
+
+// Media type of data: URIs that don't give one (RFC 2397)
+const defaultDataMediaType = "text/plain;charset=US-ASCII"
+
+// Check if an image url is a data: URI holding the image itself
+func isDataURI(imgURL string) bool {
+	return len(imgURL) >= 5 && strings.EqualFold(imgURL[:5], "data:")
+}
+
+// Decode a data: URI (e.g. data:image/png;base64,...) into its media type and payload
+func parseDataURI(uri string) (string, []byte, error) {
+	if !isDataURI(uri) {
+		return "", nil, errInvalidDataURI
+	}
+	comma := strings.IndexByte(uri, ',')
+	if comma < 0 {
+		return "", nil, errInvalidDataURI
+	}
+	meta, payload := uri[5:comma], uri[comma+1:]
+
+	isBase64 := false
+	if strings.HasSuffix(strings.ToLower(meta), ";base64") {
+		isBase64 = true
+		meta = meta[:len(meta)-len(";base64")]
+	}
+	mediaType := meta
+	if mediaType == "" || strings.HasPrefix(mediaType, ";") {
+		mediaType = "text/plain" + mediaType
+		if meta == "" {
+			mediaType = defaultDataMediaType
+		}
+	}
+
+	// the payload may be percent-encoded, including the base64 of some encoders
+	unescaped, err := url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, errInvalidDataURI
+	}
+	if !isBase64 {
+		return mediaType, []byte(unescaped), nil
+	}
+	unescaped = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, unescaped)
+	data, err := base64.StdEncoding.DecodeString(unescaped)
+	if err != nil {
+		// some encoders leave out the padding
+		data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(unescaped, "="))
+	}
+	if err != nil {
+		return "", nil, errInvalidDataURI
+	}
+	return mediaType, data, nil
+}
@@ -0,0 +1,84 @@
+package rquent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestParseDataURI(t *testing.T) {
+	tests := []struct {
+		uri       string
+		mediaType string
+		data      string
+	}{
+		{"data:image/png;base64,aGVsbG8=", "image/png", "hello"},
+		{"data:image/png;base64,aGVsbG8", "image/png", "hello"},
+		{"DATA:image/png;BASE64,aGVs%0AbG8=", "image/png", "hello"},
+		{"data:,hello%20world", defaultDataMediaType, "hello world"},
+		{"data:;charset=utf-8,hi", "text/plain;charset=utf-8", "hi"},
+	}
+	for _, test := range tests {
+		mediaType, data, err := parseDataURI(test.uri)
+		if err != nil {
+			t.Errorf("Expected (nil) Got (%v) for %v", err, test.uri)
+			continue
+		}
+		if mediaType != test.mediaType || string(data) != test.data {
+			t.Errorf("Expected (%v %q) Got (%v %q) for %v", test.mediaType, test.data, mediaType, data, test.uri)
+		}
+	}
+
+	for _, uri := range []string{"data:image/png;base64", "data:image/png;base64,!!!", "data:,%zz", "http://www.test.com"} {
+		if _, _, err := parseDataURI(uri); err != errInvalidDataURI {
+			t.Errorf("Expected (%v) Got (%v) for %v", errInvalidDataURI, err, uri)
+		}
+	}
+}
+
+// encode a small red PNG as a data: URI
+func newPNGDataURI(t *testing.T) string {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for x := 0; x < 3; x += 1 {
+		for y := 0; y < 2; y += 1 {
+			img.Set(x, y, red)
+		}
+	}
+	b := new(bytes.Buffer)
+	if err := png.Encode(b, img); err != nil {
+		t.Fatal(err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(b.Bytes())
+}
+
+func TestPipelineRunDataURI(t *testing.T) {
+	uri := newPNGDataURI(t)
+	for _, inMemory := range []bool{false, true} {
+		b := new(bytes.Buffer)
+		errOut := new(bytes.Buffer)
+		pipeline, err := NewPipeline(testPipeConfig).
+			WithSource(strings.NewReader("data:image/png;base64,!!!\n" + uri)).
+			WithOutput(b).
+			WithErrorOutput(errOut).
+			WithInMemory(inMemory).
+			Init()
+
+		if err != nil {
+			t.Fatalf("Expected (nil) Got (%v)", err)
+		}
+
+		pipeline.Run()
+		// the comma in the uri is quoted
+		expected := `"` + uri + `",3,2,#ff0000,#000000,#000000` + "\n"
+		if b.String() != expected {
+			t.Errorf("Expected (%v) Got (%v) with inMemory %v", expected, b.String(), inMemory)
+		}
+		stats := pipeline.Stats()
+		if stats.Failed != 1 || stats.Errors[RqErrorNoRetry] != 1 {
+			t.Errorf("Expected (malformed uri to fail without retrying) Got (%v failed, errors %v)", stats.Failed, stats.Errors)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package rquent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+)
+
+// Summaries of the images downloaded so far in a run, keyed by a hash of their content, so the same
+// image served under several urls is only decoded and summarized once; safe for use by multiple workers
+type contentCache struct {
+	mu      sync.Mutex
+	entries map[string]contentEntry
+}
+
+// What a duplicate image needs from the first image with its content
+type contentEntry struct {
+	width   int
+	height  int
+	format  string
+	summary ColorSummary
+	result  Summary
+}
+
+func newContentCache() *contentCache {
+	return &contentCache{entries: make(map[string]contentEntry)}
+}
+
+// Hash the downloaded content of img from f, and reuse the summary of an earlier image with the same
+// content if there is one; f is read from the start and left there
+func (c *contentCache) lookup(img *RqImage, f *os.File) (bool, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return false, err
+	}
+	img.contentHash = hex.EncodeToString(h.Sum(nil))
+
+	c.mu.Lock()
+	entry, ok := c.entries[img.contentHash]
+	c.mu.Unlock()
+	if ok {
+		img.width = entry.width
+		img.height = entry.height
+		img.format = entry.format
+		img.summary = entry.summary
+		img.result = entry.result
+		img.duplicate = true
+	}
+	return ok, nil
+}
+
+// Remember the summary of a finished image for later images with the same content
+// Images that were still being summarized when a duplicate was downloaded are summarized again
+func (c *contentCache) store(img RqImage) {
+	if img.contentHash == "" || img.duplicate || img.cached {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[img.contentHash] = contentEntry{img.width, img.height, img.format, img.summary, img.result}
+}
@@ -0,0 +1,113 @@
+package rquent
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// summarizer that counts the images it summarizes
+type countingSummarizer struct {
+	cornerSummarizer
+	n *int32
+}
+
+func (s countingSummarizer) Summarize(img image.Image) (Summary, error) {
+	atomic.AddInt32(s.n, 1)
+	return s.cornerSummarizer.Summarize(img)
+}
+
+func TestContentCache(t *testing.T) {
+	// Test images are only found by the hash of their content once stored
+	f, err := ioutil.TempFile("", "*.tmpimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.WriteString("image")
+	f.Seek(0, 0)
+
+	c := newContentCache()
+	first := RqImage{URL: "a"}
+	if found, err := c.lookup(&first, f); found || err != nil || first.contentHash == "" {
+		t.Errorf("Expected (not found, hashed) Got (%v, %v, %q)", found, err, first.contentHash)
+	}
+	first.width = 3
+	first.summary = ColorSummary{Colors: []color.NRGBA{red, green}}
+	c.store(first)
+
+	second := RqImage{URL: "b"}
+	if found, err := c.lookup(&second, f); !found || err != nil {
+		t.Errorf("Expected (found) Got (%v, %v)", found, err)
+	}
+	if !second.duplicate || second.width != 3 || len(second.summary.Colors) != 2 {
+		t.Errorf("Expected (summary of %+v) Got (%+v)", first, second)
+	}
+	// duplicates aren't stored again
+	second.width = 4
+	c.store(second)
+	if c.entries[first.contentHash].width != 3 {
+		t.Errorf("Expected (3) Got (%v)", c.entries[first.contentHash].width)
+	}
+	// and the file can still be read from the start
+	if b, _ := ioutil.ReadAll(f); string(b) != "image" {
+		t.Errorf("Expected (image) Got (%s)", b)
+	}
+}
+
+func TestPipelineRunContentDedup(t *testing.T) {
+	// Test an image served under a second url is summarized once
+	firstDone := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/b.jpg" {
+			<-firstDone
+		}
+		data, _ := ioutil.ReadFile(testImagePathValid)
+		w.Write(data)
+	}))
+	defer s.Close()
+
+	var summarized int32
+	results := make(chan RqImage)
+	pipeline, err := NewPipeline(PipeConfig{Download: 2, Summarize: 1, Cleanup: 1}).
+		WithSource(strings.NewReader(s.URL + "/a.jpg\n" + s.URL + "/b.jpg")).
+		WithResultChannel(results).
+		WithSummarizer(countingSummarizer{n: &summarized}).
+		WithContentDedup(true).
+		Init()
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	go pipeline.Run()
+	first := <-results
+	close(firstDone)
+	second := <-results
+	for range results {
+	}
+	if n := atomic.LoadInt32(&summarized); n != 1 {
+		t.Errorf("Expected (1 image summarized) Got (%v)", n)
+	}
+	if second.URL != s.URL+"/b.jpg" || second.Width() != first.Width() || second.Result() != first.Result() {
+		t.Errorf("Expected (result of %+v) Got (%+v)", first, second)
+	}
+}
+
+func TestMakePipelineContentDedupInMemory(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithOutput(ioutil.Discard).
+		WithInMemory(true).
+		WithContentDedup(true).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
@@ -0,0 +1,24 @@
+// Package rquent finds the most prevalent colors in images.
+//
+// SummarizeImage and SummarizeReader summarize a single image. An RqPipeline downloads and
+// summarizes a list of image urls with pools of workers, writing a line of output for each image:
+//
+//	pipeline, err := rquent.NewPipeline(rquent.PipeConfig{Download: 10, Summarize: 2, Cleanup: 2}).
+//		WithSource(urls).
+//		WithOutput(out).
+//		Init()
+//	if err != nil {
+//		return err
+//	}
+//	result, err := pipeline.Run()
+//
+// Once a run returns, the same pipeline can run the next batch after WithSource sets its urls.
+// WithResultChannel receives each summarized RqImage on a channel instead of writing output.
+// WithRotatingOutput splits the results into numbered files of a fixed number of lines.
+// WithWatchdog reports a run that has stopped making progress.
+// WithCache reuses the summaries of images that haven't changed since an earlier run.
+//
+// Decoders for the image formats to support must be registered, e.g. by importing image/jpeg, or
+// added to a pipeline with WithDecoder.
+// The rquent command in cmd/rquent wires the pipeline to command line flags.
+package rquent
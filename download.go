@@ -0,0 +1,785 @@
+package rquent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Time allowed for each download, including reading the body, unless the pipeline is given another
+const DefaultTimeout = time.Duration(5 * time.Second)
+
+func newClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+	}
+}
+
+// Copy client and its transport so the transport can be changed without affecting client
+func cloneTransport(client *http.Client) (*http.Client, *http.Transport, error) {
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, nil, errors.New("Can't configure a client that doesn't use an *http.Transport")
+	}
+	cloned := *client
+	cloned.Transport = transport
+	return &cloned, transport, nil
+}
+
+// Copy client so its requests are sent through proxy; client itself is left unchanged
+// Without a proxy, clients using the default transport already honor HTTP_PROXY and HTTPS_PROXY
+func withProxy(client *http.Client, proxy *url.URL) (*http.Client, error) {
+	proxied, transport, err := cloneTransport(client)
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy = http.ProxyURL(proxy)
+	return proxied, nil
+}
+
+// Copy client so it verifies servers with rootCAs (the system's if nil), or not at all with skipVerify
+// client itself is left unchanged
+func withTLS(client *http.Client, skipVerify bool, rootCAs *x509.CertPool) (*http.Client, error) {
+	configured, transport, err := cloneTransport(client)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	if skipVerify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if rootCAs != nil {
+		tlsConfig.RootCAs = rootCAs
+	}
+	transport.TLSClientConfig = tlsConfig
+	return configured, nil
+}
+
+// Copy client with the connection timeouts of cfg; client itself is left unchanged
+// Timeouts that are 0 keep the transport's own
+func withTransportTimeouts(client *http.Client, cfg DownloadConfig) (*http.Client, error) {
+	if cfg.ConnectTimeout == 0 && cfg.TLSHandshakeTimeout == 0 && cfg.ResponseHeaderTimeout == 0 {
+		return client, nil
+	}
+	configured, transport, err := cloneTransport(client)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ConnectTimeout > 0 {
+		// wrap the transport's dialer rather than replacing it, in case it's been customized
+		dial := transport.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{KeepAlive: 30 * time.Second}).DialContext
+		}
+		timeout := cfg.ConnectTimeout
+		transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return dial(ctx, network, addr)
+		}
+	}
+	if cfg.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	}
+	if cfg.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	}
+	return configured, nil
+}
+
+// Copy client with the given connection pool sizes for each host; client itself is left unchanged
+// Sizes that are 0 keep the transport's own. Keep-alives are turned back on so connections are reused
+func withConnPool(client *http.Client, maxIdlePerHost int, maxPerHost int) (*http.Client, error) {
+	if maxIdlePerHost == 0 && maxPerHost == 0 {
+		return client, nil
+	}
+	configured, transport, err := cloneTransport(client)
+	if err != nil {
+		return nil, err
+	}
+	transport.DisableKeepAlives = false
+	if maxIdlePerHost > 0 {
+		transport.MaxIdleConnsPerHost = maxIdlePerHost
+		if transport.MaxIdleConns > 0 && transport.MaxIdleConns < maxIdlePerHost {
+			// the total would evict connections the host is allowed to keep
+			transport.MaxIdleConns = maxIdlePerHost
+		}
+	}
+	if maxPerHost > 0 {
+		transport.MaxConnsPerHost = maxPerHost
+	}
+	return configured, nil
+}
+
+// Configuration for how images are downloaded
+type DownloadConfig struct {
+	Retries       int           // number of times to retry a request after a transient failure
+	RetryDelay    time.Duration // delay before the first retry; doubles with each attempt
+	MaxRetryDelay time.Duration // upper bound on the delay between retries (including Retry-After)
+	MaxBytes      int64         // largest image that will be downloaded (decompressed); 0 for no limit
+	// MaxTotalBytes stops starting downloads once this many bytes have been downloaded in total, letting the
+	// ones in progress finish; the rest of the urls are left unprocessed. Compressed responses count their
+	// compressed length, as in RqStats.Bytes. 0 for no limit
+	MaxTotalBytes int64
+	MaxRedirects  int // redirects to follow before giving up; 0 for the default (10)
+	// Timeouts for the stages of a request that hang on unresponsive hosts; 0 keeps the transport's own
+	ConnectTimeout        time.Duration // establishing the connection
+	TLSHandshakeTimeout   time.Duration // the TLS handshake of https urls
+	ResponseHeaderTimeout time.Duration // waiting for the response headers once the request is sent
+	// RequestsPerSecond caps requests across all download workers (including retries); 0 for no limit
+	RequestsPerSecond float64
+}
+
+// Download config used unless the pipeline is given another; copy it to change single values
+var DefaultDownloadConfig = DownloadConfig{
+	Retries:       0,
+	RetryDelay:    500 * time.Millisecond,
+	MaxRetryDelay: 10 * time.Second,
+}
+
+// Redirects followed when DownloadConfig.MaxRedirects is 0
+const DefaultMaxRedirects = 10
+
+// Returned when a url redirects more than DownloadConfig.MaxRedirects times (e.g. a redirect loop)
+var errTooManyRedirects = errors.New("Too many redirects")
+
+// Redirect policy that gives up after max redirects
+func limitRedirects(max int) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return errTooManyRedirects
+		}
+		return nil
+	}
+}
+
+// Downloads images according to a config; safe for use by multiple workers
+type downloader struct {
+	client    *http.Client
+	cfg       DownloadConfig
+	header    http.Header // added to every request
+	limiter   *rateLimiter
+	hosts     *hostLimiter  // caps simultaneous downloads per host
+	robots    *robotsPolicy // skips urls disallowed by robots.txt and honors crawl-delay, if set
+	logger    Logger
+	decodeCfg SummarizeConfig    // options for decoding images (see decodeImage)
+	bytes     *uint64            // counts the bytes of response bodies read, if set; updated atomically
+	cache     *summaryCache      // summaries of earlier runs to revalidate, if set
+	contents  *contentCache      // summaries of this run by content, to skip duplicates, if set
+	creds     credentialStore    // Authorization for requests to the hosts that have credentials
+	fetchers  map[string]Fetcher // read urls of other schemes than http(s), by lowercase scheme
+}
+
+// The redirect limit is applied to a copy of client, unless it already has its own redirect policy
+func newDownloader(client *http.Client, cfg DownloadConfig) *downloader {
+	if client.CheckRedirect == nil {
+		maxRedirects := cfg.MaxRedirects
+		if maxRedirects == 0 {
+			maxRedirects = DefaultMaxRedirects
+		}
+		limited := *client
+		limited.CheckRedirect = limitRedirects(maxRedirects)
+		client = &limited
+	}
+	return &downloader{
+		client:  client,
+		cfg:     cfg,
+		limiter: newRateLimiter(cfg.RequestsPerSecond),
+		logger:  nopLogger{},
+	}
+}
+
+// Returned when an image is larger than DownloadConfig.MaxBytes
+var errMaxBytes = errors.New("Image exceeds maximum download size")
+
+// Returned when a response body is shorter than its Content-Length
+var errPartialDownload = errors.New("Partial download")
+
+// Returned when a downloaded image can't be decoded, as opposed to failing to download it
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *decodeError) Unwrap() error {
+	return e.err
+}
+
+// Wrap err from decoding body as a decodeError, unless it's from reading body (e.g. a dropped
+// connection), in which case it's a download error
+func decodeFailed(err error, body *maxBytesReader) error {
+	if err == nil || body.readErr != nil {
+		return err
+	}
+	return &decodeError{err}
+}
+
+// Reader that reads up to n bytes, then fails with errMaxBytes if there's more to read
+type maxBytesReader struct {
+	r        io.Reader
+	n        int64
+	read     int64 // bytes read so far
+	exceeded bool
+	readErr  error // from r, other than io.EOF
+}
+
+func (mr *maxBytesReader) Read(p []byte) (int, error) {
+	if mr.n <= 0 {
+		// check for data beyond the limit
+		var probe [1]byte
+		n, err := mr.r.Read(probe[:])
+		if n > 0 {
+			mr.exceeded = true
+			return 0, errMaxBytes
+		}
+		if err != nil && err != io.EOF {
+			mr.readErr = err
+		}
+		return 0, err
+	}
+	if int64(len(p)) > mr.n {
+		p = p[:mr.n]
+	}
+	n, err := mr.r.Read(p)
+	mr.n -= int64(n)
+	mr.read += int64(n)
+	if err != nil && err != io.EOF {
+		mr.readErr = err
+	}
+	return n, err
+}
+
+// Wrap a response body so it can't exceed the configured maximum size
+// Responses that advertise a larger Content-Length are rejected before reading
+func limitBody(resp *http.Response, cfg DownloadConfig) (*maxBytesReader, error) {
+	if cfg.MaxBytes <= 0 {
+		return &maxBytesReader{r: resp.Body, n: 1<<63 - 1}, nil
+	}
+	if resp.ContentLength > cfg.MaxBytes {
+		return nil, errMaxBytes
+	}
+	return &maxBytesReader{r: resp.Body, n: cfg.MaxBytes}, nil
+}
+
+// Returned when a download gets a response with an error status code
+type DownloadError struct {
+	StatusCode int
+	URL        string // where the request ended up after any redirects
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("Url invalid (statusCode %v)", e.StatusCode)
+}
+
+// Returns true if a response status code is worth retrying
+func retryableStatus(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusTooManyRequests
+}
+
+// Parse a Retry-After header value (seconds or an http date) into a delay; returns 0 if absent or invalid
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Delay before retry number attempt (0-based): exponential backoff with jitter, unless the server asked for more
+func retryDelay(cfg DownloadConfig, attempt int, retryAfter time.Duration) time.Duration {
+	delay := cfg.RetryDelay << uint(attempt)
+	if delay <= 0 || (cfg.MaxRetryDelay > 0 && delay > cfg.MaxRetryDelay) {
+		// also catches overflow from the shift
+		delay = cfg.MaxRetryDelay
+	}
+	// jitter in [delay/2, delay) so workers retrying together spread out
+	if half := int64(delay / 2); half > 0 {
+		delay = time.Duration(half + rand.Int63n(half))
+	}
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	if cfg.MaxRetryDelay > 0 && delay > cfg.MaxRetryDelay {
+		delay = cfg.MaxRetryDelay
+	}
+	return delay
+}
+
+// Get a url, treating error status codes as errors; caller must close the body
+// Network errors and retryable status codes are retried with backoff according to cfg
+func (d *downloader) getURL(ctx context.Context, url string) (*http.Response, error) {
+	return d.request(ctx, http.MethodGet, url, nil)
+}
+
+// Make a request like getURL with any method, adding header to the downloader's headers
+func (d *downloader) request(ctx context.Context, method string, url string, header http.Header) (*http.Response, error) {
+	cfg := d.cfg
+	for attempt := 0; ; attempt += 1 {
+		if err := d.robots.Wait(ctx, url); err != nil {
+			return nil, err
+		}
+		if err := d.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range d.header {
+			req.Header[name] = values
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if auth := d.creds.authorization(req.URL); auth != "" {
+			// more specific than an Authorization header for every host
+			req.Header.Set("Authorization", auth)
+		}
+		if req.Header.Get("Accept-Encoding") == "" {
+			// setting this ourselves stops the transport from decompressing, so it's done in decodeBody
+			req.Header.Set("Accept-Encoding", "gzip, deflate")
+		}
+
+		var retryAfter time.Duration
+		resp, err := d.client.Do(req)
+		if errors.Is(err, errTooManyRedirects) {
+			// following the same chain again won't end any differently
+			return nil, errTooManyRedirects
+		}
+		if err == nil {
+			if resp.StatusCode < 400 {
+				if final := resp.Request.URL.String(); final != url {
+					d.logger.Debugf("Redirected %v to %v", url, final)
+				}
+				if method == http.MethodHead {
+					// there's no body to decode
+					return resp, nil
+				}
+				if err := decodeBody(resp, cfg.MaxBytes); err != nil {
+					resp.Body.Close()
+					return nil, err
+				}
+				return resp, nil
+			}
+			drainBody(resp)
+			err = &DownloadError{StatusCode: resp.StatusCode, URL: resp.Request.URL.String()}
+			if !retryableStatus(resp.StatusCode) {
+				return nil, err
+			}
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		if ctx.Err() != nil || attempt >= cfg.Retries {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(retryDelay(cfg, attempt, retryAfter)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Most of an error response's body that's read so its connection can be reused
+const maxDrainBytes = 64 * 1024
+
+// Read the rest of a small response body before closing it, so the connection goes back to the pool
+// instead of being closed
+func drainBody(resp *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrainBytes))
+	resp.Body.Close()
+}
+
+// Returns the filesystem path for a file:// url or a bare path, or false if imgURL should be downloaded
+func localPath(imgURL string) (string, bool) {
+	u, err := url.Parse(imgURL)
+	if err != nil {
+		// let the request report the bad url
+		return "", false
+	}
+	switch u.Scheme {
+	case "":
+		return imgURL, true
+	case "file":
+		return filepath.FromSlash(u.Path), true
+	default:
+		return "", false
+	}
+}
+
+// Check a local image can be opened; missing files are errors that retrying won't fix
+func openLocal(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return nil, errors.New("Not a file: " + path)
+	}
+	return f, nil
+}
+
+// Body that closes both a decompressor and the underlying response body
+type decodedBody struct {
+	io.Reader
+	closers    []io.Closer
+	compressed *countingReader // the underlying body, counting the bytes actually downloaded
+}
+
+// Reader counting the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// Bytes of a response's body that were downloaded, having read body from it: for a compressed
+// response that's its compressed length rather than the image's
+func downloadedBytes(resp *http.Response, body *maxBytesReader) int64 {
+	if decoded, ok := resp.Body.(*decodedBody); ok {
+		return decoded.compressed.n
+	}
+	return body.read
+}
+
+func (b *decodedBody) Close() error {
+	var err error
+	for _, c := range b.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Replace a response body compressed with gzip or deflate with the decompressed body, failing with
+// errMaxBytes if the compressed body is already longer than maxBytes (if positive)
+// Other encodings are left as is (the decoder will reject them if they aren't images)
+func decodeBody(resp *http.Response, maxBytes int64) error {
+	if resp.Uncompressed {
+		// already handled by the transport
+		return nil
+	}
+
+	compressed := &countingReader{r: resp.Body}
+	var decompressor io.ReadCloser
+	var err error
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		decompressor, err = gzip.NewReader(compressed)
+	case "deflate":
+		decompressor, err = zlib.NewReader(compressed)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// limitBody can't check the length once it's cleared below
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return errMaxBytes
+	}
+
+	resp.Body = &decodedBody{decompressor, []io.Closer{decompressor, resp.Body}, compressed}
+	// the advertised length is of the compressed body
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+// Decode the payload of a data: URI, which must fit in the configured maximum size like a download
+func (d *downloader) readDataURI(uri string) (string, []byte, error) {
+	mediaType, data, err := parseDataURI(uri)
+	if err != nil {
+		return "", nil, err
+	}
+	if d.cfg.MaxBytes > 0 && int64(len(data)) > d.cfg.MaxBytes {
+		return "", nil, errMaxBytes
+	}
+	return mediaType, data, nil
+}
+
+// Add to the count of bytes downloaded
+func (d *downloader) countBytes(n int64) {
+	if d.bytes != nil {
+		atomic.AddUint64(d.bytes, uint64(n))
+	}
+}
+
+// Download an image from a url and decode it directly from the response
+func (d *downloader) downloadToImage(ctx context.Context, url string) (image.Image, error) {
+	img, _, _, _, err := d.downloadToImageIfModified(ctx, url, validators{})
+	return img, err
+}
+
+// Like downloadToImage, but fails with errNotModified if the image hasn't changed since cached, and
+// also returns the image's format, the number of bytes read and the validators of the response
+func (d *downloader) downloadToImageIfModified(ctx context.Context, url string, cached validators) (image.Image, string, int64, validators, error) {
+	if isDataURI(url) {
+		_, data, err := d.readDataURI(url)
+		if err != nil {
+			return nil, "", 0, validators{}, err
+		}
+		img, format, err := decodeImage(bytes.NewReader(data), d.decodeCfg)
+		if err != nil {
+			err = &decodeError{err}
+		}
+		return img, format, int64(len(data)), validators{}, err
+	}
+	if f, ok := d.fetcher(url); ok {
+		img, format, n, err := d.fetchToImage(ctx, f, url)
+		return img, format, n, validators{}, err
+	}
+
+	release, err := d.hosts.Acquire(ctx, url)
+	if err != nil {
+		return nil, "", 0, validators{}, err
+	}
+	defer release()
+
+	resp, err := d.request(ctx, http.MethodGet, url, cached.header())
+	if err != nil {
+		return nil, "", 0, validators{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, "", 0, cached, errNotModified
+	}
+
+	body, err := limitBody(resp, d.cfg)
+	if err != nil {
+		return nil, "", 0, validators{}, err
+	}
+	img, format, err := decodeImage(body, d.decodeCfg)
+	d.countBytes(downloadedBytes(resp, body))
+	if body.exceeded {
+		return nil, "", 0, validators{}, errMaxBytes
+	}
+	return img, format, body.read, responseValidators(resp), decodeFailed(err, body)
+}
+
+// Download an file from a url and save to fd
+func (d *downloader) downloadToFile(ctx context.Context, url string, localFile *os.File) error {
+	_, err := d.downloadToFileIfModified(ctx, url, localFile, validators{})
+	return err
+}
+
+// Like downloadToFile, but fails with errNotModified (writing nothing) if the image hasn't changed
+// since cached, and returns the validators of the response
+func (d *downloader) downloadToFileIfModified(ctx context.Context, url string, localFile *os.File, cached validators) (validators, error) {
+	if isDataURI(url) {
+		_, data, err := d.readDataURI(url)
+		if err != nil {
+			return validators{}, err
+		}
+		if _, err := localFile.Write(data); err != nil {
+			return validators{}, err
+		}
+		_, err = localFile.Seek(0, 0)
+		return validators{}, err
+	}
+	if f, ok := d.fetcher(url); ok {
+		return validators{}, d.fetchToFile(ctx, f, url, localFile)
+	}
+
+	release, err := d.hosts.Acquire(ctx, url)
+	if err != nil {
+		return validators{}, err
+	}
+	defer release()
+
+	// Ref: https://golangcode.com/download-a-file-from-a-url/
+	resp, err := d.request(ctx, http.MethodGet, url, cached.header())
+	if err != nil {
+		return validators{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return cached, errNotModified
+	}
+
+	body, err := limitBody(resp, d.cfg)
+	if err != nil {
+		return validators{}, err
+	}
+	n, err := io.Copy(localFile, body)
+	d.countBytes(downloadedBytes(resp, body))
+	if err != nil {
+		return validators{}, err
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		// the body ended cleanly before the advertised length, so the image is truncated
+		return validators{}, fmt.Errorf("%w (got %v of %v bytes)", errPartialDownload, n, resp.ContentLength)
+	}
+
+	_, err = localFile.Seek(0, 0)
+	return responseValidators(resp), err
+}
+
+// Decode an image from a local path; also returns its format and the size of the file
+func decodeLocal(path string, cfg SummarizeConfig) (image.Image, string, int, error) {
+	f, err := openLocal(path)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer f.Close()
+
+	img, format, err := decodeImage(f, cfg)
+	return img, format, fileSize(f), err
+}
+
+// Size of an open file in bytes, or 0 if it can't be found
+func fileSize(f *os.File) int {
+	info, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	return int(info.Size())
+}
+
+// Servers that don't support HEAD are checked with a GET for just the first bytes
+const checkRangeBytes = 512
+
+// Check a url is reachable and serves an image without downloading it, using a HEAD request
+// Returns the content type and size (-1 if unknown)
+func (d *downloader) checkURL(ctx context.Context, url string) (string, int64, error) {
+	if isDataURI(url) {
+		mediaType, data, err := d.readDataURI(url)
+		if err != nil {
+			return "", -1, err
+		}
+		return mediaType, int64(len(data)), checkContentType(mediaType)
+	}
+	if f, ok := d.fetcher(url); ok {
+		return d.checkFetched(ctx, f, url)
+	}
+
+	release, err := d.hosts.Acquire(ctx, url)
+	if err != nil {
+		return "", -1, err
+	}
+	defer release()
+
+	resp, err := d.request(ctx, http.MethodHead, url, nil)
+	var downloadErr *DownloadError
+	if err != nil && !(errors.As(err, &downloadErr) &&
+		(downloadErr.StatusCode == http.StatusMethodNotAllowed || downloadErr.StatusCode == http.StatusNotImplemented)) {
+		return "", -1, err
+	}
+	size := int64(-1)
+	if err == nil {
+		resp.Body.Close()
+		size = resp.ContentLength
+	} else {
+		// HEAD isn't allowed; identity encoding keeps the advertised size that of the image
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=0-%v", checkRangeBytes-1))
+		header.Set("Accept-Encoding", "identity")
+		resp, err = d.request(ctx, http.MethodGet, url, header)
+		if err != nil {
+			return "", -1, err
+		}
+		resp.Body.Close()
+		size = resp.ContentLength
+		if resp.StatusCode == http.StatusPartialContent {
+			size = parseContentRangeSize(resp.Header.Get("Content-Range"))
+		}
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if err := checkContentType(contentType); err != nil {
+		return contentType, size, err
+	}
+	if d.cfg.MaxBytes > 0 && size > d.cfg.MaxBytes {
+		return contentType, size, errMaxBytes
+	}
+	return contentType, size, nil
+}
+
+// Check a local image exists and looks like an image from its first bytes
+func checkLocal(path string) (string, int64, error) {
+	f, err := openLocal(path)
+	if err != nil {
+		return "", -1, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", -1, err
+	}
+	head := make([]byte, checkRangeBytes)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", -1, err
+	}
+	contentType := http.DetectContentType(head[:n])
+	return contentType, info.Size(), checkContentType(contentType)
+}
+
+// Returned when a url serves something other than an image
+var errNotImage = errors.New("Content type is not an image")
+
+// Check a content type is for an image
+func checkContentType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return errNotImage
+	}
+	return nil
+}
+
+// Get the total size from a Content-Range header (e.g. "bytes 0-511/1234"); -1 if unknown
+func parseContentRangeSize(value string) int64 {
+	i := strings.LastIndex(value, "/")
+	if i < 0 {
+		return -1
+	}
+	size, err := strconv.ParseInt(value[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
@@ -0,0 +1,599 @@
+package rquent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testRetryConfig = DownloadConfig{
+	Retries:       2,
+	RetryDelay:    time.Millisecond,
+	MaxRetryDelay: 10 * time.Millisecond,
+}
+
+// create a server that responds with statusCode for the first nFails requests, then serves the valid image
+func flakyServer(statusCode int, nFails int32, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(requests, 1) <= nFails {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(statusCode)
+			return
+		}
+		http.ServeFile(w, r, testImagePathValid)
+	}))
+}
+
+func downloadToTmpFile(url string, cfg DownloadConfig) error {
+	localFile, err := ioutil.TempFile("", "*.jpg")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localFile.Name())
+	defer localFile.Close()
+
+	return newDownloader(http.DefaultClient, cfg).downloadToFile(context.Background(), url, localFile)
+}
+
+func TestDownloadToFileRetry503(t *testing.T) {
+	var requests int32
+	s := flakyServer(http.StatusServiceUnavailable, 2, &requests)
+	defer s.Close()
+
+	err := downloadToTmpFile(s.URL, testRetryConfig)
+	if err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+	if requests != 3 {
+		t.Errorf("Expected (3 requests) Got (%v)", requests)
+	}
+}
+
+func TestDownloadToFileRetryExhausted(t *testing.T) {
+	var requests int32
+	s := flakyServer(http.StatusTooManyRequests, 10, &requests)
+	defer s.Close()
+
+	err := downloadToTmpFile(s.URL, testRetryConfig)
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+	if requests != 3 {
+		t.Errorf("Expected (3 requests) Got (%v)", requests)
+	}
+}
+
+func TestDownloadToFileNoRetry404(t *testing.T) {
+	var requests int32
+	s := flakyServer(http.StatusNotFound, 10, &requests)
+	defer s.Close()
+
+	err := downloadToTmpFile(s.URL, testRetryConfig)
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+	if requests != 1 {
+		t.Errorf("Expected (1 request) Got (%v)", requests)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Now()
+	if d := parseRetryAfter("3", now); d != 3*time.Second {
+		t.Errorf("Expected (3s) Got (%v)", d)
+	}
+	date := now.Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date, now); d <= 0 || d > time.Minute {
+		t.Errorf("Expected (delay up to 1m) Got (%v)", d)
+	}
+	if d := parseRetryAfter("soon", now); d != 0 {
+		t.Errorf("Expected (0) Got (%v)", d)
+	}
+}
+
+func TestRetryDelayBounds(t *testing.T) {
+	cfg := DownloadConfig{RetryDelay: 100 * time.Millisecond, MaxRetryDelay: time.Second}
+	for attempt := 0; attempt < 40; attempt += 1 {
+		d := retryDelay(cfg, attempt, 0)
+		if d <= 0 || d > cfg.MaxRetryDelay {
+			t.Errorf("Expected (0 < delay <= %v) Got (%v) for attempt %v", cfg.MaxRetryDelay, d, attempt)
+		}
+	}
+	if d := retryDelay(cfg, 0, 500*time.Millisecond); d != 500*time.Millisecond {
+		t.Errorf("Expected (Retry-After of 500ms to be honored) Got (%v)", d)
+	}
+}
+
+func TestDownloadToFileMaxBytesContentLength(t *testing.T) {
+	// the image is served with a Content-Length, so it's rejected before reading
+	var requests int32
+	s := flakyServer(http.StatusOK, 0, &requests)
+	defer s.Close()
+
+	cfg := DefaultDownloadConfig
+	cfg.MaxBytes = 100
+	err := downloadToTmpFile(s.URL, cfg)
+	if err != errMaxBytes {
+		t.Errorf("Expected (%v) Got (%v)", errMaxBytes, err)
+	}
+}
+
+func TestDownloadToFileMaxBytesChunked(t *testing.T) {
+	// no Content-Length is sent, so the limit is enforced while copying
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100))
+		w.(http.Flusher).Flush()
+		w.Write(make([]byte, 100))
+	}))
+	defer s.Close()
+
+	cfg := DefaultDownloadConfig
+	cfg.MaxBytes = 150
+	if err := downloadToTmpFile(s.URL, cfg); err != errMaxBytes {
+		t.Errorf("Expected (%v) Got (%v)", errMaxBytes, err)
+	}
+
+	cfg.MaxBytes = 200
+	if err := downloadToTmpFile(s.URL, cfg); err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+}
+
+func TestDownloadToFileHeaders(t *testing.T) {
+	// Test that custom headers are sent with every attempt, including retries
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "rquent-test" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeFile(w, r, testImagePathValid)
+	}))
+	defer s.Close()
+
+	d := newDownloader(http.DefaultClient, testRetryConfig)
+	d.header = http.Header{}
+	d.header.Set("User-Agent", "rquent-test")
+	d.header.Set("Authorization", "Bearer token")
+
+	localFile, err := ioutil.TempFile("", "*.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(localFile.Name())
+	defer localFile.Close()
+
+	if err := d.downloadToFile(context.Background(), s.URL, localFile); err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected (2 requests with headers) Got (%v)", requests)
+	}
+}
+
+// create a server that compresses the valid image with the given Content-Encoding
+func encodingServer(encoding string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadFile(testImagePathValid)
+		w.Header().Set("Content-Encoding", encoding)
+		var cw io.WriteCloser
+		if encoding == "gzip" {
+			cw = gzip.NewWriter(w)
+		} else {
+			cw = zlib.NewWriter(w)
+		}
+		cw.Write(data)
+		cw.Close()
+	}))
+}
+
+func TestDownloadToImageContentEncoding(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			s := encodingServer(encoding)
+			defer s.Close()
+
+			// also check when the header is set explicitly, which disables the transport's decompression
+			for _, header := range []http.Header{nil, http.Header{"Accept-Encoding": []string{encoding}}} {
+				d := newDownloader(http.DefaultClient, DefaultDownloadConfig)
+				d.header = header
+				img, err := d.downloadToImage(context.Background(), s.URL)
+				if err != nil {
+					t.Fatalf("Expected (nil) Got (%v)", err)
+				}
+				if img.Bounds().Dx() != 1400 {
+					t.Errorf("Expected (width 1400) Got (%v)", img.Bounds().Dx())
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadCountsCompressedBytes(t *testing.T) {
+	// Test compressed responses count the bytes downloaded, not the decompressed image's
+	s := encodingServer("gzip")
+	defer s.Close()
+	data, err := ioutil.ReadFile(testImagePathValid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var counted uint64
+	d := newDownloader(http.DefaultClient, DefaultDownloadConfig)
+	d.bytes = &counted
+	if _, err := d.downloadToImage(context.Background(), s.URL); err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if counted == 0 || counted >= uint64(len(data)) {
+		t.Errorf("Expected (fewer than %v compressed bytes) Got (%v)", len(data), counted)
+	}
+}
+
+func TestDecodeBodyMaxBytes(t *testing.T) {
+	// Test a compressed body is checked against the maximum size before its length is cleared
+	b := new(bytes.Buffer)
+	gz := gzip.NewWriter(b)
+	gz.Write([]byte("small"))
+	gz.Close()
+	resp := &http.Response{
+		Header:        http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:          ioutil.NopCloser(b),
+		ContentLength: 100,
+	}
+	if err := decodeBody(resp, 50); err != errMaxBytes {
+		t.Errorf("Expected (%v) Got (%v)", errMaxBytes, err)
+	}
+	if resp.ContentLength != 100 {
+		t.Errorf("Expected (100) Got (%v)", resp.ContentLength)
+	}
+}
+
+func TestWithProxy(t *testing.T) {
+	// Test requests are sent to the proxy, and the original client isn't changed
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHost = r.URL.Host
+		http.ServeFile(w, r, testImagePathValid)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	client := newClient(DefaultTimeout)
+	proxied, err := withProxy(client, proxyURL)
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if client.Transport != nil {
+		t.Errorf("Expected (original client unchanged) Got (%v)", client.Transport)
+	}
+
+	_, err = newDownloader(proxied, DefaultDownloadConfig).downloadToImage(context.Background(), testImageURL200)
+	if err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+	if proxiedHost != "www.test.com" {
+		t.Errorf("Expected (www.test.com) Got (%v)", proxiedHost)
+	}
+}
+
+type testRoundTripper struct{}
+
+func (testRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestWithProxyCustomTransport(t *testing.T) {
+	client := &http.Client{Transport: testRoundTripper{}}
+	if _, err := withProxy(client, &url.URL{Scheme: "http", Host: "proxy"}); err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+// create a server that redirects /loop to itself and /hop/n through n redirects to the valid image
+func redirectServer(requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.URL.Path == "/loop" {
+			http.Redirect(w, r, "/loop", http.StatusFound)
+			return
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/")); err == nil && n > 0 {
+			http.Redirect(w, r, "/hop/"+strconv.Itoa(n-1), http.StatusFound)
+			return
+		}
+		http.ServeFile(w, r, testImagePathValid)
+	}))
+}
+
+func TestDownloadToFileRedirectLoop(t *testing.T) {
+	var requests int32
+	s := redirectServer(&requests)
+	defer s.Close()
+
+	cfg := testRetryConfig
+	cfg.MaxRedirects = 3
+	err := downloadToTmpFile(s.URL+"/loop", cfg)
+	if err != errTooManyRedirects {
+		t.Errorf("Expected (%v) Got (%v)", errTooManyRedirects, err)
+	}
+	// the original request and 3 redirects, without retrying
+	if requests != 4 {
+		t.Errorf("Expected (4 requests) Got (%v)", requests)
+	}
+}
+
+func TestDownloadToFileRedirectsFollowed(t *testing.T) {
+	var requests int32
+	s := redirectServer(&requests)
+	defer s.Close()
+
+	cfg := DefaultDownloadConfig
+	cfg.MaxRedirects = 3
+	if err := downloadToTmpFile(s.URL+"/hop/3", cfg); err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	var requests int32
+	s := flakyServer(http.StatusOK, 0, &requests)
+	defer s.Close()
+
+	contentType, size, err := newDownloader(http.DefaultClient, DefaultDownloadConfig).checkURL(context.Background(), s.URL)
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	info, _ := os.Stat(testImagePathValid)
+	if contentType != "image/jpeg" || size != info.Size() {
+		t.Errorf("Expected (image/jpeg %v) Got (%v %v)", info.Size(), contentType, size)
+	}
+}
+
+func TestCheckURLHeadNotAllowed(t *testing.T) {
+	// Test servers that reject HEAD are checked with a ranged GET
+	var ranges []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeFile(w, r, testImagePathValid)
+	}))
+	defer s.Close()
+
+	contentType, size, err := newDownloader(http.DefaultClient, DefaultDownloadConfig).checkURL(context.Background(), s.URL)
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	info, _ := os.Stat(testImagePathValid)
+	if contentType != "image/jpeg" || size != info.Size() {
+		t.Errorf("Expected (image/jpeg %v) Got (%v %v)", info.Size(), contentType, size)
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=0-511" {
+		t.Errorf("Expected (one ranged GET) Got (%v)", ranges)
+	}
+}
+
+func TestCheckURLNotImage(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}))
+	defer s.Close()
+
+	_, _, err := newDownloader(http.DefaultClient, DefaultDownloadConfig).checkURL(context.Background(), s.URL)
+	if err != errNotImage {
+		t.Errorf("Expected (%v) Got (%v)", errNotImage, err)
+	}
+}
+
+func TestCheckLocal(t *testing.T) {
+	contentType, _, err := checkLocal(testImagePathValid)
+	if err != nil || contentType != "image/jpeg" {
+		t.Errorf("Expected (image/jpeg nil) Got (%v %v)", contentType, err)
+	}
+	if _, _, err := checkLocal(testImagePathInvalid); err == nil {
+		t.Errorf("Expected (error for missing file) Got (nil)")
+	}
+}
+
+func TestDownloadErrorFinalURL(t *testing.T) {
+	// Test the status code and the url a redirect chain ended at are kept
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/start" {
+			http.Redirect(w, r, "/missing", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer s.Close()
+
+	err := downloadToTmpFile(s.URL+"/start", DefaultDownloadConfig)
+	downloadErr, ok := err.(*DownloadError)
+	if !ok {
+		t.Fatalf("Expected (*DownloadError) Got (%v)", err)
+	}
+	if downloadErr.StatusCode != http.StatusNotFound || downloadErr.URL != s.URL+"/missing" {
+		t.Errorf("Expected (404 from %v) Got (%v from %v)", s.URL+"/missing", downloadErr.StatusCode, downloadErr.URL)
+	}
+}
+
+// serves a body shorter than its Content-Length, ending in a clean EOF
+type shortBodyRoundTripper struct{}
+
+func (shortBodyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"image/jpeg"}},
+		Body:          ioutil.NopCloser(strings.NewReader("short")),
+		ContentLength: 100,
+		Request:       req,
+	}, nil
+}
+
+func TestDownloadToFilePartial(t *testing.T) {
+	localFile, err := ioutil.TempFile("", "*.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(localFile.Name())
+	defer localFile.Close()
+
+	client := &http.Client{Transport: shortBodyRoundTripper{}}
+	err = newDownloader(client, DefaultDownloadConfig).downloadToFile(context.Background(), "http://www.test.com/short.jpg", localFile)
+	if !errors.Is(err, errPartialDownload) {
+		t.Errorf("Expected (%v) Got (%v)", errPartialDownload, err)
+	}
+}
+
+func TestWithTransportTimeouts(t *testing.T) {
+	client := newClient(DefaultTimeout)
+	cfg := DefaultDownloadConfig
+	if configured, _ := withTransportTimeouts(client, cfg); configured != client {
+		t.Errorf("Expected (client unchanged without timeouts) Got (copy)")
+	}
+
+	cfg.ConnectTimeout = time.Second
+	cfg.TLSHandshakeTimeout = 2 * time.Second
+	cfg.ResponseHeaderTimeout = 3 * time.Second
+	configured, err := withTransportTimeouts(client, cfg)
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	transport := configured.Transport.(*http.Transport)
+	if transport.TLSHandshakeTimeout != 2*time.Second || transport.ResponseHeaderTimeout != 3*time.Second {
+		t.Errorf("Expected (2s and 3s) Got (%v and %v)", transport.TLSHandshakeTimeout, transport.ResponseHeaderTimeout)
+	}
+	if transport.DialContext == nil {
+		t.Errorf("Expected (dialer with connect timeout) Got (nil)")
+	}
+	if client.Transport != nil {
+		t.Errorf("Expected (original client unchanged) Got (%v)", client.Transport)
+	}
+}
+
+func TestDownloadToFileResponseHeaderTimeout(t *testing.T) {
+	// the mock server takes 10s to respond to /slow
+	cfg := DefaultDownloadConfig
+	cfg.ResponseHeaderTimeout = 50 * time.Millisecond
+	client, err := withTransportTimeouts(testClient, cfg)
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	localFile, err := ioutil.TempFile("", "*.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(localFile.Name())
+	defer localFile.Close()
+
+	start := time.Now()
+	err = newDownloader(client, cfg).downloadToFile(context.Background(), "http://www.test.com/slow", localFile)
+	if err == nil {
+		t.Errorf("Expected (timeout error) Got (nil)")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected (timeout after 50ms) Got (%v)", elapsed)
+	}
+}
+
+func TestWithTLS(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, testImagePathValid)
+	}))
+	defer s.Close()
+
+	get := func(client *http.Client) error {
+		_, err := newDownloader(client, DefaultDownloadConfig).downloadToImage(context.Background(), s.URL)
+		return err
+	}
+	client := newClient(DefaultTimeout)
+	if err := get(client); err == nil {
+		t.Errorf("Expected (certificate error) Got (nil)")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	trusted, err := withTLS(client, false, roots)
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if err := get(trusted); err != nil {
+		t.Errorf("Expected (nil with the server's CA) Got (%v)", err)
+	}
+
+	insecure, err := withTLS(client, true, nil)
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if err := get(insecure); err != nil {
+		t.Errorf("Expected (nil when skipping verification) Got (%v)", err)
+	}
+	if client.Transport != nil {
+		t.Errorf("Expected (original client unchanged) Got (%v)", client.Transport)
+	}
+}
+
+func TestWithConnPool(t *testing.T) {
+	client := newClient(DefaultTimeout)
+	if configured, _ := withConnPool(client, 0, 0); configured != client {
+		t.Errorf("Expected (client unchanged without pool sizes) Got (copy)")
+	}
+
+	configured, err := withConnPool(client, 200, 300)
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	transport := configured.Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 200 || transport.MaxConnsPerHost != 300 || transport.MaxIdleConns != 200 {
+		t.Errorf("Expected (200 idle, 300 max, 200 idle total) Got (%v, %v, %v)", transport.MaxIdleConnsPerHost, transport.MaxConnsPerHost, transport.MaxIdleConns)
+	}
+	if client.Transport != nil {
+		t.Errorf("Expected (original client unchanged) Got (%v)", client.Transport)
+	}
+}
+
+func TestDownloadReusesConnections(t *testing.T) {
+	// Test error responses are drained so their connections are reused
+	var conns int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(bytes.Repeat([]byte("x"), 1024))
+	}))
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	s.Start()
+	defer s.Close()
+
+	d := newDownloader(s.Client(), DefaultDownloadConfig)
+	for i := 0; i < 3; i += 1 {
+		if _, err := d.getURL(context.Background(), s.URL); err == nil {
+			t.Fatalf("Expected (error) Got (nil)")
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Expected (1 connection) Got (%v)", n)
+	}
+}
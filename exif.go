@@ -0,0 +1,100 @@
+package rquent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// Bytes read from the start of a JPEG to look for EXIF metadata; an APP1 segment holds at most 64KiB,
+// and it can follow a JFIF APP0 segment with a thumbnail of the same size
+const exifPeekSize = 128 * 1024
+
+const exifOrientationTag = 0x0112
+
+// Image decoded along with its EXIF orientation
+// Orientation is recorded as is (1-8, see the EXIF spec); the pixels are not rotated
+type orientedImage struct {
+	image.Image
+	orientation int
+}
+
+// Get the EXIF orientation recorded when img was decoded, or 0 if there wasn't one
+func imageOrientation(img image.Image) int {
+	if oriented, ok := img.(*orientedImage); ok {
+		return oriented.orientation
+	}
+	return 0
+}
+
+// Read the EXIF orientation from the start of a JPEG, or 0 if it doesn't have one
+// Only the header is needed, so head can be cut off anywhere after the EXIF segment
+func readOrientation(head []byte) int {
+	if len(head) < 2 || head[0] != 0xff || head[1] != 0xd8 {
+		// not a JPEG
+		return 0
+	}
+	for pos := 2; pos+4 <= len(head); {
+		if head[pos] != 0xff {
+			return 0
+		}
+		marker := head[pos+1]
+		if marker == 0xda {
+			// start of scan; metadata comes before the image data
+			return 0
+		}
+		length := int(binary.BigEndian.Uint16(head[pos+2:]))
+		if length < 2 {
+			return 0
+		}
+		end := pos + 2 + length
+		if marker == 0xe1 && end <= len(head) {
+			segment := head[pos+4 : end]
+			if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return tiffOrientation(segment[6:])
+			}
+		}
+		pos = end
+	}
+	return 0
+}
+
+// Read the orientation tag from the first IFD of EXIF TIFF data, or 0 if it isn't there
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	nEntries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < nEntries; i += 1 {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		// a SHORT, stored in the first 2 bytes of the value
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 0
+		}
+		return orientation
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package rquent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// build an APP1 segment with EXIF data holding only an orientation tag
+func exifSegment(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := new(bytes.Buffer)
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(tiff, order, uint16(42))
+	binary.Write(tiff, order, uint32(8)) // IFD0 right after the header
+	binary.Write(tiff, order, uint16(1)) // 1 entry
+	binary.Write(tiff, order, uint16(exifOrientationTag))
+	binary.Write(tiff, order, uint16(3)) // SHORT
+	binary.Write(tiff, order, uint32(1))
+	binary.Write(tiff, order, orientation)
+	binary.Write(tiff, order, uint16(0)) // padding of the value
+	binary.Write(tiff, order, uint32(0)) // no next IFD
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// encode a JPEG with the EXIF segment inserted after the start of image marker
+func newExifJPEG(t *testing.T, segment []byte) []byte {
+	b := new(bytes.Buffer)
+	if err := jpeg.Encode(b, image.NewRGBA(image.Rect(0, 0, 4, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := b.Bytes()
+	return append(append(append([]byte{}, encoded[:2]...), segment...), encoded[2:]...)
+}
+
+func TestReadOrientation(t *testing.T) {
+	tests := []struct {
+		name     string
+		head     []byte
+		expected int
+	}{
+		{"little endian", newExifJPEG(t, exifSegment(binary.LittleEndian, 6)), 6},
+		{"big endian", newExifJPEG(t, exifSegment(binary.BigEndian, 3)), 3},
+		{"out of range", newExifJPEG(t, exifSegment(binary.BigEndian, 9)), 0},
+		{"no exif", newExifJPEG(t, nil), 0},
+		{"cut off", newExifJPEG(t, exifSegment(binary.BigEndian, 3))[:20], 0},
+		{"not a jpeg", []byte("GIF89a"), 0},
+	}
+	for _, test := range tests {
+		if got := readOrientation(test.head); got != test.expected {
+			t.Errorf("Expected (%v) Got (%v) for %v", test.expected, got, test.name)
+		}
+	}
+}
+
+func TestDecodeImageOrientation(t *testing.T) {
+	content := newExifJPEG(t, exifSegment(binary.LittleEndian, 6))
+
+	img, _, err := decodeImage(bytes.NewReader(content), SummarizeConfig{})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if o := imageOrientation(img); o != 0 {
+		t.Errorf("Expected (orientation ignored by default) Got (%v)", o)
+	}
+
+	cfg := SummarizeConfig{K: 1, Orientation: true}
+	summary, err := SummarizeReader(bytes.NewReader(content), cfg)
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if !summary.HasOrientation || summary.Orientation != 6 {
+		t.Errorf("Expected (orientation 6) Got (%v)", summary.Orientation)
+	}
+}
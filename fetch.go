@@ -0,0 +1,142 @@
+package rquent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Reads images from urls with a scheme other than http(s), e.g. s3://bucket/key in object storage
+// Fetchers are added to a pipeline by scheme with WithFetchers
+type Fetcher interface {
+	// Open the object at rawURL for reading, returning its size in bytes or -1 if unknown; the caller
+	// closes it. A missing object should be a *DownloadError with StatusCode 404, so it's treated like
+	// a missing image rather than a network error
+	Fetch(ctx context.Context, rawURL string) (io.ReadCloser, int64, error)
+}
+
+// Schemes the downloader handles itself, which can't be given to a Fetcher
+var builtinSchemes = map[string]bool{"http": true, "https": true, "file": true, "data": true, "": true}
+
+// Get the fetcher for the scheme of rawURL, or false if it's downloaded over http
+func (d *downloader) fetcher(rawURL string) (Fetcher, bool) {
+	if len(d.fetchers) == 0 {
+		return nil, false
+	}
+	i := strings.Index(rawURL, "://")
+	if i < 0 {
+		return nil, false
+	}
+	f, ok := d.fetchers[strings.ToLower(rawURL[:i])]
+	return f, ok
+}
+
+// Open an object with a fetcher, waiting for the rate limit like a request
+// The returned body is limited to the configured maximum size
+func (d *downloader) fetch(ctx context.Context, f Fetcher, rawURL string) (*maxBytesReader, io.Closer, int64, error) {
+	if err := d.limiter.Wait(ctx); err != nil {
+		return nil, nil, 0, err
+	}
+	body, size, err := f.Fetch(ctx, rawURL)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	limited, err := limitBody(&http.Response{Body: body, ContentLength: size}, d.cfg)
+	if err != nil {
+		body.Close()
+		return nil, nil, 0, err
+	}
+	return limited, body, size, nil
+}
+
+// Read an object from a fetcher into localFile, like downloadToFile
+func (d *downloader) fetchToFile(ctx context.Context, f Fetcher, rawURL string, localFile *os.File) error {
+	release, err := d.hosts.Acquire(ctx, rawURL)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	body, closer, size, err := d.fetch(ctx, f, rawURL)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	n, err := io.Copy(localFile, body)
+	d.countBytes(body.read)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("%w (got %v of %v bytes)", errPartialDownload, n, size)
+	}
+	_, err = localFile.Seek(0, 0)
+	return err
+}
+
+// Read and decode an object from a fetcher, like downloadToImage; also returns its format and the
+// number of bytes read
+func (d *downloader) fetchToImage(ctx context.Context, f Fetcher, rawURL string) (image.Image, string, int64, error) {
+	release, err := d.hosts.Acquire(ctx, rawURL)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer release()
+
+	body, closer, _, err := d.fetch(ctx, f, rawURL)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer closer.Close()
+	img, format, err := decodeImage(body, d.decodeCfg)
+	d.countBytes(body.read)
+	if body.exceeded {
+		return nil, "", 0, errMaxBytes
+	}
+	return img, format, body.read, decodeFailed(err, body)
+}
+
+// Check an object from a fetcher is an image from its first bytes, like checkURL
+// Returns the sniffed content type and the object's size (-1 if unknown)
+func (d *downloader) checkFetched(ctx context.Context, f Fetcher, rawURL string) (string, int64, error) {
+	release, err := d.hosts.Acquire(ctx, rawURL)
+	if err != nil {
+		return "", -1, err
+	}
+	defer release()
+
+	body, closer, size, err := d.fetch(ctx, f, rawURL)
+	if err != nil {
+		return "", -1, err
+	}
+	defer closer.Close()
+	head, err := bufio.NewReaderSize(body, checkRangeBytes).Peek(checkRangeBytes)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", -1, err
+	}
+	contentType := http.DetectContentType(head)
+	return contentType, size, checkContentType(contentType)
+}
+
+// Check the fetchers of a pipeline are for schemes it doesn't handle itself
+func checkFetchers(fetchers map[string]Fetcher) error {
+	for scheme, f := range fetchers {
+		if f == nil {
+			return errors.New("Pipeline fetcher for " + scheme + " must not be nil")
+		}
+		if builtinSchemes[strings.ToLower(scheme)] {
+			return errors.New("Pipeline fetchers can't replace the downloads of " + scheme + " urls")
+		}
+		if u, err := url.Parse(scheme + "://host/"); err != nil || u.Scheme != strings.ToLower(scheme) {
+			return errors.New("Pipeline fetcher scheme is invalid: " + scheme)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package rquent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Fetcher serving objects from memory by url
+type memFetcher map[string][]byte
+
+func (f memFetcher) Fetch(ctx context.Context, rawURL string) (io.ReadCloser, int64, error) {
+	data, ok := f[rawURL]
+	if !ok {
+		return nil, -1, &DownloadError{StatusCode: http.StatusNotFound, URL: rawURL}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func newMemFetcher(t *testing.T) memFetcher {
+	data, err := ioutil.ReadFile(testImagePathValid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return memFetcher{"mem://bucket/valid.jpg": data}
+}
+
+func TestPipelineRunFetcher(t *testing.T) {
+	for _, inMemory := range []bool{false, true} {
+		b := new(bytes.Buffer)
+		errOut := new(bytes.Buffer)
+		pipeline, err := NewPipeline(testPipeConfig).
+			WithSource(strings.NewReader("mem://bucket/valid.jpg\nMEM://bucket/missing.jpg")).
+			WithOutput(b).
+			WithErrorOutput(errOut).
+			WithInMemory(inMemory).
+			WithFetchers(map[string]Fetcher{"mem": newMemFetcher(t)}).
+			Init()
+
+		if err != nil {
+			t.Fatalf("Expected (nil) Got (%v)", err)
+		}
+
+		result, _ := pipeline.Run()
+		if result.Succeeded != 1 || result.Failed != 1 {
+			t.Errorf("Expected (1 succeeded, 1 failed in memory %v) Got (%+v)", inMemory, result)
+		}
+		if !strings.HasPrefix(b.String(), "mem://bucket/valid.jpg,") {
+			t.Errorf("Expected (fetched result) Got (%q)", b.String())
+		}
+		if !strings.Contains(errOut.String(), ",404,") {
+			t.Errorf("Expected (missing object failed with 404) Got (%q)", errOut.String())
+		}
+	}
+}
+
+func TestPipelineRunFetcherDryRun(t *testing.T) {
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("mem://bucket/valid.jpg")).
+		WithOutput(b).
+		WithDryRun(true).
+		WithFetchers(map[string]Fetcher{"mem": newMemFetcher(t)}).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	if result, _ := pipeline.Run(); result.Succeeded != 1 {
+		t.Errorf("Expected (1 succeeded) Got (%+v)", result)
+	}
+	if !strings.HasPrefix(b.String(), "mem://bucket/valid.jpg,image/jpeg,") {
+		t.Errorf("Expected (sniffed content type) Got (%q)", b.String())
+	}
+}
+
+func TestMakePipelineFetcherBuiltinScheme(t *testing.T) {
+	for _, scheme := range []string{"https", "File", "bad scheme"} {
+		_, err := NewPipeline(testPipeConfig).
+			WithSource(strings.NewReader("")).
+			WithFetchers(map[string]Fetcher{scheme: memFetcher{}}).
+			Init()
+		if err == nil {
+			t.Errorf("Expected (error for %q) Got (nil)", scheme)
+		}
+	}
+}
+
+// Fetcher claiming its objects are longer than they are
+type shortFetcher struct{}
+
+func (shortFetcher) Fetch(ctx context.Context, rawURL string) (io.ReadCloser, int64, error) {
+	return ioutil.NopCloser(strings.NewReader("short")), 10, nil
+}
+
+func TestFetchToFilePartial(t *testing.T) {
+	localFile, err := ioutil.TempFile("", "rquent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(localFile.Name())
+	defer localFile.Close()
+
+	d := newDownloader(http.DefaultClient, DefaultDownloadConfig)
+	err = d.fetchToFile(context.Background(), shortFetcher{}, "short://bucket/key", localFile)
+	if !errors.Is(err, errPartialDownload) || !strings.Contains(err.Error(), "got 5 of 10 bytes") {
+		t.Errorf("Expected (%v with the byte counts) Got (%v)", errPartialDownload, err)
+	}
+}
@@ -0,0 +1,139 @@
+package rquent
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// How often buffered results are flushed to the output by default
+const DefaultFlushInterval = time.Second
+
+// Buffers writes to out, flushing them when asked or after every write if interval is 0
+// A flush also flushes out if it has a Flush method (like *bufio.Writer) and syncs out if sync is set and out has a Sync method (like *os.File)
+// Safe for concurrent use; errors are sticky, so once a write or flush fails every later call fails too
+type flushWriter struct {
+	mux      sync.Mutex
+	buf      *bufio.Writer
+	out      io.Writer
+	interval time.Duration
+	sync     bool
+	err      error
+}
+
+func newFlushWriter(out io.Writer, interval time.Duration, sync bool) *flushWriter {
+	return &flushWriter{
+		buf:      bufio.NewWriter(out),
+		out:      out,
+		interval: interval,
+		sync:     sync,
+	}
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.buf.Write(p)
+	if err == nil && w.interval == 0 {
+		err = w.flushLocked()
+	}
+	w.err = err
+	return n, err
+}
+
+// Write everything buffered to out
+func (w *flushWriter) Flush() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.err == nil {
+		w.err = w.flushLocked()
+	}
+	return w.err
+}
+
+func (w *flushWriter) flushLocked() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if flusher, ok := w.out.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	if syncer, ok := w.out.(interface{ Sync() error }); ok && w.sync {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// Flush every interval until the returned function is called; does nothing if interval is 0
+// Errors aren't returned here, they fail the next write or Flush
+func (w *flushWriter) flushEvery() func() {
+	if w.interval == 0 {
+		return func() {}
+	}
+	ticker := time.NewTicker(w.interval)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ticker.C:
+				w.Flush()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stop)
+		<-done
+	}
+}
+
+// Writes everything to each of outs, like io.MultiWriter, stopping at the first one that fails
+// Flush and Sync pass through to the outs that have them so buffered sinks aren't left holding results
+type multiOutput struct {
+	outs []io.Writer
+}
+
+func (m *multiOutput) Write(p []byte) (int, error) {
+	for _, out := range m.outs {
+		n, err := out.Write(p)
+		if err != nil {
+			return n, err
+		}
+		if n != len(p) {
+			return n, io.ErrShortWrite
+		}
+	}
+	return len(p), nil
+}
+
+func (m *multiOutput) Flush() error {
+	for _, out := range m.outs {
+		if flusher, ok := out.(interface{ Flush() error }); ok {
+			if err := flusher.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *multiOutput) Sync() error {
+	for _, out := range m.outs {
+		if syncer, ok := out.(interface{ Sync() error }); ok {
+			if err := syncer.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
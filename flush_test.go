@@ -0,0 +1,112 @@
+package rquent
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// buffer that counts how many times it was synced
+type syncBuffer struct {
+	bytes.Buffer
+	syncs int
+}
+
+func (b *syncBuffer) Sync() error {
+	b.syncs += 1
+	return nil
+}
+
+func TestFlushWriterBuffers(t *testing.T) {
+	out := new(syncBuffer)
+	w := newFlushWriter(out, time.Hour, false)
+	w.Write([]byte("a\n"))
+	if out.Len() != 0 {
+		t.Errorf("Expected (nothing written before flush) Got (%q)", out.String())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if out.String() != "a\n" {
+		t.Errorf("Expected (%q) Got (%q)", "a\n", out.String())
+	}
+	if out.syncs != 0 {
+		t.Errorf("Expected (0 syncs) Got (%v)", out.syncs)
+	}
+}
+
+func TestFlushWriterWriteThroughSync(t *testing.T) {
+	out := new(syncBuffer)
+	w := newFlushWriter(out, 0, true)
+	w.Write([]byte("a\n"))
+	if out.String() != "a\n" {
+		t.Errorf("Expected (%q) Got (%q)", "a\n", out.String())
+	}
+	if out.syncs != 1 {
+		t.Errorf("Expected (1 sync) Got (%v)", out.syncs)
+	}
+}
+
+func TestFlushWriterFlushEvery(t *testing.T) {
+	out := new(bytes.Buffer)
+	w := newFlushWriter(out, 10*time.Millisecond, false)
+	stop := w.flushEvery()
+	w.Write([]byte("a\n"))
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	if out.String() != "a\n" {
+		t.Errorf("Expected (%q) Got (%q)", "a\n", out.String())
+	}
+}
+
+func TestFlushWriterStickyError(t *testing.T) {
+	w := newFlushWriter(failingWriter{}, time.Hour, false)
+	w.Write([]byte("a\n"))
+	if err := w.Flush(); err == nil {
+		t.Fatalf("Expected (error) Got (nil)")
+	}
+	if _, err := w.Write([]byte("b\n")); err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestFlushWriterFlushesOutput(t *testing.T) {
+	b := new(bytes.Buffer)
+	out := bufio.NewWriter(b)
+	w := newFlushWriter(out, time.Hour, false)
+	w.Write([]byte("a\n"))
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if b.String() != "a\n" {
+		t.Errorf("Expected (%q) Got (%q)", "a\n", b.String())
+	}
+}
+
+func TestMultiOutput(t *testing.T) {
+	first := new(syncBuffer)
+	second := new(bytes.Buffer)
+	buffered := bufio.NewWriter(second)
+	m := &multiOutput{outs: []io.Writer{first, buffered}}
+	w := newFlushWriter(m, time.Hour, true)
+	w.Write([]byte("a\n"))
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if first.String() != "a\n" || second.String() != "a\n" {
+		t.Errorf("Expected (%q in both) Got (%q, %q)", "a\n", first.String(), second.String())
+	}
+	if first.syncs != 1 {
+		t.Errorf("Expected (1 sync) Got (%v)", first.syncs)
+	}
+}
+
+func TestMultiOutputFails(t *testing.T) {
+	b := new(bytes.Buffer)
+	m := &multiOutput{outs: []io.Writer{failingWriter{}, b}}
+	if _, err := m.Write([]byte("a\n")); err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
@@ -1,20 +1,88 @@
-package main
+package rquent
 
 import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"strings"
 )
 
 type RqImage struct {
-	URL      string
-	size     int
-	filePath string
-	summary  colorSummary
-	nFails   int
+	URL         string
+	size        int
+	format      string      // as named by image.Decode (e.g. "jpeg"), or by WithDecoder for its decoders
+	filePath    string      // temp file the image was downloaded to; removed in cleanup
+	localPath   string      // file the image was read from when the url is a local path; never removed
+	decoded     image.Image // set when the image was decoded in memory rather than saved to filePath
+	width       int
+	height      int
+	summary     ColorSummary
+	result      Summary // set instead of summary when the pipeline has a Summarizer
+	nFails      int
+	contentType string     // set when the url was only checked (dry run)
+	timings     *Timings   // set when the pipeline records timings
+	validators  validators // of the download response, for caching the summary
+	cached      bool       // the summary came from the cache, so there's nothing to decode
+	contentHash string     // of the downloaded bytes, when duplicate content is summarized once
+	duplicate   bool       // the summary came from an earlier image with the same content
 }
 
-type colorSummary struct {
-	colors []color.NRGBA // most prevalent colors in sorted order (most prevalent first)
+// Summary of the colors in an image
+type ColorSummary struct {
+	Colors     []color.NRGBA // most prevalent colors in sorted order (most prevalent first)
+	Fractions  []float64     // fraction of the counted pixels covered by each color; only set if requested
+	Average    color.NRGBA   // mean color of the counted pixels; only set if HasAverage
+	HasAverage bool
+	Frames     int // number of frames counted; only set when counting every frame of animated images
+	// EXIF orientation (1-8) to rotate the image by, or 0 if it has none; only set if HasOrientation
+	Orientation    int
+	HasOrientation bool
+	// Number of the k colors left out of Colors because of the config's MinFraction, including
+	// placeholders for images with fewer than k colors
+	Dropped int
+}
+
+// Get the prevalent colors as hex strings (e.g. #ff0000)
+func (summary ColorSummary) HexColors() []string {
+	return summary.FormatColors(HexFormat{})
+}
+
+// Get the average color as a hex string, or "" if it wasn't computed
+func (summary ColorSummary) HexAverage() string {
+	return summary.FormatAverage(HexFormat{})
+}
+
+// Get the prevalent colors as hex strings in the given format
+func (summary ColorSummary) FormatColors(format HexFormat) []string {
+	hexes := make([]string, len(summary.Colors))
+	for i, c := range summary.Colors {
+		hexes[i] = format.Format(c)
+	}
+	return hexes
+}
+
+// Get the prevalent colors as CSS hsl strings, e.g. hsl(0,100%,50%)
+func (summary ColorSummary) HSLColors() []string {
+	hsls := make([]string, len(summary.Colors))
+	for i, c := range summary.Colors {
+		hsls[i] = hslString(c)
+	}
+	return hsls
+}
+
+// Get the average color as a hex string in the given format, or "" if it wasn't computed
+func (summary ColorSummary) FormatAverage(format HexFormat) string {
+	if !summary.HasAverage {
+		return ""
+	}
+	return format.Format(summary.Average)
 }
 
 func NewRqImage(url string) RqImage {
@@ -22,69 +90,519 @@ func NewRqImage(url string) RqImage {
 		URL:      url,
 		size:     -1,
 		filePath: "",
-		summary:  colorSummary{},
+		summary:  ColorSummary{},
 	}
 }
 
-func (img *RqImage) GetHexSummary() []string {
-	hexes := make([]string, len(img.summary.colors))
-	for i, c := range img.summary.colors {
-		hexes[i] = hexify(c)
+// Get the width of the summarized image
+func (img *RqImage) Width() int {
+	return img.width
+}
+
+// Get the height of the summarized image
+func (img *RqImage) Height() int {
+	return img.height
+}
+
+// Get the size in bytes of the image as downloaded (or read from disk); -1 if it wasn't
+func (img *RqImage) Size() int {
+	return img.size
+}
+
+// Get the format the image was decoded from, as named by image.Decode (e.g. "jpeg" or "png"); empty if
+// it wasn't decoded, as in a dry run
+func (img *RqImage) Format() string {
+	return img.format
+}
+
+// Get the colors of the summarized image; empty if it was summarized by a Summarizer
+func (img *RqImage) Summary() ColorSummary {
+	return img.summary
+}
+
+// Get the result of the pipeline's Summarizer, or nil if it counted colors
+func (img *RqImage) Result() Summary {
+	return img.result
+}
+
+// Get the content type and size (-1 if unknown) found when checking the image in a dry run
+func (img *RqImage) Checked() (string, int) {
+	return img.contentType, img.size
+}
+
+// Get the time spent downloading and summarizing the image; false unless the pipeline records timings
+func (img *RqImage) Timings() (Timings, bool) {
+	if img.timings == nil {
+		return Timings{}, false
 	}
-	return hexes
+	return *img.timings, true
 }
 
+// Get the local file to read the image from, if it isn't downloaded
+func (img *RqImage) sourcePath() (string, bool) {
+	if img.localPath != "" {
+		// already known, e.g. from a directory source
+		return img.localPath, true
+	}
+	return localPath(img.URL)
+}
+
+// Get the average color as a hex string, or "" if it wasn't computed
+func (img *RqImage) GetHexAverage(format HexFormat) string {
+	return img.summary.FormatAverage(format)
+}
+
+// Get the prevalent colors as hex strings
+func (img *RqImage) GetHexSummary(format HexFormat) []string {
+	return img.summary.FormatColors(format)
+}
+
+// Get the prevalent colors as hsl strings
+func (img *RqImage) GetHSLSummary() []string {
+	return img.summary.HSLColors()
+}
+
+// Returned when summarizing an image with no pixels
+var errEmptyImage = errors.New("Image has no pixels")
+
 // Used to indicate a color that's not from the source image; should not be modified
 var PlaceholderColor = color.NRGBA{}
 
-// update the most frequent colors slice - assumed the slice is in sorted descending order by counts
-func updateMostFrequentColors(mostColors []color.NRGBA, c color.NRGBA, counts map[color.NRGBA]uint64) {
-	if c == mostColors[0] || c == mostColors[1] || c == mostColors[2] {
-		// case 1: color is already one of the most frequent - check if it needs to be swapped
-		for j := 1; j < 3; j += 1 {
-			if c == mostColors[j] && counts[c] > counts[mostColors[j-1]] {
-				mostColors[j-1], mostColors[j] = mostColors[j], mostColors[j-1]
-				break
-			}
+// Configuration for how images are summarized
+type SummarizeConfig struct {
+	K        int   // number of prevalent colors to find
+	MinAlpha uint8 // pixels with a lower alpha are skipped (0 counts every pixel as opaque)
+	// QuantizeBits rounds each channel to this many bits (1-8) before counting so similar colors
+	// are counted together; 0 counts exact colors
+	QuantizeBits int
+	// SampleStride only counts every Nth pixel in each dimension, so a stride of 4 inspects 1/16th
+	// of the pixels. Colors covering large areas are still found, but small details may be missed
+	// and the ordering of colors with similar counts can change. 0 or 1 counts every pixel.
+	SampleStride int
+	// MaxDimension shrinks images so neither side is longer than this before counting, averaging the
+	// pixels each output pixel covers. Unlike a stride every pixel contributes, and averaging smooths
+	// noise, but blended colors appear along edges and fine details merge into their surroundings.
+	// 0 counts at full resolution
+	MaxDimension int
+	// CropFraction only counts the centered rectangle covering this fraction of the width and height,
+	// e.g. to skip the background around a product photo; 0.5 counts the center quarter of the pixels.
+	// 0 or 1 counts the whole image
+	CropFraction float64
+	Average      bool // also compute the average color of the counted pixels
+	Fractions    bool // also record the fraction of the counted pixels each prevalent color covers
+	// MinFraction leaves out colors covering less than this fraction of the counted pixels, such as
+	// anti-aliasing around a single-color image, so fewer than k colors (and no placeholders) are
+	// returned; 0 keeps all k
+	MinFraction float64
+	// MergeDistance merges colors within this CIE Lab distance (Delta E) of a more prevalent color
+	// before choosing the top k, so visually identical colors don't split the vote; 0 disables it
+	MergeDistance float64
+	// WeightSaturation ranks colors by their count weighted by saturation instead of the raw count, so
+	// a vivid color can beat a dull gray covering more pixels. PenalizeExtremes also down-weights
+	// colors near black or white. Weighting only changes the ranking; grays still win with nothing else
+	WeightSaturation bool
+	PenalizeExtremes bool
+	// AllFrames counts the pixels of every frame of an animated GIF instead of only the first
+	AllFrames bool
+	// Orientation records the EXIF orientation of JPEGs so they can be rotated later; the pixels are
+	// counted as stored either way, which doesn't change the colors found
+	Orientation bool
+	// AllowedFormats only decodes images in these formats (as named by image.Decode, e.g. "jpeg" and
+	// "png"), checking the header before any pixels are decoded so other registered decoders are never
+	// run; images in other formats fail without being retried. Empty allows every registered format
+	AllowedFormats []string
+	// MaxPixels rejects images whose header declares more pixels (width x height) than this before they're
+	// decoded, so a small file claiming huge dimensions can't exhaust memory; they fail without being
+	// retried. Images only a decoder from WithDecoder understands aren't checked. 0 allows any size
+	MaxPixels int64
+	// ColorModel converts each pixel before counting it, e.g. color.GrayModel or SepiaModel, so the
+	// prevalent colors (and average) are those of the converted image; MinAlpha is still compared to the
+	// alpha of the original pixel. nil counts the colors as they are
+	ColorModel color.Model `json:"-"`
+	// Composite blends semi-transparent pixels over Background before counting them, so a half
+	// transparent red counts as pink over white instead of as red; otherwise their alpha is ignored.
+	// Background's alpha isn't used, except that the zero value (fully transparent) means white
+	Composite  bool
+	Background color.NRGBA
+	decoders   []decoder // fallbacks for formats the image package doesn't recognize; see WithDecoder
+}
+
+// Background semi-transparent pixels are composited over, opaque
+func (cfg SummarizeConfig) background() color.NRGBA {
+	if cfg.Background.A == 0 {
+		return color.NRGBA{255, 255, 255, 255}
+	}
+	bg := cfg.Background
+	bg.A = 255
+	return bg
+}
+
+// A decoder for a format registered with RqPipeline.WithDecoder
+type decoder struct {
+	format string
+	decode func(io.Reader) (image.Image, error)
+}
+
+// Check a config is usable for summarizing
+func (cfg SummarizeConfig) validate() error {
+	if cfg.K <= 0 {
+		return errors.New("Summarize config value for K must be greater than 0")
+	}
+	if cfg.QuantizeBits < 0 || cfg.QuantizeBits > 8 {
+		return errors.New("Summarize config value for QuantizeBits must be between 0 and 8")
+	}
+	if cfg.SampleStride < 0 || cfg.MaxDimension < 0 || cfg.MergeDistance < 0 {
+		return errors.New("Summarize config values for SampleStride, MaxDimension and MergeDistance must not be negative")
+	}
+	if cfg.CropFraction < 0 || cfg.CropFraction > 1 {
+		return errors.New("Summarize config value for CropFraction must be between 0 and 1")
+	}
+	if cfg.MaxPixels < 0 {
+		return errors.New("Summarize config value for MaxPixels must not be negative")
+	}
+	if cfg.MinFraction < 0 || cfg.MinFraction > 1 {
+		return errors.New("Summarize config value for MinFraction must be between 0 and 1")
+	}
+	return nil
+}
+
+// Summarize the colors of an image; this is what the pipeline does for each image it downloads
+func SummarizeImage(img image.Image, cfg SummarizeConfig) (ColorSummary, error) {
+	if err := cfg.validate(); err != nil {
+		return ColorSummary{}, err
+	}
+	return getPrevalentColors(&img, cfg)
+}
+
+// Decode an image from r and summarize its colors
+// Decoding needs the formats to be registered, e.g. by importing image/jpeg or with image.RegisterFormat
+func SummarizeReader(r io.Reader, cfg SummarizeConfig) (ColorSummary, error) {
+	if err := cfg.validate(); err != nil {
+		return ColorSummary{}, err
+	}
+	img, _, err := decodeImage(r, cfg)
+	if err != nil {
+		return ColorSummary{}, err
+	}
+	return getPrevalentColors(&img, cfg)
+}
+
+// Every frame of an animated image; it acts as its first frame when used as an image.Image
+type animatedImage struct {
+	image.Image
+	frames []image.Image
+}
+
+// Returned when decoding an image in a format that's not in the config's AllowedFormats
+var errFormatNotAllowed = errors.New("Image format is not allowed")
+
+// Returned when decoding an image whose declared dimensions exceed the config's MaxPixels
+var errTooManyPixels = errors.New("Image has too many pixels")
+
+// Check the format and declared dimensions of an image are allowed by cfg; returns a reader for the
+// whole image. Only the header is read, so nothing is allocated for the pixels
+func checkFormat(r io.Reader, cfg SummarizeConfig) (io.Reader, error) {
+	if len(cfg.AllowedFormats) == 0 && cfg.MaxPixels == 0 {
+		return r, nil
+	}
+	head := new(bytes.Buffer)
+	imgCfg, format, err := image.DecodeConfig(io.TeeReader(r, head))
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.formatAllowed(format) {
+		return nil, fmt.Errorf("%w: %v", errFormatNotAllowed, format)
+	}
+	if cfg.MaxPixels > 0 && int64(imgCfg.Width)*int64(imgCfg.Height) > cfg.MaxPixels {
+		return nil, fmt.Errorf("%w: %vx%v", errTooManyPixels, imgCfg.Width, imgCfg.Height)
+	}
+	return io.MultiReader(head, r), nil
+}
+
+// Check a format is allowed by cfg
+func (cfg SummarizeConfig) formatAllowed(format string) bool {
+	if len(cfg.AllowedFormats) == 0 {
+		return true
+	}
+	for _, allowed := range cfg.AllowedFormats {
+		if strings.EqualFold(allowed, format) || (format == "jpeg" && strings.EqualFold(allowed, "jpg")) {
+			return true
 		}
-	} else {
-		// case 2: color is not one of the most frequent
-		//   if color counts is less than or equal to all of the most frequent, do nothing
-		//   otherwise, it's now one of the most frequent and we update the slice accordingly
-		if counts[c] > counts[mostColors[2]] {
-			for i := 0; i < 3; i += 1 {
-				if mostColors[i] == PlaceholderColor {
-					mostColors[i] = c
-					break
-				} else if i == 2 {
-					mostColors[2] = c
-				}
-			}
+	}
+	return false
+}
+
+// Decode an image using the decoding options of cfg, returning it with the name of its format like
+// image.Decode. The format is sniffed from the image's header first, and only images in a format the
+// image package doesn't recognize are read into memory and tried with each of the config's decoders in
+// turn, failing with image.ErrFormat if none of them can decode it
+func decodeImage(r io.Reader, cfg SummarizeConfig) (image.Image, string, error) {
+	if len(cfg.decoders) == 0 {
+		return decodeRegistered(r, cfg)
+	}
+	head := new(bytes.Buffer)
+	if _, _, err := image.DecodeConfig(io.TeeReader(r, head)); err != image.ErrFormat {
+		// a registered format, or a broken header that decoding reports the same way
+		return decodeRegistered(io.MultiReader(head, r), cfg)
+	}
+	data, err := ioutil.ReadAll(io.MultiReader(head, r))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, d := range cfg.decoders {
+		if !cfg.formatAllowed(d.format) {
+			continue
 		}
+		if img, err := d.decode(bytes.NewReader(data)); err == nil {
+			return img, d.format, nil
+		}
+	}
+	return nil, "", image.ErrFormat
+}
+
+// Decode an image in a format registered with the image package
+// With AllFrames, GIFs with more than one frame are decoded as an *animatedImage, and with Orientation
+// JPEGs with an EXIF orientation are decoded as an *orientedImage
+func decodeRegistered(r io.Reader, cfg SummarizeConfig) (image.Image, string, error) {
+	r, err := checkFormat(r, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	if !cfg.AllFrames && !cfg.Orientation {
+		return image.Decode(r)
+	}
+
+	peekSize := 4
+	if cfg.Orientation {
+		peekSize = exifPeekSize
+	}
+	br := bufio.NewReaderSize(r, peekSize)
+	head, _ := br.Peek(peekSize)
+	if cfg.AllFrames && bytes.HasPrefix(head, []byte("GIF8")) {
+		img, err := decodeAllFrames(br)
+		return img, "gif", err
+	}
+	orientation := 0
+	if cfg.Orientation {
+		// read before decoding, which invalidates head
+		orientation = readOrientation(head)
+	}
+	img, format, err := image.Decode(br)
+	if err != nil {
+		return nil, "", err
+	}
+	if orientation != 0 {
+		return &orientedImage{Image: img, orientation: orientation}, format, nil
 	}
+	return img, format, nil
 }
 
-// Return slice of colors in sorted order of prevalence
-func getPrevalentColors(imgPtr *image.Image) (colorSummary, error) {
-	// TODO: generalize to k most prevalent, use a min-heap
-	img := *imgPtr
+// Decode every frame of a GIF, as an *animatedImage if there's more than one
+func decodeAllFrames(r io.Reader) (image.Image, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) == 0 {
+		return nil, errors.New("gif: no frames")
+	}
+	if len(g.Image) == 1 {
+		return g.Image[0], nil
+	}
+	frames := make([]image.Image, len(g.Image))
+	for i, frame := range g.Image {
+		frames[i] = frame
+	}
+	return &animatedImage{Image: frames[0], frames: frames}, nil
+}
+
+// Round a channel value to the nearest of 2^bits evenly spaced levels (including 0 and 255)
+func quantizeChannel(v uint8, bits int) uint8 {
+	levels := uint32(1)<<uint(bits) - 1
+	level := (uint32(v)*levels + 127) / 255
+	return uint8(level * 255 / levels)
+}
+
+// Replace a color with the representative color of its bucket
+func quantizeColor(c color.NRGBA, bits int) color.NRGBA {
+	if bits <= 0 || bits >= 8 {
+		return c
+	}
+	c.R = quantizeChannel(c.R, bits)
+	c.G = quantizeChannel(c.G, bits)
+	c.B = quantizeChannel(c.B, bits)
+	return c
+}
+
+// Number of prevalent colors found when the pipeline isn't given a SummarizeConfig
+const DefaultK = 3
+
+// A color and the number of pixels it covers
+type colorCount struct {
+	color color.NRGBA
+	count uint64
+}
+
+// Returns true if a is less prevalent than b; ties are broken by color value so selection is deterministic
+func lessPrevalent(a, b colorCount) bool {
+	if a.count != b.count {
+		return a.count < b.count
+	}
+	return packColor(a.color) > packColor(b.color)
+}
+
+func packColor(c color.NRGBA) uint32 {
+	return uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
+}
+
+// min-heap of color counts; the root is the least prevalent color (implements heap.Interface)
+type colorCountHeap []colorCount
+
+func (h colorCountHeap) Len() int            { return len(h) }
+func (h colorCountHeap) Less(i, j int) bool  { return lessPrevalent(h[i], h[j]) }
+func (h colorCountHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *colorCountHeap) Push(x interface{}) { *h = append(*h, x.(colorCount)) }
+func (h *colorCountHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// Return up to k of the most prevalent colors from counts, sorted most prevalent first
+// Colors with the same count are ranked by value (R, then G, B and A), lowest first, so ties don't depend
+// on map iteration order (see lessPrevalent)
+func topKColors(counts map[color.NRGBA]uint64, k int) []colorCount {
+	h := make(colorCountHeap, 0, k)
+	for c, n := range counts {
+		cc := colorCount{c, n}
+		if h.Len() < k {
+			heap.Push(&h, cc)
+		} else if lessPrevalent(h[0], cc) {
+			// more prevalent than the least prevalent of the top k, so replace it
+			h[0] = cc
+			heap.Fix(&h, 0)
+		}
+	}
+
+	top := make([]colorCount, h.Len())
+	for i := len(top) - 1; i >= 0; i -= 1 {
+		top[i] = heap.Pop(&h).(colorCount)
+	}
+	return top
+}
+
+// Return slice of the k most prevalent colors in sorted order of prevalence
+// If the image has fewer than k colors, the remaining slots are filled with PlaceholderColor, unless
+// cfg.MinFraction is set, which leaves out colors covering too few pixels instead
+// Pixels of every frame of an *animatedImage are counted together (as stored, so later frames usually
+// only cover the area that changed)
+func getPrevalentColors(imgPtr *image.Image, cfg SummarizeConfig) (ColorSummary, error) {
+	if (*imgPtr).Bounds().Empty() {
+		// there are no pixels to count, so the result would be all placeholders
+		return ColorSummary{}, errEmptyImage
+	}
+	frames := []image.Image{*imgPtr}
+	if animated, ok := (*imgPtr).(*animatedImage); ok {
+		frames = animated.frames
+	}
+
+	stride := cfg.SampleStride
+	if stride < 1 {
+		stride = 1
+	}
+	background := cfg.background()
 
 	counts := make(map[color.NRGBA]uint64)
-	counts[PlaceholderColor] = 0
-	mostColors := []color.NRGBA{PlaceholderColor, PlaceholderColor, PlaceholderColor}
-
-	bounds := img.Bounds()
-	for x := bounds.Min.X; x < bounds.Max.X; x++ {
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			// convert color at x, y to NRGBA
-			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
-			c.A = 255
-			counts[c] += 1
-
-			// update most frequent colors
-			updateMostFrequentColors(mostColors, c, counts)
+	var sumR, sumG, sumB, nPixels uint64
+	for _, img := range frames {
+		img = downscale(centerCrop(img, cfg.CropFraction), cfg.MaxDimension)
+		bounds := img.Bounds()
+		for x := bounds.Min.X; x < bounds.Max.X; x += stride {
+			for y := bounds.Min.Y; y < bounds.Max.Y; y += stride {
+				// convert color at x, y to NRGBA
+				pixel := img.At(x, y)
+				c := color.NRGBAModel.Convert(pixel).(color.NRGBA)
+				if c.A < cfg.MinAlpha {
+					// (mostly) transparent, so not really a color in the image
+					continue
+				}
+				if cfg.Composite {
+					c = compositeOver(pixel, background)
+				} else {
+					c.A = 255
+				}
+				if cfg.ColorModel != nil {
+					c = color.NRGBAModel.Convert(cfg.ColorModel.Convert(c)).(color.NRGBA)
+				}
+				counts[quantizeColor(c, cfg.QuantizeBits)] += 1
+
+				sumR += uint64(c.R)
+				sumG += uint64(c.G)
+				sumB += uint64(c.B)
+				nPixels += 1
+			}
+		}
+	}
+
+	if cfg.MergeDistance > 0 {
+		counts = mergeSimilarColors(counts, cfg.MergeDistance)
+	}
+	pixelCounts := counts
+	if cfg.WeightSaturation || cfg.PenalizeExtremes {
+		counts = weightColors(counts, cfg.WeightSaturation, cfg.PenalizeExtremes)
+	}
+
+	top := topKColors(counts, cfg.K)
+	if cfg.MinFraction > 0 {
+		// weighted counts only rank the colors, the fraction is of the pixels actually counted
+		kept := top[:0]
+		for _, cc := range top {
+			if float64(pixelCounts[cc.color]) >= cfg.MinFraction*float64(nPixels) {
+				kept = append(kept, cc)
+			}
+		}
+		top = kept
+	}
+	nColors := cfg.K
+	if cfg.MinFraction > 0 {
+		// no placeholders for the dropped colors
+		nColors = len(top)
+	}
+
+	mostColors := make([]color.NRGBA, nColors)
+	for i := range mostColors {
+		mostColors[i] = PlaceholderColor
+	}
+	var fractions []float64
+	if cfg.Fractions {
+		// placeholders cover nothing
+		fractions = make([]float64, nColors)
+	}
+	for i, cc := range top {
+		mostColors[i] = cc.color
+		if fractions != nil {
+			fractions[i] = float64(pixelCounts[cc.color]) / float64(nPixels)
 		}
 	}
 
-	return colorSummary{mostColors}, nil
+	summary := ColorSummary{Colors: mostColors, Fractions: fractions, Dropped: cfg.K - nColors}
+	if cfg.AllFrames {
+		summary.Frames = len(frames)
+	}
+	if cfg.Orientation {
+		summary.HasOrientation = true
+		summary.Orientation = imageOrientation(*imgPtr)
+	}
+	if cfg.Average && nPixels > 0 {
+		summary.HasAverage = true
+		summary.Average = color.NRGBA{
+			R: uint8(sumR / nPixels),
+			G: uint8(sumG / nPixels),
+			B: uint8(sumB / nPixels),
+			A: 255,
+		}
+	}
+	return summary, nil
 }
@@ -1,13 +1,26 @@
-package main
+package rquent
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"image"
 	"image/color"
+	"image/draw"
+	"image/gif"
 	"image/jpeg"
+	"image/png"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
+
+	"github.com/macintoshpie/rquent/rquenttest"
 )
 
 func TestDownloadToFileSuccess(t *testing.T) {
@@ -21,7 +34,7 @@ func TestDownloadToFileSuccess(t *testing.T) {
 
 	// download the image
 	imgUrl := "http://mock.com/valid.jpg"
-	err = downloadToFile(imgUrl, localFile, testClient)
+	err = testDownloader.downloadToFile(context.Background(), imgUrl, localFile)
 	if err != nil {
 		t.Errorf("Expected (nil) Got (%v)", err)
 	}
@@ -43,7 +56,7 @@ func TestDownloadToFile404Image(t *testing.T) {
 
 	// download the image
 	imgUrl := "http://mock.com/bogusimage.jpg"
-	err = downloadToFile(imgUrl, localFile, testClient)
+	err = testDownloader.downloadToFile(context.Background(), imgUrl, localFile)
 	if err == nil {
 		t.Errorf("Expected (error) Got (%v)", err)
 	}
@@ -60,12 +73,34 @@ func TestDownloadImageToFileTimeout(t *testing.T) {
 
 	// visit url that waits longer than our client's timeout
 	imgUrl := "http://mock.com/slow"
-	err = downloadToFile(imgUrl, localFile, testClient)
+	err = testDownloader.downloadToFile(context.Background(), imgUrl, localFile)
 	if err == nil {
 		t.Errorf("Expected (client timeout error) Got (%v)", err)
 	}
 }
 
+var csvLineTests = []struct {
+	field    string
+	expected string
+}{
+	{"http://a.com/x.jpg", "http://a.com/x.jpg,1\n"},
+	{"http://a.com/x.jpg?w=1,2", `"http://a.com/x.jpg?w=1,2",1` + "\n"},
+	{`http://a.com/"x".jpg,`, `"http://a.com/""x"".jpg,",1` + "\n"},
+	{"http://a.com/x\n.jpg", "\"http://a.com/x\n.jpg\",1\n"},
+}
+
+func TestCsvLine(t *testing.T) {
+	for _, tt := range csvLineTests {
+		if got := string(csvLine([]string{tt.field, "1"}, ',')); got != tt.expected {
+			t.Errorf("Expected (%q) Got (%q)", tt.expected, got)
+		}
+	}
+	// with tabs, commas don't need quoting
+	if got := string(csvLine([]string{"http://a.com/x.jpg?w=1,2", "a\tb"}, '\t')); got != "http://a.com/x.jpg?w=1,2\t\"a\tb\"\n" {
+		t.Errorf("Expected (%q) Got (%q)", "http://a.com/x.jpg?w=1,2\t\"a\tb\"\n", got)
+	}
+}
+
 type colorFreq struct {
 	color color.NRGBA
 	freq  float32
@@ -75,23 +110,11 @@ type colorFreq struct {
 // It's user's responsibility to ensure the frequencies add to 1, else the result is unpredictable
 // Save image for debugging purposes
 func newColorsImage(width, height int, colors []colorFreq, save bool) image.Image {
-	img := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{width, height}})
-	var xStart, xEnd int
-	// for each color, calculate the start and end x positions, then fill in the column
+	columns := make([]rquenttest.ColorFreq, len(colors))
 	for i, c := range colors {
-		if i == 0 {
-			xStart = 0
-		} else {
-			xStart = xEnd
-		}
-		xEnd = xStart + int(c.freq*float32(width))
-
-		for x := xStart; x < xEnd; x++ {
-			for y := 0; y < height; y++ {
-				img.Set(x, y, c.color)
-			}
-		}
+		columns[i] = rquenttest.ColorFreq{Color: c.color, Freq: float64(c.freq)}
 	}
+	img := rquenttest.GenerateColorColumns(width, height, columns)
 
 	if save {
 		out, _ := os.Create("./newColorsImage.png")
@@ -101,10 +124,14 @@ func newColorsImage(width, height int, colors []colorFreq, save bool) image.Imag
 	return img
 }
 
+var testSummarizeConfig = SummarizeConfig{K: 3}
+
 var red = color.NRGBA{255, 0, 0, 255}
 var green = color.NRGBA{0, 255, 0, 255}
 var blue = color.NRGBA{0, 0, 255, 255}
 var white = color.NRGBA{255, 255, 255, 255}
+var black = color.NRGBA{0, 0, 0, 255}
+var yellow = color.NRGBA{255, 255, 0, 255}
 
 var rgbSingleColorTests = []struct {
 	name   string
@@ -120,14 +147,14 @@ func TestGetPrevalentColorsSingleColor(t *testing.T) {
 	for _, tt := range rgbSingleColorTests {
 		t.Run(tt.name, func(t *testing.T) {
 			colorImg := newColorsImage(width, height, tt.colors, false)
-			summary, err := getPrevalentColors(&colorImg)
+			summary, err := getPrevalentColors(&colorImg, testSummarizeConfig)
 
 			if err != nil {
 				t.Errorf("Expected (nil) Got (%v)", err)
 			}
 
-			if summary.colors[0] != tt.colors[0].color {
-				t.Errorf("Expected (colors[0] == %v) Got (%v)", tt.colors[0].color, summary.colors)
+			if summary.Colors[0] != tt.colors[0].color {
+				t.Errorf("Expected (colors[0] == %v) Got (%v)", tt.colors[0].color, summary.Colors)
 			}
 		})
 	}
@@ -147,7 +174,7 @@ func TestGetPrevalentColorsManyColors(t *testing.T) {
 	for _, tt := range rgbManyColorTests {
 		t.Run(tt.name, func(t *testing.T) {
 			colorImg := newColorsImage(width, height, tt.colorsSorted, false)
-			summary, err := getPrevalentColors(&colorImg)
+			summary, err := getPrevalentColors(&colorImg, testSummarizeConfig)
 
 			if err != nil {
 				t.Errorf("Expected (nil) Got (%v)", err)
@@ -157,16 +184,16 @@ func TestGetPrevalentColorsManyColors(t *testing.T) {
 			nExpected := int(math.Min(float64(len(tt.colorsSorted)), 3))
 			for i := 0; i < nExpected; i++ {
 				expected := tt.colorsSorted[i].color
-				if summary.colors[i] != expected {
-					t.Errorf("Expected (colors[%v] == %v) Got (%v)", i, expected, summary.colors[i])
+				if summary.Colors[i] != expected {
+					t.Errorf("Expected (colors[%v] == %v) Got (%v)", i, expected, summary.Colors[i])
 				}
 			}
 
 			// verify any remaining slots of results are empty (when there are less than 3 colors in image)
 			if nExpected < 3 {
 				for i := nExpected; i < 3; i += 1 {
-					if summary.colors[i] != PlaceholderColor {
-						t.Errorf("Expected(colors[%v] == placeholder) Got (%v)", i, summary.colors[i])
+					if summary.Colors[i] != PlaceholderColor {
+						t.Errorf("Expected(colors[%v] == placeholder) Got (%v)", i, summary.Colors[i])
 					}
 				}
 			}
@@ -174,14 +201,435 @@ func TestGetPrevalentColorsManyColors(t *testing.T) {
 	}
 }
 
+var rgbTopKTests = []struct {
+	name         string
+	k            int
+	colorsSorted []colorFreq
+}{
+	{"k=1", 1, []colorFreq{colorFreq{red, .5}, colorFreq{green, .3}, colorFreq{blue, .2}}},
+	{"k=5 with 6 colors", 5, []colorFreq{colorFreq{red, .3}, colorFreq{green, .25}, colorFreq{blue, .2},
+		colorFreq{white, .12}, colorFreq{black, .08}, colorFreq{yellow, .05}}},
+	{"k=5 with 2 colors", 5, []colorFreq{colorFreq{blue, .8}, colorFreq{red, .2}}},
+}
+
+func TestGetPrevalentColorsTopK(t *testing.T) {
+	const width, height = 100, 10
+	for _, tt := range rgbTopKTests {
+		t.Run(tt.name, func(t *testing.T) {
+			colorImg := newColorsImage(width, height, tt.colorsSorted, false)
+			summary, err := getPrevalentColors(&colorImg, SummarizeConfig{K: tt.k})
+
+			if err != nil {
+				t.Errorf("Expected (nil) Got (%v)", err)
+			}
+			if len(summary.Colors) != tt.k {
+				t.Fatalf("Expected (%v colors) Got (%v)", tt.k, len(summary.Colors))
+			}
+
+			// verify result
+			nExpected := int(math.Min(float64(len(tt.colorsSorted)), float64(tt.k)))
+			for i := 0; i < nExpected; i++ {
+				expected := tt.colorsSorted[i].color
+				if summary.Colors[i] != expected {
+					t.Errorf("Expected (colors[%v] == %v) Got (%v)", i, expected, summary.Colors[i])
+				}
+			}
+
+			// verify any remaining slots are padded with the placeholder
+			for i := nExpected; i < tt.k; i += 1 {
+				if summary.Colors[i] != PlaceholderColor {
+					t.Errorf("Expected(colors[%v] == placeholder) Got (%v)", i, summary.Colors[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetPrevalentColorsMinAlpha(t *testing.T) {
+	const width, height = 100, 10
+	transparent := color.NRGBA{0, 0, 0, 0}
+	colorImg := newColorsImage(width, height, []colorFreq{colorFreq{transparent, .7}, colorFreq{red, .3}}, false)
+
+	// by default transparent pixels are counted as opaque black
+	summary, _ := getPrevalentColors(&colorImg, testSummarizeConfig)
+	if summary.Colors[0] != black {
+		t.Errorf("Expected (colors[0] == %v) Got (%v)", black, summary.Colors[0])
+	}
+
+	// with a threshold they're skipped
+	summary, _ = getPrevalentColors(&colorImg, SummarizeConfig{K: 3, MinAlpha: 16})
+	if summary.Colors[0] != red {
+		t.Errorf("Expected (colors[0] == %v) Got (%v)", red, summary.Colors[0])
+	}
+	if summary.Colors[1] != PlaceholderColor {
+		t.Errorf("Expected (colors[1] == placeholder) Got (%v)", summary.Colors[1])
+	}
+}
+
+func TestGetPrevalentColorsComposite(t *testing.T) {
+	const width, height = 100, 10
+	halfRed := color.NRGBA{255, 0, 0, 128}
+	colorImg := newColorsImage(width, height, []colorFreq{colorFreq{halfRed, .7}, colorFreq{blue, .3}}, false)
+
+	// semi-transparent pixels count as opaque by default
+	summary, _ := getPrevalentColors(&colorImg, SummarizeConfig{K: 1})
+	if summary.Colors[0] != red {
+		t.Errorf("Expected (colors[0] == %v) Got (%v)", red, summary.Colors[0])
+	}
+
+	// composited over white by default, or over the background given
+	summary, _ = getPrevalentColors(&colorImg, SummarizeConfig{K: 2, Composite: true})
+	if pink := (color.NRGBA{255, 127, 127, 255}); summary.Colors[0] != pink || summary.Colors[1] != blue {
+		t.Errorf("Expected (%v, %v) Got (%v)", pink, blue, summary.Colors)
+	}
+	summary, _ = getPrevalentColors(&colorImg, SummarizeConfig{K: 1, Composite: true, Background: black})
+	if dark := (color.NRGBA{128, 0, 0, 255}); summary.Colors[0] != dark {
+		t.Errorf("Expected (%v) Got (%v)", dark, summary.Colors[0])
+	}
+}
+
+func TestGetPrevalentColorsEmpty(t *testing.T) {
+	var img image.Image = image.NewRGBA(image.Rect(0, 0, 0, 0))
+	if _, err := getPrevalentColors(&img, testSummarizeConfig); err != errEmptyImage {
+		t.Errorf("Expected (%v) Got (%v)", errEmptyImage, err)
+	}
+}
+
+func TestGetPrevalentColorsQuantize(t *testing.T) {
+	// a gradient of near-identical reds split the vote unless they're bucketed together
+	const width, height = 100, 10
+	colors := []colorFreq{
+		colorFreq{color.NRGBA{250, 0, 0, 255}, .2},
+		colorFreq{color.NRGBA{252, 2, 0, 255}, .2},
+		colorFreq{color.NRGBA{254, 0, 3, 255}, .2},
+		colorFreq{blue, .4},
+	}
+	colorImg := newColorsImage(width, height, colors, false)
+
+	summary, _ := getPrevalentColors(&colorImg, testSummarizeConfig)
+	if summary.Colors[0] != blue {
+		t.Errorf("Expected (colors[0] == %v) Got (%v)", blue, summary.Colors[0])
+	}
+
+	summary, _ = getPrevalentColors(&colorImg, SummarizeConfig{K: 3, QuantizeBits: 4})
+	if summary.Colors[0] != red {
+		t.Errorf("Expected (colors[0] == %v) Got (%v)", red, summary.Colors[0])
+	}
+	if summary.Colors[1] != blue {
+		t.Errorf("Expected (colors[1] == %v) Got (%v)", blue, summary.Colors[1])
+	}
+}
+
+func TestGetPrevalentColorsSampleStride(t *testing.T) {
+	const width, height = 100, 10
+	for _, tt := range rgbManyColorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			colorImg := newColorsImage(width, height, tt.colorsSorted, false)
+			summary, _ := getPrevalentColors(&colorImg, SummarizeConfig{K: 3, SampleStride: 2})
+
+			// large columns of color are still found
+			if summary.Colors[0] != tt.colorsSorted[0].color {
+				t.Errorf("Expected (colors[0] == %v) Got (%v)", tt.colorsSorted[0].color, summary.Colors[0])
+			}
+		})
+	}
+}
+
+func TestGetPrevalentColorsAverage(t *testing.T) {
+	const width, height = 100, 10
+	colorImg := newColorsImage(width, height, []colorFreq{colorFreq{red, .5}, colorFreq{blue, .5}}, false)
+
+	summary, _ := getPrevalentColors(&colorImg, testSummarizeConfig)
+	if summary.HasAverage {
+		t.Errorf("Expected (no average by default) Got (%v)", summary.Average)
+	}
+
+	summary, _ = getPrevalentColors(&colorImg, SummarizeConfig{K: 3, Average: true})
+	expected := color.NRGBA{127, 0, 127, 255}
+	if !summary.HasAverage || summary.Average != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, summary.Average)
+	}
+}
+
+// encode a gif with a solid red 4x4 frame followed by two solid blue ones
+func newAnimatedGIF() *bytes.Buffer {
+	palette := color.Palette{red, blue}
+	g := &gif.GIF{}
+	for _, index := range []uint8{0, 1, 1} {
+		frame := image.NewPaletted(image.Rect(0, 0, 4, 4), palette)
+		for i := range frame.Pix {
+			frame.Pix[i] = index
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 0)
+	}
+	b := new(bytes.Buffer)
+	gif.EncodeAll(b, g)
+	return b
+}
+
+func TestGetPrevalentColorsFractions(t *testing.T) {
+	const width, height = 100, 10
+	colorImg := newColorsImage(width, height, []colorFreq{colorFreq{red, .6}, colorFreq{blue, .4}}, false)
+
+	summary, _ := getPrevalentColors(&colorImg, testSummarizeConfig)
+	if summary.Fractions != nil {
+		t.Errorf("Expected (no fractions by default) Got (%v)", summary.Fractions)
+	}
+
+	// weighting changes the ranking, but the fractions are still of the pixels
+	cfg := SummarizeConfig{K: 3, Fractions: true, WeightSaturation: true}
+	summary, _ = getPrevalentColors(&colorImg, cfg)
+	expected := []float64{.6, .4, 0}
+	for i := range expected {
+		if math.Abs(summary.Fractions[i]-expected[i]) > 1e-9 {
+			t.Errorf("Expected (%v) Got (%v)", expected, summary.Fractions)
+			break
+		}
+	}
+}
+
+func TestGetPrevalentColorsMinFraction(t *testing.T) {
+	// Test colors covering too few pixels are left out rather than padded
+	const width, height = 100, 10
+	colorImg := newColorsImage(width, height, []colorFreq{colorFreq{red, .97}, colorFreq{blue, .03}}, false)
+
+	cfg := SummarizeConfig{K: 3, MinFraction: .05, Fractions: true}
+	summary, err := getPrevalentColors(&colorImg, cfg)
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if len(summary.Colors) != 1 || summary.Colors[0] != red || len(summary.Fractions) != 1 || summary.Dropped != 2 {
+		t.Errorf("Expected ([%v] with 2 dropped) Got (%v with %v dropped)", red, summary.Colors, summary.Dropped)
+	}
+
+	cfg.MinFraction = .03
+	summary, _ = getPrevalentColors(&colorImg, cfg)
+	if len(summary.Colors) != 2 || summary.Colors[1] != blue || summary.Dropped != 1 {
+		t.Errorf("Expected ([%v %v] with 1 dropped) Got (%v with %v dropped)", red, blue, summary.Colors, summary.Dropped)
+	}
+}
+
+func TestGetPrevalentColorsColorModel(t *testing.T) {
+	// Test colors are counted after converting them, so colors with the same gray are counted together
+	toGray := func(c color.NRGBA) color.NRGBA {
+		return color.NRGBAModel.Convert(color.GrayModel.Convert(c)).(color.NRGBA)
+	}
+	redGray := toGray(red)
+	colorImg := newColorsImage(100, 10, []colorFreq{colorFreq{red, .5}, colorFreq{redGray, .3}, colorFreq{blue, .2}}, false)
+
+	summary, err := getPrevalentColors(&colorImg, SummarizeConfig{K: 3, ColorModel: color.GrayModel, Fractions: true, Average: true})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	expected := []color.NRGBA{redGray, toGray(blue), PlaceholderColor}
+	for i := range expected {
+		if summary.Colors[i] != expected[i] {
+			t.Errorf("Expected (%v) Got (%v)", expected, summary.Colors)
+			break
+		}
+	}
+	if summary.Fractions[0] != .8 {
+		t.Errorf("Expected (0.8) Got (%v)", summary.Fractions[0])
+	}
+	if avg := summary.Average; avg.R != avg.G || avg.G != avg.B {
+		t.Errorf("Expected (gray average) Got (%v)", avg)
+	}
+
+	// the default path counts the colors as they are
+	summary, _ = getPrevalentColors(&colorImg, SummarizeConfig{K: 1})
+	if summary.Colors[0] != red {
+		t.Errorf("Expected (%v) Got (%v)", red, summary.Colors[0])
+	}
+}
+
+func TestGetPrevalentColorsAllFrames(t *testing.T) {
+	// Test only the first frame is counted by default
+	img, _, err := decodeImage(newAnimatedGIF(), SummarizeConfig{})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	summary, _ := getPrevalentColors(&img, SummarizeConfig{K: 1})
+	if summary.Colors[0] != red || summary.Frames != 0 {
+		t.Errorf("Expected (%v from 0 frames) Got (%v from %v frames)", red, summary.Colors[0], summary.Frames)
+	}
+
+	// Test every frame is counted with AllFrames
+	img, format, err := decodeImage(newAnimatedGIF(), SummarizeConfig{AllFrames: true})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if format != "gif" {
+		t.Errorf("Expected (gif) Got (%v)", format)
+	}
+	summary, _ = getPrevalentColors(&img, SummarizeConfig{K: 1, AllFrames: true})
+	if summary.Colors[0] != blue || summary.Frames != 3 {
+		t.Errorf("Expected (%v from 3 frames) Got (%v from %v frames)", blue, summary.Colors[0], summary.Frames)
+	}
+	if img.Bounds().Dx() != 4 {
+		t.Errorf("Expected (width 4) Got (%v)", img.Bounds().Dx())
+	}
+}
+
+func TestDecodeImageAllFramesNotGIF(t *testing.T) {
+	f, err := os.Open(testImagePathValid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, _, err := decodeImage(f, SummarizeConfig{AllFrames: true})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if _, ok := img.(*animatedImage); ok {
+		t.Errorf("Expected (jpeg to decode as a single image) Got (*animatedImage)")
+	}
+}
+
+func TestSummarizeImage(t *testing.T) {
+	colorImg := newColorsImage(100, 10, []colorFreq{colorFreq{red, .7}, colorFreq{blue, .3}}, false)
+	summary, err := SummarizeImage(colorImg, SummarizeConfig{K: 2})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	hexes := summary.HexColors()
+	if len(hexes) != 2 || hexes[0] != "#ff0000" || hexes[1] != "#0000ff" {
+		t.Errorf("Expected ([#ff0000 #0000ff]) Got (%v)", hexes)
+	}
+
+	if _, err := SummarizeImage(colorImg, SummarizeConfig{}); err == nil {
+		t.Errorf("Expected (error for K of 0) Got (nil)")
+	}
+}
+
+func TestSummarizeReader(t *testing.T) {
+	summary, err := SummarizeReader(newAnimatedGIF(), SummarizeConfig{K: 1, AllFrames: true})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if summary.Colors[0] != blue || summary.Frames != 3 {
+		t.Errorf("Expected (%v from 3 frames) Got (%v from %v frames)", blue, summary.Colors[0], summary.Frames)
+	}
+}
+
+func TestQuantizeChannel(t *testing.T) {
+	for _, bits := range []int{1, 4, 7} {
+		if got := quantizeChannel(0, bits); got != 0 {
+			t.Errorf("Expected (0) Got (%v) for %v bits", got, bits)
+		}
+		if got := quantizeChannel(255, bits); got != 255 {
+			t.Errorf("Expected (255) Got (%v) for %v bits", got, bits)
+		}
+	}
+	if got := quantizeChannel(120, 1); got != 0 {
+		t.Errorf("Expected (0) Got (%v)", got)
+	}
+	if got := quantizeChannel(130, 1); got != 255 {
+		t.Errorf("Expected (255) Got (%v)", got)
+	}
+}
+
+func TestTopKColorsDeterministic(t *testing.T) {
+	// Test that selection doesn't depend on map iteration order when counts tie
+	counts := map[color.NRGBA]uint64{red: 5, green: 5, blue: 5, white: 1}
+	first := topKColors(counts, 2)
+	for i := 0; i < 20; i += 1 {
+		got := topKColors(counts, 2)
+		for j := range first {
+			if got[j] != first[j] {
+				t.Fatalf("Expected (%v) Got (%v)", first, got)
+			}
+		}
+	}
+}
+
+// check the colors of top are expected, in order
+func checkTopColors(t *testing.T, top []colorCount, expected []color.NRGBA) {
+	t.Helper()
+	got := make([]color.NRGBA, len(top))
+	for i, cc := range top {
+		got[i] = cc.color
+	}
+	if len(got) != len(expected) {
+		t.Errorf("Expected (%v) Got (%v)", expected, got)
+		return
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected (%v) Got (%v)", expected, got)
+			return
+		}
+	}
+}
+
+func TestTopKColorsTies(t *testing.T) {
+	// Test tied colors are ranked by value, lowest first (blue < green < red < white)
+	counts := map[color.NRGBA]uint64{red: 5, green: 5, blue: 5, white: 1}
+	checkTopColors(t, topKColors(counts, 2), []color.NRGBA{blue, green})
+	checkTopColors(t, topKColors(counts, 4), []color.NRGBA{blue, green, red, white})
+
+	// a tie with a more prevalent color doesn't change its place
+	counts = map[color.NRGBA]uint64{white: 7, blue: 5, green: 5}
+	checkTopColors(t, topKColors(counts, 3), []color.NRGBA{white, blue, green})
+}
+
+func TestTopKColorsExactlyK(t *testing.T) {
+	// Test exactly k colors are all returned, and fewer than k aren't padded here
+	counts := map[color.NRGBA]uint64{red: 3, green: 2, blue: 1}
+	checkTopColors(t, topKColors(counts, 3), []color.NRGBA{red, green, blue})
+	checkTopColors(t, topKColors(counts, 4), []color.NRGBA{red, green, blue})
+	checkTopColors(t, topKColors(map[color.NRGBA]uint64{}, 3), []color.NRGBA{})
+}
+
+func TestTopKColorsOvertake(t *testing.T) {
+	// Test a fourth color replaces the third once it covers more pixels, but not when it ties
+	counts := map[color.NRGBA]uint64{red: 10, green: 8, blue: 5}
+	for _, test := range []struct {
+		count    uint64
+		expected []color.NRGBA
+	}{
+		{4, []color.NRGBA{red, green, blue}},
+		{5, []color.NRGBA{red, green, blue}}, // ties go to the lower color, blue
+		{6, []color.NRGBA{red, green, white}},
+		{9, []color.NRGBA{red, white, green}},
+		{11, []color.NRGBA{white, red, green}},
+	} {
+		counts[white] = test.count
+		checkTopColors(t, topKColors(counts, 3), test.expected)
+	}
+}
+
+func TestGetPrevalentColorsExactlyK(t *testing.T) {
+	// Test an image with exactly k colors has no placeholders, and k+1 pads with one
+	colorImg := newColorsImage(100, 10, []colorFreq{colorFreq{red, .5}, colorFreq{green, .3}, colorFreq{blue, .2}}, false)
+	summary, _ := getPrevalentColors(&colorImg, SummarizeConfig{K: 3})
+	expected := []color.NRGBA{red, green, blue}
+	for i := range expected {
+		if summary.Colors[i] != expected[i] {
+			t.Errorf("Expected (%v) Got (%v)", expected, summary.Colors)
+			break
+		}
+	}
+
+	summary, _ = getPrevalentColors(&colorImg, SummarizeConfig{K: 4})
+	if len(summary.Colors) != 4 || summary.Colors[3] != PlaceholderColor {
+		t.Errorf("Expected (%v padded with %v) Got (%v)", expected, PlaceholderColor, summary.Colors)
+	}
+}
+
 // prevent compiler from removing result in benchmarks
-var result colorSummary
+var result ColorSummary
 
 func benchmarkGetPrevalentColors(width, height int, b *testing.B) {
-	var colors colorSummary
+	benchmarkGetPrevalentColorsConfig(width, height, testSummarizeConfig, b)
+}
+
+func benchmarkGetPrevalentColorsConfig(width, height int, cfg SummarizeConfig, b *testing.B) {
+	var colors ColorSummary
 	colorImg := newColorsImage(width, height, []colorFreq{colorFreq{red, 1}}, false)
 	for n := 0; n < b.N; n++ {
-		colors, _ = getPrevalentColors(&colorImg)
+		colors, _ = getPrevalentColors(&colorImg, cfg)
 	}
 
 	result = colors
@@ -199,6 +647,14 @@ func BenchmarkGetPrevalentColors1_000_000px(b *testing.B) {
 	benchmarkGetPrevalentColors(1000, 1000, b)
 }
 
+func BenchmarkGetPrevalentColors1_000_000pxStride4(b *testing.B) {
+	benchmarkGetPrevalentColorsConfig(1000, 1000, SummarizeConfig{K: 3, SampleStride: 4}, b)
+}
+
+func BenchmarkGetPrevalentColors1_000_000pxMaxDimension256(b *testing.B) {
+	benchmarkGetPrevalentColorsConfig(1000, 1000, SummarizeConfig{K: 3, MaxDimension: 256}, b)
+}
+
 // const testImagesURL = "localhost:8080/random"
 
 // func benchmarkProcessImages(nImages int, pipelineEntry func(chan RqImage), b *testing.B) {
@@ -217,3 +673,97 @@ func BenchmarkGetPrevalentColors1_000_000px(b *testing.B) {
 // func BenchmarkProcessImagesSync_100(b *testing.B) {
 // 	benchmarkProcessImagesSync(100, ProcessImagesSync, b)
 // }
+
+// Decodes "FAKE" followed by a color as a 3x2 image of that color
+func decodeFake(r io.Reader) (image.Image, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil || len(b) != 7 || string(b[:4]) != "FAKE" {
+		return nil, errors.New("not a fake image")
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{b[4], b[5], b[6], 255}), image.ZP, draw.Src)
+	return img, nil
+}
+
+func TestDecodeImageDecoders(t *testing.T) {
+	// Test decoders are only tried for formats the image package doesn't recognize
+	failing := decoder{"failing", func(io.Reader) (image.Image, error) { return nil, errors.New("failed") }}
+	cfg := SummarizeConfig{decoders: []decoder{failing, {"fake", decodeFake}}}
+	img, format, err := decodeImage(strings.NewReader("FAKE\xff\x00\x00"), cfg)
+	if err != nil || img.At(0, 0) != red || img.Bounds().Dx() != 3 || format != "fake" {
+		t.Errorf("Expected (%v fake image) Got (%v, %v, %v)", red, img, format, err)
+	}
+	img, format, err = decodeImage(newAnimatedGIF(), cfg)
+	if err != nil || img.Bounds().Empty() || format != "gif" {
+		t.Errorf("Expected (gif image) Got (%v, %v, %v)", img, format, err)
+	}
+	_, _, err = decodeImage(strings.NewReader("not an image"), cfg)
+	if err != image.ErrFormat {
+		t.Errorf("Expected (%v) Got (%v)", image.ErrFormat, err)
+	}
+
+	// recognized formats are decoded as they're read, not read to the end first
+	b := new(bytes.Buffer)
+	png.Encode(b, image.NewNRGBA(image.Rect(0, 0, 2, 2)))
+	_, format, err = decodeImage(io.MultiReader(b, iotest.ErrReader(errors.New("read past the image"))), cfg)
+	if err != nil || format != "png" {
+		t.Errorf("Expected (png, nil) Got (%v, %v)", format, err)
+	}
+
+	// decoders for formats that aren't allowed are skipped
+	cfg.AllowedFormats = []string{"png"}
+	_, _, err = decodeImage(strings.NewReader("FAKE\xff\x00\x00"), cfg)
+	if err != image.ErrFormat {
+		t.Errorf("Expected (%v) Got (%v)", image.ErrFormat, err)
+	}
+}
+
+// create a tiny PNG whose header claims it's width x height, as in a decompression bomb
+func newOversizedPNG(width, height uint32) []byte {
+	b := new(bytes.Buffer)
+	png.Encode(b, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	data := b.Bytes()
+	// the IHDR chunk follows the 8 byte signature: length, type, then width and height
+	ihdr := data[8+4 : 8+4+4+13]
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	binary.BigEndian.PutUint32(data[8+4+4+13:], crc32.ChecksumIEEE(ihdr))
+	return data
+}
+
+func TestDecodeImageMaxPixels(t *testing.T) {
+	// Test images declaring too many pixels are rejected from their header
+	bomb := newOversizedPNG(100000, 100000)
+	_, _, err := decodeImage(bytes.NewReader(bomb), SummarizeConfig{MaxPixels: 1000000})
+	if !errors.Is(err, errTooManyPixels) {
+		t.Errorf("Expected (%v) Got (%v)", errTooManyPixels, err)
+	}
+
+	img, _, err := decodeImage(bytes.NewReader(newOversizedPNG(1, 1)), SummarizeConfig{MaxPixels: 1})
+	if err != nil || img.Bounds().Dx() != 1 {
+		t.Errorf("Expected (1x1 image) Got (%v, %v)", img, err)
+	}
+	if err := (SummarizeConfig{K: 1, MaxPixels: -1}).validate(); err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestDecodeImageAllowedFormats(t *testing.T) {
+	// Test only allowed formats are decoded, with jpg accepted for jpeg
+	pngImage := new(bytes.Buffer)
+	png.Encode(pngImage, image.NewNRGBA(image.Rect(0, 0, 2, 2)))
+	jpegImage := new(bytes.Buffer)
+	jpeg.Encode(jpegImage, image.NewNRGBA(image.Rect(0, 0, 2, 2)), nil)
+
+	cfg := SummarizeConfig{AllowedFormats: []string{"PNG", "jpg"}}
+	for _, b := range []*bytes.Buffer{pngImage, jpegImage} {
+		img, _, err := decodeImage(bytes.NewReader(b.Bytes()), cfg)
+		if err != nil || img.Bounds().Dx() != 2 {
+			t.Errorf("Expected (2x2 image) Got (%v, %v)", img, err)
+		}
+	}
+	_, _, err := decodeImage(newAnimatedGIF(), cfg)
+	if !errors.Is(err, errFormatNotAllowed) {
+		t.Errorf("Expected (%v) Got (%v)", errFormatNotAllowed, err)
+	}
+}
@@ -0,0 +1,93 @@
+package rquent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Characters that aren't safe in file names on every platform
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Longest part of a kept image's name taken from its url, so names stay well within filesystem limits
+const maxKeptNameLength = 100
+
+// File name to keep the image downloaded from imgURL under: the last part of its path (or "image"),
+// then a hash of the whole url so different urls never share a name, whatever order they finish in
+// The same url always gets the same name, so a re-run overwrites its own images
+func keptName(imgURL string) string {
+	stem, ext := keptStem(imgURL)
+	return stem + ext
+}
+
+// Split a kept image's name into the part before its extension, which files about the same image
+// (e.g. swatches) can share, and the extension from the url (which may be "")
+func keptStem(imgURL string) (string, string) {
+	base := ""
+	if u, err := url.Parse(imgURL); err == nil && !isDataURI(imgURL) && strings.Trim(u.Path, "/.") != "" {
+		base = path.Base(u.Path)
+	}
+	ext := path.Ext(base)
+	stem := unsafeNameChars.ReplaceAllString(strings.TrimSuffix(base, ext), "_")
+	ext = unsafeNameChars.ReplaceAllString(ext, "")
+	if strings.Trim(stem, "_.") == "" {
+		stem = "image"
+	}
+	if len(stem) > maxKeptNameLength {
+		stem = stem[:maxKeptNameLength]
+	}
+	if len(ext) > 10 {
+		ext = ""
+	}
+	sum := sha256.Sum256([]byte(imgURL))
+	return stem + "-" + hex.EncodeToString(sum[:4]), ext
+}
+
+// Move a file, copying it when it can't be renamed (e.g. to another filesystem)
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Move a downloaded image into dir instead of deleting it; returns true if the job was passed to the next stage
+func keepImage(ctx context.Context, job RqJob, dir string, errorChn chan<- RqError) bool {
+	if job.image.filePath == "" {
+		// nothing was downloaded, or it was read from a local path that's already kept
+		return sendJob(ctx, job.nextChn, job)
+	}
+
+	if err := moveFile(job.image.filePath, filepath.Join(dir, keptName(job.image.URL))); err != nil {
+		sendError(ctx, errorChn, NewRqError(job, RqErrorCleanup, err.Error()))
+		return false
+	}
+
+	job.image.filePath = ""
+	return sendJob(ctx, job.nextChn, job)
+}
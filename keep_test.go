@@ -0,0 +1,78 @@
+package rquent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeptName(t *testing.T) {
+	for _, test := range []struct {
+		url    string
+		prefix string
+		ext    string
+	}{
+		{"http://a.com/photos/cat.jpg?w=100", "cat-", ".jpg"},
+		{"http://a.com/photos/my%20cat.png", "my_cat-", ".png"},
+		{"http://a.com/", "image-", ""},
+		{"http://a.com/download", "download-", ""},
+		{"data:image/png;base64,AAAA", "image-", ""},
+	} {
+		name := keptName(test.url)
+		if !strings.HasPrefix(name, test.prefix) || !strings.HasSuffix(name, test.ext) || filepath.Ext(name) != test.ext {
+			t.Errorf("Expected (%v<hash>%v) Got (%v)", test.prefix, test.ext, name)
+		}
+	}
+
+	// the same file name at different urls is kept apart, and a url always gets the same name
+	a, b := keptName("http://a.com/x.jpg"), keptName("http://b.com/x.jpg")
+	if a == b || a != keptName("http://a.com/x.jpg") {
+		t.Errorf("Expected (distinct stable names) Got (%v and %v)", a, b)
+	}
+}
+
+func TestPipelineRunKeepImages(t *testing.T) {
+	// Test downloaded images are moved into the directory instead of deleted
+	dir, err := ioutil.TempDir("", "rquent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(new(bytes.Buffer)).
+		WithKeepImages(dir).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	if result, _ := pipeline.Run(); result.Succeeded != 1 {
+		t.Errorf("Expected (1 succeeded) Got (%+v)", result)
+	}
+	kept, err := ioutil.ReadFile(filepath.Join(dir, keptName(testImageURL200)))
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	original, _ := ioutil.ReadFile(testImagePathValid)
+	if !bytes.Equal(kept, original) {
+		t.Errorf("Expected (%v bytes of the image) Got (%v bytes)", len(original), len(kept))
+	}
+}
+
+func TestMakePipelineKeepImagesInMemory(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithOutput(new(bytes.Buffer)).
+		WithInMemory(true).
+		WithKeepImages(os.TempDir()).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
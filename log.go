@@ -0,0 +1,66 @@
+package rquent
+
+import (
+	"fmt"
+	"log"
+)
+
+// Receives the pipeline's log messages
+//
+//	Debug: per-image progress (started, downloaded, summarized, ...)
+//	Info:  retried errors and pipeline completion
+//	Error: failed images and pipeline failures
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelError
+)
+
+// Logger that discards everything; the default for pipelines
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// Logger that writes messages at or above a level to a standard library logger
+type stdLogger struct {
+	logger *log.Logger
+	level  LogLevel
+}
+
+// Create a Logger writing messages at or above level to logger (or the standard logger if nil)
+func NewStdLogger(logger *log.Logger, level LogLevel) Logger {
+	return &stdLogger{logger, level}
+}
+
+func (l *stdLogger) logf(level LogLevel, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	if l.logger == nil {
+		log.Output(3, fmt.Sprintf(format, args...))
+		return
+	}
+	l.logger.Output(3, fmt.Sprintf(format, args...))
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) {
+	l.logf(LogLevelDebug, format, args...)
+}
+
+func (l *stdLogger) Infof(format string, args ...interface{}) {
+	l.logf(LogLevelInfo, format, args...)
+}
+
+func (l *stdLogger) Errorf(format string, args ...interface{}) {
+	l.logf(LogLevelError, format, args...)
+}
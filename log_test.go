@@ -0,0 +1,110 @@
+package rquent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStdLoggerLevels(t *testing.T) {
+	b := new(bytes.Buffer)
+	logger := NewStdLogger(log.New(b, "", 0), LogLevelInfo)
+
+	logger.Debugf("debug %v", 1)
+	logger.Infof("info %v", 2)
+	logger.Errorf("error %v", 3)
+
+	expected := "info 2\nerror 3\n"
+	if b.String() != expected {
+		t.Errorf("Expected (%q) Got (%q)", expected, b.String())
+	}
+}
+
+func TestPipelineLogger(t *testing.T) {
+	// Test that per-image progress is logged at debug level and completion at info
+	b := new(bytes.Buffer)
+	logs := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(b).
+		WithLogger(NewStdLogger(log.New(logs, "", 0), LogLevelInfo)).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	if strings.Contains(logs.String(), "Downloaded") {
+		t.Errorf("Expected (no debug lines) Got (%v)", logs.String())
+	}
+	if !strings.Contains(logs.String(), "PIPELINE COMPLETE!") {
+		t.Errorf("Expected (completion line) Got (%v)", logs.String())
+	}
+}
+
+func TestPipelineLogsSettings(t *testing.T) {
+	// Test the start of a run logs the settings that produced its output
+	logs := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(new(bytes.Buffer)).
+		WithFormat(FormatJSONL).
+		WithLogger(NewStdLogger(log.New(logs, "", 0), LogLevelInfo)).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	line := strings.SplitN(logs.String(), "\n", 2)[0]
+	for _, expected := range []string{"Starting run", "timeout 5s", "format jsonl", "k 3"} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("Expected (%q in first line) Got (%v)", expected, line)
+		}
+	}
+}
+
+func TestPipelineLogsRetriedErrorsAtDebug(t *testing.T) {
+	// Test an error that's retried isn't logged at info, so only failed images show up there
+	data, err := ioutil.ReadFile(testImagePathValid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(data)
+	}))
+	defer s.Close()
+
+	logs := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader(s.URL + "/a.jpg")).
+		WithOutput(new(bytes.Buffer)).
+		WithLogger(NewStdLogger(log.New(logs, "", 0), LogLevelInfo)).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, _ := pipeline.Run()
+	if result.Succeeded != 1 || result.Retried != 1 {
+		t.Fatalf("Expected (1 succeeded after 1 retry) Got (%+v)", result)
+	}
+	if strings.Contains(logs.String(), "Job Error") {
+		t.Errorf("Expected (no retried errors) Got (%v)", logs.String())
+	}
+}
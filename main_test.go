@@ -1,7 +1,8 @@
-package main
+package rquent
 
 import (
 	"context"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -50,12 +51,28 @@ func mockHandlerFunc() http.Handler {
 	})
 }
 
+// create a server for benchmarks that serves the valid image from memory at any path after waiting
+// latency, so urls can all differ and requests aren't slowed down by reading the file
+func newImageServer(tb testing.TB, latency time.Duration) *httptest.Server {
+	data, err := ioutil.ReadFile(testImagePathValid)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(latency)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(data)
+	}))
+}
+
 var testClient *http.Client
+var testDownloader *downloader
 
 func TestMain(m *testing.M) {
 	// setup
 	var sClose func()
-	testClient, sClose = mockHTTPClient(*newClient(defaultTimeout), mockHandlerFunc())
+	testClient, sClose = mockHTTPClient(*newClient(DefaultTimeout), mockHandlerFunc())
+	testDownloader = newDownloader(testClient, DefaultDownloadConfig)
 
 	// run tests
 	res := m.Run()
@@ -0,0 +1,98 @@
+package rquent
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// Writes results in the order their jobs were read from the source
+// Results that finish early are buffered, up to size of them; when the buffer is full the writer
+// stops waiting for the oldest missing result so a stuck job can't hold everything back, and that
+// result is written out of order if it ever finishes
+type orderedWriter struct {
+	mux     sync.Mutex
+	out     io.Writer
+	size    int
+	next    uint64            // index of the next result to write
+	pending map[uint64][]byte // buffered results by index; nil for jobs that failed
+}
+
+func newOrderedWriter(out io.Writer, size int) *orderedWriter {
+	return &orderedWriter{
+		out:     out,
+		size:    size,
+		pending: make(map[uint64][]byte),
+	}
+}
+
+// Record the result line of the job at index (nil if it failed) and write any results now in order
+func (w *orderedWriter) complete(index uint64, line []byte) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if index < w.next {
+		// already gave up waiting for this one, so write it late rather than lose it
+		if line == nil {
+			return nil
+		}
+		_, err := w.out.Write(line)
+		return err
+	}
+
+	w.pending[index] = line
+	if len(w.pending) > w.size {
+		w.next = w.oldest()
+	}
+	return w.flush()
+}
+
+// Write buffered results starting from next until one is missing; lock must be held
+func (w *orderedWriter) flush() error {
+	for {
+		line, ok := w.pending[w.next]
+		if !ok {
+			return nil
+		}
+		delete(w.pending, w.next)
+		w.next += 1
+		if line == nil {
+			continue
+		}
+		if _, err := w.out.Write(line); err != nil {
+			return err
+		}
+	}
+}
+
+// Index of the oldest buffered result; lock must be held
+func (w *orderedWriter) oldest() uint64 {
+	first := true
+	var oldest uint64
+	for index := range w.pending {
+		if first || index < oldest {
+			oldest = index
+			first = false
+		}
+	}
+	return oldest
+}
+
+// Write every buffered result in order, skipping over missing ones (e.g. when the run stops early)
+func (w *orderedWriter) close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	indexes := make([]uint64, 0, len(w.pending))
+	for index := range w.pending {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	for _, index := range indexes {
+		w.next = index
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package rquent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOrderedWriterInOrder(t *testing.T) {
+	b := new(bytes.Buffer)
+	w := newOrderedWriter(b, 10)
+
+	w.complete(2, []byte("c\n"))
+	w.complete(1, []byte("b\n"))
+	if b.Len() != 0 {
+		t.Errorf("Expected (nothing written before first result) Got (%q)", b.String())
+	}
+	w.complete(0, []byte("a\n"))
+
+	if b.String() != "a\nb\nc\n" {
+		t.Errorf("Expected (%q) Got (%q)", "a\nb\nc\n", b.String())
+	}
+}
+
+func TestOrderedWriterSkipsFailed(t *testing.T) {
+	b := new(bytes.Buffer)
+	w := newOrderedWriter(b, 10)
+
+	w.complete(1, []byte("b\n"))
+	w.complete(0, nil)
+
+	if b.String() != "b\n" {
+		t.Errorf("Expected (%q) Got (%q)", "b\n", b.String())
+	}
+}
+
+func TestOrderedWriterBufferFull(t *testing.T) {
+	// Test a stuck job doesn't hold back more than size results
+	b := new(bytes.Buffer)
+	w := newOrderedWriter(b, 2)
+
+	w.complete(1, []byte("b\n"))
+	w.complete(2, []byte("c\n"))
+	w.complete(3, []byte("d\n"))
+	if b.String() != "b\nc\nd\n" {
+		t.Errorf("Expected (%q) Got (%q)", "b\nc\nd\n", b.String())
+	}
+
+	// the stuck job is still written when it finishes
+	w.complete(0, []byte("a\n"))
+	if b.String() != "b\nc\nd\na\n" {
+		t.Errorf("Expected (%q) Got (%q)", "b\nc\nd\na\n", b.String())
+	}
+}
+
+func TestOrderedWriterClose(t *testing.T) {
+	b := new(bytes.Buffer)
+	w := newOrderedWriter(b, 10)
+
+	w.complete(3, []byte("d\n"))
+	w.complete(1, []byte("b\n"))
+	if err := w.close(); err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	if b.String() != "b\nd\n" {
+		t.Errorf("Expected (%q) Got (%q)", "b\nd\n", b.String())
+	}
+}
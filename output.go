@@ -0,0 +1,323 @@
+package rquent
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RqOutputFormat int
+
+const (
+	FormatCSV RqOutputFormat = iota
+	FormatJSONL
+)
+
+// Name of the format, as parsed by ParseOutputFormat
+func (format RqOutputFormat) String() string {
+	switch format {
+	case FormatCSV:
+		return "csv"
+	case FormatJSONL:
+		return "jsonl"
+	default:
+		return "RqOutputFormat(" + strconv.Itoa(int(format)) + ")"
+	}
+}
+
+// Parse an output format from its name (as used on the command line)
+func ParseOutputFormat(name string) (RqOutputFormat, error) {
+	switch strings.ToLower(name) {
+	case "csv":
+		return FormatCSV, nil
+	case "jsonl", "ndjson":
+		return FormatJSONL, nil
+	default:
+		return FormatCSV, errors.New("Unknown output format: " + name)
+	}
+}
+
+// Settings for formatting the output lines, built once from a pipeline's options
+type outputOptions struct {
+	hex         HexFormat
+	hsl         bool // also write the colors in hsl
+	timings     bool // add the stage timings columns to the header
+	size        bool // write the image's size in bytes
+	imageFormat bool // write the format the image was decoded from
+	average     bool // write the average color, left empty for images without one
+	comma       rune // separates CSV fields, a comma if zero
+}
+
+// The CSV field delimiter
+func (opts outputOptions) delimiter() rune {
+	if opts.comma == 0 {
+		return ','
+	}
+	return opts.comma
+}
+
+// Format the header row naming the columns of formatResult for the summarize config (or summarizer if not nil)
+// Only CSV has a header, so other formats return nil
+func formatHeader(cfg SummarizeConfig, summarizer Summarizer, format RqOutputFormat, opts outputOptions) []byte {
+	if format != FormatCSV {
+		return nil
+	}
+	line := []string{"url", "width", "height"}
+	if opts.size {
+		line = append(line, "size")
+	}
+	if opts.imageFormat {
+		line = append(line, "format")
+	}
+	if summarizer != nil {
+		for _, column := range summarizer.Columns() {
+			line = append(line, column)
+		}
+		if opts.timings {
+			line = append(line, timingColumns...)
+		}
+		return csvLine(line, opts.delimiter())
+	}
+	for i := 1; i <= cfg.K; i++ {
+		line = append(line, "color"+strconv.Itoa(i))
+	}
+	if opts.hsl {
+		for i := 1; i <= cfg.K; i++ {
+			line = append(line, "hsl"+strconv.Itoa(i))
+		}
+	}
+	if cfg.Average {
+		line = append(line, "average")
+	}
+	if cfg.AllFrames {
+		line = append(line, "frames")
+	}
+	if cfg.Orientation {
+		line = append(line, "orientation")
+	}
+	if opts.timings {
+		line = append(line, timingColumns...)
+	}
+	return csvLine(line, opts.delimiter())
+}
+
+// CSV columns of the stage timings, which come last
+var timingColumns = []string{"download_ms", "summarize_ms"}
+
+// Format a duration as milliseconds with one decimal place (e.g. 12.5)
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+}
+
+// JSON representation of an image's stage timings
+type jsonTimings struct {
+	DownloadMs  float64 `json:"download_ms"`
+	SummarizeMs float64 `json:"summarize_ms"`
+}
+
+func newJSONTimings(timings *Timings) *jsonTimings {
+	if timings == nil {
+		return nil
+	}
+	return &jsonTimings{
+		DownloadMs:  float64(timings.Download) / float64(time.Millisecond),
+		SummarizeMs: float64(timings.Summarize) / float64(time.Millisecond),
+	}
+}
+
+// Format the header row naming the columns of formatCheck (CSV output only)
+func formatCheckHeader(format RqOutputFormat, opts outputOptions) []byte {
+	if format != FormatCSV {
+		return nil
+	}
+	return csvLine([]string{"url", "content_type", "size"}, opts.delimiter())
+}
+
+// JSON representation of a summarized image
+type jsonResult struct {
+	URL         string       `json:"url"`
+	Width       int          `json:"width"`
+	Height      int          `json:"height"`
+	Size        *int         `json:"size,omitempty"`
+	Format      string       `json:"format,omitempty"`
+	Colors      []string     `json:"colors"`
+	HSL         []string     `json:"hsl,omitempty"`
+	Fractions   []float64    `json:"fractions,omitempty"`
+	Average     string       `json:"average,omitempty"`
+	Frames      int          `json:"frames,omitempty"`
+	Orientation int          `json:"orientation,omitempty"`
+	Timings     *jsonTimings `json:"timings,omitempty"`
+}
+
+// JSON representation of an image summarized by a Summarizer
+type jsonSummary struct {
+	URL     string       `json:"url"`
+	Width   int          `json:"width"`
+	Height  int          `json:"height"`
+	Size    *int         `json:"size,omitempty"`
+	Format  string       `json:"format,omitempty"`
+	Summary Summary      `json:"summary"`
+	Timings *jsonTimings `json:"timings,omitempty"`
+}
+
+// Format a summarized image as a single line of output (including the trailing newline)
+func formatResult(img RqImage, format RqOutputFormat, opts outputOptions) ([]byte, error) {
+	if img.result != nil {
+		return formatSummary(img, format, opts)
+	}
+	switch format {
+	case FormatCSV:
+		line := []string{
+			img.URL,
+			strconv.Itoa(img.width),
+			strconv.Itoa(img.height),
+		}
+		if opts.size {
+			line = append(line, strconv.Itoa(img.size))
+		}
+		if opts.imageFormat {
+			line = append(line, img.format)
+		}
+		for i, c := range img.GetHexSummary(opts.hex) {
+			if i < len(img.summary.Fractions) {
+				// e.g. #ff0000:0.62
+				c += ":" + formatFraction(img.summary.Fractions[i])
+			}
+			line = append(line, c)
+		}
+		// keep the columns after the colors in line with the header
+		dropped := make([]string, img.summary.Dropped)
+		line = append(line, dropped...)
+		if opts.hsl {
+			line = append(line, img.GetHSLSummary()...)
+			line = append(line, dropped...)
+		}
+		if opts.average {
+			// left empty when no pixels were counted, keeping the column in line with the header
+			line = append(line, img.GetHexAverage(opts.hex))
+		}
+		if img.summary.Frames > 0 {
+			line = append(line, strconv.Itoa(img.summary.Frames))
+		}
+		if img.summary.HasOrientation {
+			// left empty when the image has no orientation
+			orientation := ""
+			if img.summary.Orientation != 0 {
+				orientation = strconv.Itoa(img.summary.Orientation)
+			}
+			line = append(line, orientation)
+		}
+		if img.timings != nil {
+			line = append(line, formatMillis(img.timings.Download), formatMillis(img.timings.Summarize))
+		}
+		return csvLine(line, opts.delimiter()), nil
+	case FormatJSONL:
+		result := jsonResult{
+			URL:         img.URL,
+			Width:       img.width,
+			Height:      img.height,
+			Colors:      img.GetHexSummary(opts.hex),
+			Fractions:   img.summary.Fractions,
+			Average:     img.GetHexAverage(opts.hex),
+			Frames:      img.summary.Frames,
+			Orientation: img.summary.Orientation,
+			Timings:     newJSONTimings(img.timings),
+		}
+		if opts.hsl {
+			result.HSL = img.GetHSLSummary()
+		}
+		if opts.size {
+			result.Size = &img.size
+		}
+		if opts.imageFormat {
+			result.Format = img.format
+		}
+		b, err := json.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	default:
+		return nil, errors.New("Unknown output format")
+	}
+}
+
+// Format an image summarized by a Summarizer as a single line of output
+func formatSummary(img RqImage, format RqOutputFormat, opts outputOptions) ([]byte, error) {
+	switch format {
+	case FormatCSV:
+		line := []string{
+			img.URL,
+			strconv.Itoa(img.width),
+			strconv.Itoa(img.height),
+		}
+		if opts.size {
+			line = append(line, strconv.Itoa(img.size))
+		}
+		if opts.imageFormat {
+			line = append(line, img.format)
+		}
+		for _, field := range img.result.Fields() {
+			line = append(line, field)
+		}
+		if img.timings != nil {
+			line = append(line, formatMillis(img.timings.Download), formatMillis(img.timings.Summarize))
+		}
+		return csvLine(line, opts.delimiter()), nil
+	case FormatJSONL:
+		result := jsonSummary{
+			URL:     img.URL,
+			Width:   img.width,
+			Height:  img.height,
+			Summary: img.result,
+			Timings: newJSONTimings(img.timings),
+		}
+		if opts.size {
+			result.Size = &img.size
+		}
+		if opts.imageFormat {
+			result.Format = img.format
+		}
+		b, err := json.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	default:
+		return nil, errors.New("Unknown output format")
+	}
+}
+
+// JSON representation of a checked (dry run) image
+type jsonCheck struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+// Format an image checked during a dry run as a single line of output; size is -1 if unknown
+func formatCheck(img RqImage, format RqOutputFormat, opts outputOptions) ([]byte, error) {
+	switch format {
+	case FormatCSV:
+		line := []string{
+			img.URL,
+			img.contentType,
+			strconv.Itoa(img.size),
+		}
+		return csvLine(line, opts.delimiter()), nil
+	case FormatJSONL:
+		b, err := json.Marshal(jsonCheck{
+			URL:         img.URL,
+			ContentType: img.contentType,
+			Size:        img.size,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	default:
+		return nil, errors.New("Unknown output format")
+	}
+}
@@ -0,0 +1,401 @@
+package rquent
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"image/color"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testResultImage = RqImage{
+	URL:     testImageURL200,
+	width:   10,
+	height:  20,
+	summary: ColorSummary{Colors: []color.NRGBA{red, green, blue}},
+}
+
+func TestFormatResultCSV(t *testing.T) {
+	line, err := formatResult(testResultImage, FormatCSV, outputOptions{})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	expected := testImageURL200 + ",10,20,#ff0000,#00ff00,#0000ff\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+}
+
+func TestFormatResultCSVEscaping(t *testing.T) {
+	// Test a signed url with commas, quotes and a newline reads back as a single field
+	img := testResultImage
+	img.URL = "http://a.com/x.jpg?sig=a,b&q=\"c\"\nd"
+	line, err := formatResult(img, FormatCSV, outputOptions{})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	record, err := csv.NewReader(bytes.NewReader(line)).Read()
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if len(record) != 6 || record[0] != img.URL {
+		t.Errorf("Expected (%q and 5 more fields) Got (%q)", img.URL, record)
+	}
+}
+
+func TestFormatResultJSONL(t *testing.T) {
+	line, err := formatResult(testResultImage, FormatJSONL, outputOptions{})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if line[len(line)-1] != '\n' {
+		t.Errorf("Expected (line to end in newline) Got (%q)", line)
+	}
+
+	var result jsonResult
+	if err := json.Unmarshal(line, &result); err != nil {
+		t.Fatalf("Expected (valid json) Got (%v)", err)
+	}
+	if result.URL != testImageURL200 {
+		t.Errorf("Expected (%v) Got (%v)", testImageURL200, result.URL)
+	}
+	if len(result.Colors) != 3 || result.Colors[0] != "#ff0000" {
+		t.Errorf("Expected (3 colors starting with #ff0000) Got (%v)", result.Colors)
+	}
+}
+
+func TestFormatResultAverage(t *testing.T) {
+	img := testResultImage
+	img.summary.Average = color.NRGBA{0x10, 0x20, 0x30, 255}
+	img.summary.HasAverage = true
+
+	line, err := formatResult(img, FormatCSV, outputOptions{average: true})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	expected := testImageURL200 + ",10,20,#ff0000,#00ff00,#0000ff,#102030\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	// an image without an average (no pixels counted) still has the column
+	img.summary.HasAverage = false
+	line, _ = formatResult(img, FormatCSV, outputOptions{average: true})
+	expected = testImageURL200 + ",10,20,#ff0000,#00ff00,#0000ff,\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+	img.summary.HasAverage = true
+
+	line, _ = formatResult(img, FormatJSONL, outputOptions{})
+	var result jsonResult
+	json.Unmarshal(line, &result)
+	if result.Average != "#102030" {
+		t.Errorf("Expected (#102030) Got (%v)", result.Average)
+	}
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	if format, err := ParseOutputFormat("jsonl"); err != nil || format != FormatJSONL {
+		t.Errorf("Expected (%v, nil) Got (%v, %v)", FormatJSONL, format, err)
+	}
+	if _, err := ParseOutputFormat("xml"); err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+	if format, _ := ParseOutputFormat(FormatJSONL.String()); format != FormatJSONL {
+		t.Errorf("Expected (%v) Got (%v)", FormatJSONL, format)
+	}
+}
+
+func TestFormatHeader(t *testing.T) {
+	cfg := SummarizeConfig{K: 2, Average: true}
+	expected := "url,width,height,color1,color2,average\n"
+	if header := string(formatHeader(cfg, nil, FormatCSV, outputOptions{})); header != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, header)
+	}
+	if header := formatHeader(cfg, nil, FormatJSONL, outputOptions{}); header != nil {
+		t.Errorf("Expected (nil) Got (%q)", header)
+	}
+}
+
+func TestFormatCheck(t *testing.T) {
+	img := NewRqImage(testImageURL200)
+	img.contentType = "image/jpeg"
+	img.size = 1234
+
+	line, err := formatCheck(img, FormatCSV, outputOptions{})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	expected := testImageURL200 + ",image/jpeg,1234\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	line, err = formatCheck(img, FormatJSONL, outputOptions{})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	var result jsonCheck
+	if err := json.Unmarshal(line, &result); err != nil {
+		t.Fatalf("Expected (valid json) Got (%v)", err)
+	}
+	if result.ContentType != "image/jpeg" || result.Size != 1234 {
+		t.Errorf("Expected (image/jpeg 1234) Got (%v %v)", result.ContentType, result.Size)
+	}
+}
+
+func TestFormatResultFrames(t *testing.T) {
+	img := testResultImage
+	img.summary.Frames = 12
+
+	line, err := formatResult(img, FormatCSV, outputOptions{})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	expected := testImageURL200 + ",10,20,#ff0000,#00ff00,#0000ff,12\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+	if header := string(formatHeader(SummarizeConfig{K: 1, AllFrames: true}, nil, FormatCSV, outputOptions{})); header != "url,width,height,color1,frames\n" {
+		t.Errorf("Expected (url,width,height,color1,frames) Got (%v)", header)
+	}
+}
+
+func TestHexFormat(t *testing.T) {
+	c := color.NRGBA{0xab, 0xcd, 0xef, 0x80}
+	tests := []struct {
+		format   HexFormat
+		expected string
+	}{
+		{HexFormat{}, "#abcdef"},
+		{HexFormat{Uppercase: true}, "#ABCDEF"},
+		{HexFormat{Alpha: true}, "#abcdef80"},
+		{HexFormat{Uppercase: true, Alpha: true}, "#ABCDEF80"},
+	}
+	for _, test := range tests {
+		if got := test.format.Format(c); got != test.expected {
+			t.Errorf("Expected (%v) Got (%v)", test.expected, got)
+		}
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	for _, test := range []struct {
+		in       string
+		expected color.NRGBA
+	}{
+		{"#abcdef", color.NRGBA{0xab, 0xcd, 0xef, 0xff}},
+		{"ABCDEF80", color.NRGBA{0xab, 0xcd, 0xef, 0x80}},
+	} {
+		if c, err := ParseHexColor(test.in); err != nil || c != test.expected {
+			t.Errorf("Expected (%v) Got (%v, %v)", test.expected, c, err)
+		}
+	}
+	for _, in := range []string{"", "#fff", "#gggggg"} {
+		if _, err := ParseHexColor(in); err == nil || !strings.Contains(err.Error(), strconv.Quote(in)) {
+			t.Errorf("Expected (error quoting %q) Got (%v)", in, err)
+		}
+	}
+}
+
+func TestFormatResultHexFormat(t *testing.T) {
+	img := testResultImage
+	img.summary.Colors = []color.NRGBA{{0xab, 0xcd, 0xef, 255}, PlaceholderColor}
+	img.summary.Average = color.NRGBA{0x10, 0x20, 0x3f, 255}
+	img.summary.HasAverage = true
+
+	line, err := formatResult(img, FormatCSV, outputOptions{hex: HexFormat{Uppercase: true, Alpha: true}, average: true})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	expected := testImageURL200 + ",10,20,#ABCDEFFF,#00000000,#10203FFF\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+}
+
+func TestFormatResultSummarizer(t *testing.T) {
+	img := testResultImage
+	img.result = cornerSummary{"#a,b"}
+
+	line, err := formatResult(img, FormatCSV, outputOptions{})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	expected := testImageURL200 + ",10,20,\"#a,b\"\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	line, _ = formatResult(img, FormatJSONL, outputOptions{})
+	expected = `{"url":"` + testImageURL200 + `","width":10,"height":20,"summary":{"corner":"#a,b"}}` + "\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+}
+
+func TestFormatResultFractions(t *testing.T) {
+	img := testResultImage
+	img.summary.Fractions = []float64{.625, .25, .125}
+
+	line, err := formatResult(img, FormatCSV, outputOptions{})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	expected := testImageURL200 + ",10,20,#ff0000:0.62,#00ff00:0.25,#0000ff:0.12\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	line, _ = formatResult(img, FormatJSONL, outputOptions{})
+	var result jsonResult
+	json.Unmarshal(line, &result)
+	if len(result.Fractions) != 3 || result.Fractions[0] != .625 || result.Colors[0] != "#ff0000" {
+		t.Errorf("Expected (colors and fractions separately) Got (%v and %v)", result.Colors, result.Fractions)
+	}
+}
+
+func TestFormatResultOrientation(t *testing.T) {
+	img := testResultImage
+	img.summary.HasOrientation = true
+
+	line, _ := formatResult(img, FormatCSV, outputOptions{})
+	expected := testImageURL200 + ",10,20,#ff0000,#00ff00,#0000ff,\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	img.summary.Orientation = 6
+	line, _ = formatResult(img, FormatCSV, outputOptions{})
+	expected = testImageURL200 + ",10,20,#ff0000,#00ff00,#0000ff,6\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	if header := string(formatHeader(SummarizeConfig{K: 1, Orientation: true}, nil, FormatCSV, outputOptions{})); header != "url,width,height,color1,orientation\n" {
+		t.Errorf("Expected (url,width,height,color1,orientation) Got (%v)", header)
+	}
+}
+
+func TestFormatResultHSL(t *testing.T) {
+	img := testResultImage
+	img.summary = ColorSummary{Colors: []color.NRGBA{red, blue}}
+	line, err := formatResult(img, FormatCSV, outputOptions{hsl: true})
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	expected := testImageURL200 + `,10,20,#ff0000,#0000ff,"hsl(0,100%,50%)","hsl(240,100%,50%)"` + "\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	line, _ = formatResult(img, FormatJSONL, outputOptions{hsl: true})
+	var result jsonResult
+	if err := json.Unmarshal(line, &result); err != nil || len(result.HSL) != 2 || result.HSL[1] != "hsl(240,100%,50%)" {
+		t.Errorf("Expected (2 hsl colors) Got (%v, %v)", string(line), err)
+	}
+
+	header := string(formatHeader(SummarizeConfig{K: 2}, nil, FormatCSV, outputOptions{hsl: true}))
+	if header != "url,width,height,color1,color2,hsl1,hsl2\n" {
+		t.Errorf("Expected (url,width,height,color1,color2,hsl1,hsl2) Got (%v)", header)
+	}
+}
+
+func TestFormatResultDropped(t *testing.T) {
+	// Test dropped colors leave empty columns so the rest stay under their headers
+	img := testResultImage
+	img.summary = ColorSummary{Colors: []color.NRGBA{red}, Dropped: 2, Average: red, HasAverage: true}
+	line, _ := formatResult(img, FormatCSV, outputOptions{hsl: true, average: true})
+	expected := testImageURL200 + `,10,20,#ff0000,,,"hsl(0,100%,50%)",,,#ff0000` + "\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	line, _ = formatResult(img, FormatJSONL, outputOptions{})
+	var result jsonResult
+	if err := json.Unmarshal(line, &result); err != nil || len(result.Colors) != 1 {
+		t.Errorf("Expected (1 color) Got (%v, %v)", string(line), err)
+	}
+}
+
+func TestFormatResultTimings(t *testing.T) {
+	img := testResultImage
+	img.timings = &Timings{Download: 12500 * time.Microsecond, Summarize: 3 * time.Millisecond}
+	line, _ := formatResult(img, FormatCSV, outputOptions{})
+	expected := testImageURL200 + ",10,20,#ff0000,#00ff00,#0000ff,12.5,3.0\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	line, _ = formatResult(img, FormatJSONL, outputOptions{})
+	var result jsonResult
+	if err := json.Unmarshal(line, &result); err != nil || result.Timings == nil || result.Timings.DownloadMs != 12.5 {
+		t.Errorf("Expected (download_ms 12.5) Got (%v, %v)", string(line), err)
+	}
+
+	header := string(formatHeader(SummarizeConfig{K: 1}, nil, FormatCSV, outputOptions{timings: true}))
+	if header != "url,width,height,color1,download_ms,summarize_ms\n" {
+		t.Errorf("Expected (url,width,height,color1,download_ms,summarize_ms) Got (%v)", header)
+	}
+}
+
+func TestFormatResultSize(t *testing.T) {
+	img := testResultImage
+	img.size = 1234
+	line, _ := formatResult(img, FormatCSV, outputOptions{size: true})
+	expected := testImageURL200 + ",10,20,1234,#ff0000,#00ff00,#0000ff\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	line, _ = formatResult(img, FormatJSONL, outputOptions{size: true})
+	var result jsonResult
+	if err := json.Unmarshal(line, &result); err != nil || result.Size == nil || *result.Size != 1234 {
+		t.Errorf("Expected (size 1234) Got (%v, %v)", string(line), err)
+	}
+
+	img.result = cornerSummary{"#ff0000"}
+	line, _ = formatResult(img, FormatCSV, outputOptions{size: true})
+	if expected := testImageURL200 + ",10,20,1234,#ff0000\n"; string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	header := string(formatHeader(SummarizeConfig{K: 1}, nil, FormatCSV, outputOptions{size: true}))
+	if header != "url,width,height,size,color1\n" {
+		t.Errorf("Expected (url,width,height,size,color1) Got (%v)", header)
+	}
+}
+
+func TestFormatResultImageFormat(t *testing.T) {
+	img := testResultImage
+	img.size = 1234
+	img.format = "png"
+	line, _ := formatResult(img, FormatCSV, outputOptions{size: true, imageFormat: true})
+	expected := testImageURL200 + ",10,20,1234,png,#ff0000,#00ff00,#0000ff\n"
+	if string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	line, _ = formatResult(img, FormatJSONL, outputOptions{imageFormat: true})
+	var result jsonResult
+	if err := json.Unmarshal(line, &result); err != nil || result.Format != "png" {
+		t.Errorf("Expected (format png) Got (%v, %v)", string(line), err)
+	}
+
+	img.result = cornerSummary{"#ff0000"}
+	line, _ = formatResult(img, FormatCSV, outputOptions{imageFormat: true})
+	if expected := testImageURL200 + ",10,20,png,#ff0000\n"; string(line) != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, string(line))
+	}
+
+	header := string(formatHeader(SummarizeConfig{K: 1}, nil, FormatCSV, outputOptions{size: true, imageFormat: true}))
+	if header != "url,width,height,size,format,color1\n" {
+		t.Errorf("Expected (url,width,height,size,format,color1) Got (%v)", header)
+	}
+}
@@ -1,55 +1,151 @@
-package main
+package rquent
 
 import (
-	"bufio"
+	"context"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"image"
 	"io"
 	"io/ioutil"
-	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type PipeConfig struct {
 	Download  int
 	Summarize int
 	Cleanup   int
+	// Capacity of the channel into each stage; 0 (the default) is unbuffered, so a stage blocks until a
+	// worker of the next one is free. Buffering lets stages run ahead during bursts of slow downloads
+	DownloadBuffer  int
+	SummarizeBuffer int
+	CleanupBuffer   int
+	SaveBuffer      int
 }
 
 type RqPipeline struct {
-	pool         *RqPool
-	sourceURLs   io.Reader
-	outFile      io.Writer
-	mux          sync.Mutex
-	imageCount   uint64
-	readURLsDone bool
+	stats         rqStats // first so the counters are 64-bit aligned for atomic operations
+	pool          *RqPool
+	summarizeCfg  SummarizeConfig
+	summarizer    Summarizer // replaces counting prevalent colors if set
+	decoders      []decoder  // copied to summarizeCfg by Init
+	metrics       Metrics
+	sourceURLs    io.Reader
+	sourceCSV     *csvSource
+	sourceDir     *dirSource
+	limit         int // entries read from the source before it stops; 0 reads it all
+	maxLineLength int // longest line of a list source in bytes; 0 for DefaultMaxLineLength
+	outFile       io.Writer
+	resultChn     chan<- RqImage // receives results instead of outFile if set
+	closedResults chan<- RqImage // closed at the end of the last run, so can't be used again
+	webhook       *webhook       // each result is also posted here, if set
+	output        *flushWriter   // buffers writes to outFile; set by Init
+	rotateDir     string
+	rotateLines   int
+	rotating      *rotatingWriter // set by Init when output is split across files
+	flushInterval time.Duration
+	syncOutput    bool
+	outFormat     RqOutputFormat
+	outHeader     bool
+	wroteHeader   bool          // to output, so later runs don't repeat it
+	outputOpts    outputOptions // hex format, extra columns and delimiter of the results
+	cacheDir      string
+	swatchDir     string // a PNG swatch of each image's colors is written here, if set
+	dedupContent  bool
+	resumeFrom    io.Reader       // output of a previous run to resume
+	doneURLs      map[string]bool // urls with results in resumeFrom; read only once the run starts
+	orderSize     int
+	ordered       *orderedWriter // set when output is written in source order
+	errOut        io.Writer
+	logger        Logger
+	retryPolicy   RetryPolicy
+	retryDelay    time.Duration // before a failed job is requeued
+	maxRetryDelay time.Duration // cap on the delay doubling with each failure; 0 keeps it constant
+	retryBudget   int           // retries allowed across all jobs of a run; 0 doesn't limit them
+	errMux        sync.Mutex
+	deadline      time.Duration
+	cancel        context.CancelFunc
+	runErr        error // first fatal error of the run, guarded by mux
+	mux           sync.Mutex
+	imageCount    uint64
+	lastProgress  int64 // unix nanoseconds of the last imageCount change, for the watchdog
+	watchdog      *watchdog
+	inFlight      map[string]int // urls of jobs in the pipeline, guarded by mux
+	readURLsDone  bool
+	completeOnce  sync.Once // logs completion once, whichever of the reader and the jobs sees it
+	budgetOnce    sync.Once // logs reaching the download budget once
+	retryOnce     sync.Once // logs using up the retry budget once
+	nextIndex     uint64    // position of the next job read from the source
 }
 
 type RqPool struct {
-	nDownload    int
-	nSummarize   int
-	nCleanup     int
-	wg           sync.WaitGroup
-	downloadChn  chan RqJob
-	summarizeChn chan RqJob
-	saveChn      chan RqJob
-	cleanupChn   chan RqJob
-	errorChn     chan RqError
-	doneChn      chan int
-	client       *http.Client
-	stopOnce     sync.Once
+	nDownload           int
+	nSummarize          int
+	nCleanup            int
+	cfg                 PipeConfig
+	wg                  sync.WaitGroup
+	downloadChn         chan RqJob
+	summarizeChn        chan RqJob
+	saveChn             chan RqJob
+	cleanupChn          chan RqJob
+	errorChn            chan RqError
+	doneChn             chan struct{} // closed to stop the workers
+	client              *http.Client
+	proxy               *url.URL
+	skipVerify          bool
+	rootCAs             *x509.CertPool
+	timeout             *time.Duration // replaces the client's timeout if set
+	jar                 http.CookieJar // replaces the client's cookie jar if set
+	downloadCfg         DownloadConfig
+	header              http.Header
+	creds               map[string]Credential // by host
+	fetchers            map[string]Fetcher    // by url scheme
+	maxPerHost          int
+	maxIdleConnsPerHost int           // replaces the transport's own if set
+	maxConnsPerHost     int           // replaces the transport's own if set
+	robots              bool          // follow each host's robots.txt
+	startJitter         time.Duration // max random delay before each download worker starts
+	keepDir             string        // downloaded images are moved here instead of deleted, if set
+	downloader          *downloader
+	ctx                 context.Context
+	inMemory            bool
+	dryRun              bool
+	stopOnce            sync.Once
 }
 
 type RqJob struct {
 	image    RqImage
+	index    uint64 // position in the source, for ordered output
 	retryChn chan RqJob
 	nextChn  chan RqJob
 	nFails   int
 	doneFlag bool
+	// when the last attempt at each stage started and ended, for timings
+	downloadStart, downloadEnd   time.Time
+	summarizeStart, summarizeEnd time.Time
+}
+
+// Time an image spent in the download and summarize stages, from the start to the end of the attempt
+// that succeeded; time waiting in between stages isn't counted
+type Timings struct {
+	Download  time.Duration
+	Summarize time.Duration // 0 in a dry run
+}
+
+func (job RqJob) timings() Timings {
+	return Timings{
+		Download:  job.downloadEnd.Sub(job.downloadStart),
+		Summarize: job.summarizeEnd.Sub(job.summarizeStart),
+	}
 }
 
 type RqQueue struct {
@@ -58,9 +154,11 @@ type RqQueue struct {
 }
 
 type RqError struct {
-	job       RqJob
-	errorType RqErrorType
-	errorMsg  string
+	job        RqJob
+	errorType  RqErrorType
+	errorMsg   string
+	statusCode int    // status code of the response to a failed download; 0 if there wasn't one
+	finalURL   string // url a failed download ended up at after any redirects, if there was a response
 }
 
 type RqErrorType float64
@@ -73,8 +171,85 @@ const (
 	RqErrorNoRetry
 )
 
+// Name of the error type, as used in logs and metrics
+func (errorType RqErrorType) String() string {
+	switch errorType {
+	case RqErrorDownload:
+		return "download"
+	case RqErrorSummarize:
+		return "summarize"
+	case RqErrorSave:
+		return "save"
+	case RqErrorCleanup:
+		return "cleanup"
+	case RqErrorNoRetry:
+		return "no_retry"
+	default:
+		return "unknown"
+	}
+}
+
 const RqJobMaxFails = 3
 
+// Decides whether a failed job should be retried; jobs are never retried more than RqJobMaxFails
+// times or after an RqErrorNoRetry, whatever the policy says
+type RetryPolicy func(RqError) bool
+
+// Retry everything but summarize errors, which come from decoding bytes that won't change
+func DefaultRetryPolicy(rqError RqError) bool {
+	return rqError.errorType != RqErrorSummarize
+}
+
+// Retry every error type up to RqJobMaxFails times
+func RetryAll(rqError RqError) bool {
+	return true
+}
+
+func (rqError RqError) Type() RqErrorType {
+	return rqError.errorType
+}
+
+func (rqError RqError) Message() string {
+	return rqError.errorMsg
+}
+
+// Status code of the response to a failed download; 0 if there wasn't one
+func (rqError RqError) StatusCode() int {
+	return rqError.statusCode
+}
+
+// Number of times the job has failed, including this error
+func (rqError RqError) Fails() int {
+	return rqError.job.nFails
+}
+
+// Send a job to a channel, giving up if the context is cancelled
+func sendJob(ctx context.Context, chn chan<- RqJob, job RqJob) bool {
+	select {
+	case chn <- job:
+		return true
+	case <-ctx.Done():
+		// the job won't be processed, so delete possible remaining image
+		if job.image.filePath != "" {
+			os.Remove(job.image.filePath)
+		}
+		return false
+	}
+}
+
+// Send an error to a channel, giving up if the context is cancelled
+func sendError(ctx context.Context, chn chan<- RqError, rqError RqError) bool {
+	select {
+	case chn <- rqError:
+		return true
+	case <-ctx.Done():
+		if rqError.job.image.filePath != "" {
+			os.Remove(rqError.job.image.filePath)
+		}
+		return false
+	}
+}
+
 func NewRqError(job RqJob, errorType RqErrorType, message string) RqError {
 	job.nFails += 1
 	return RqError{
@@ -84,101 +259,781 @@ func NewRqError(job RqJob, errorType RqErrorType, message string) RqError {
 	}
 }
 
+// Channel capacity for a configured buffer size; negative sizes are rejected by Init
+func bufferSize(size int) int {
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// Create an error for a failed download, keeping the status code and final url if it got a response
+func newDownloadRqError(job RqJob, errorType RqErrorType, err error) RqError {
+	rqError := NewRqError(job, errorType, err.Error())
+	var downloadErr *DownloadError
+	if errors.As(err, &downloadErr) {
+		rqError.statusCode = downloadErr.StatusCode
+		rqError.finalURL = downloadErr.URL
+	}
+	return rqError
+}
+
 // Create a new pipeline
 func NewPipeline(cfg PipeConfig) *RqPipeline {
 	pool := RqPool{
-		nDownload:    cfg.Download,
-		nSummarize:   cfg.Summarize,
-		nCleanup:     cfg.Cleanup,
-		wg:           sync.WaitGroup{},
-		downloadChn:  make(chan RqJob),
-		summarizeChn: make(chan RqJob),
-		cleanupChn:   make(chan RqJob),
-		saveChn:      make(chan RqJob),
-		errorChn:     make(chan RqError, 1000),
-		doneChn:      make(chan int),
-		client:       newClient(defaultTimeout),
-		stopOnce:     sync.Once{},
+		nDownload:   cfg.Download,
+		nSummarize:  cfg.Summarize,
+		nCleanup:    cfg.Cleanup,
+		cfg:         cfg,
+		wg:          sync.WaitGroup{},
+		client:      newClient(DefaultTimeout),
+		downloadCfg: DefaultDownloadConfig,
+		ctx:         context.Background(),
 	}
+	pool.makeChns()
 
 	return &RqPipeline{
-		pool:       &pool,
-		sourceURLs: nil,
-		outFile:    nil,
-		imageCount: 0,
+		pool:          &pool,
+		summarizeCfg:  SummarizeConfig{K: DefaultK},
+		sourceURLs:    nil,
+		outFile:       nil,
+		flushInterval: DefaultFlushInterval,
+		outputOpts:    outputOptions{comma: ','},
+		imageCount:    0,
+		inFlight:      make(map[string]int),
+		logger:        nopLogger{},
+		retryPolicy:   DefaultRetryPolicy,
 	}
 }
 
+// Read URLs from imageURLs, one per line; compressed lists must be wrapped by the caller, e.g. with
+// gzip.NewReader
 func (pipe *RqPipeline) WithSource(imageURLs io.Reader) *RqPipeline {
 	pipe.sourceURLs = imageURLs
 	return pipe
 }
 
+// Stop reading the source after its first n entries (urls, CSV rows or files), e.g. to try settings on
+// the start of a long list; skipped, invalid and already done entries count toward n, blank lines and
+// comments don't. Later entries aren't read at all. 0 (the default) reads the whole source
+func (pipe *RqPipeline) WithLimit(n int) *RqPipeline {
+	pipe.limit = n
+	return pipe
+}
+
+// Allow lines of up to n bytes in a list of urls instead of DefaultMaxLineLength, e.g. for huge data
+// URIs. Reading stops at a longer line and the run fails with the error once the urls before it are done
+func (pipe *RqPipeline) WithMaxLineLength(n int) *RqPipeline {
+	pipe.maxLineLength = n
+	return pipe
+}
+
+// Read URLs from the given (0-based) column of a CSV, optionally skipping the first row as a header
+func (pipe *RqPipeline) WithCSVSource(imageURLs io.Reader, column int, skipHeader bool) *RqPipeline {
+	pipe.sourceURLs = imageURLs
+	pipe.sourceCSV = &csvSource{column: column, skipHeader: skipHeader}
+	return pipe
+}
+
+// Summarize the images under a directory whose file names match pattern (see filepath.Match), or
+// every file if pattern is ""; replaces any other source
+// The images are read in place and never deleted, and results list their paths relative to root
+func (pipe *RqPipeline) WithDirectory(root string, pattern string) *RqPipeline {
+	pipe.sourceURLs = nil
+	pipe.sourceCSV = nil
+	pipe.sourceDir = &dirSource{root: root, pattern: pattern}
+	return pipe
+}
+
 func (pipe *RqPipeline) WithClient(client *http.Client) *RqPipeline {
 	pipe.pool.client = client
 	return pipe
 }
 
+// Give up on a download that takes longer than timeout in total (DefaultTimeout by default); 0 for no limit
+// This applies to a client set with WithClient without modifying it, and DownloadConfig sets the timeouts
+// of connecting and waiting for a response
+func (pipe *RqPipeline) WithTimeout(timeout time.Duration) *RqPipeline {
+	pipe.pool.timeout = &timeout
+	return pipe
+}
+
+// Don't verify the certificates of https servers, e.g. internal servers with self-signed certificates
+// This makes downloads open to anyone between rquent and the server pretending to be it, who can then
+// serve any image they like; prefer WithRootCAs with the server's certificate where possible
+// Like WithProxy, this applies to a client set with WithClient without modifying it
+func (pipe *RqPipeline) WithInsecureSkipVerify(skip bool) *RqPipeline {
+	pipe.pool.skipVerify = skip
+	return pipe
+}
+
+// Verify the certificates of https servers with roots instead of the system's certificate authorities
+// Like WithProxy, this applies to a client set with WithClient without modifying it
+func (pipe *RqPipeline) WithRootCAs(roots *x509.CertPool) *RqPipeline {
+	pipe.pool.rootCAs = roots
+	return pipe
+}
+
+// Send downloads through proxy; this applies to a client set with WithClient without modifying it
+func (pipe *RqPipeline) WithProxy(proxy *url.URL) *RqPipeline {
+	pipe.pool.proxy = proxy
+	return pipe
+}
+
+// Decode images straight from the response instead of saving them to temp files
+// This skips the cleanup stage but holds every in-flight image in memory
+func (pipe *RqPipeline) WithInMemory(inMemory bool) *RqPipeline {
+	pipe.pool.inMemory = inMemory
+	return pipe
+}
+
+// Move each downloaded image into dir instead of deleting it in the cleanup stage, e.g. to build a
+// local mirror. Names come from the url's file name plus a hash of the url, so they never collide
+// and a re-run replaces its own images. Can't be used in memory or in a dry run, which save nothing
+func (pipe *RqPipeline) WithKeepImages(dir string) *RqPipeline {
+	pipe.pool.keepDir = dir
+	return pipe
+}
+
+// Only check that urls are reachable images (with HEAD requests) instead of downloading and summarizing them
+// Each reachable image's content type and size is written to the output; the rest fail as usual
+func (pipe *RqPipeline) WithDryRun(dryRun bool) *RqPipeline {
+	pipe.pool.dryRun = dryRun
+	return pipe
+}
+
+// Allow at most n simultaneous downloads from any one host, so a source skewed toward a few domains
+// doesn't hammer them; downloads from other hosts aren't held up. 0 (the default) doesn't limit
+func (pipe *RqPipeline) WithMaxConcurrentHosts(n int) *RqPipeline {
+	pipe.pool.maxPerHost = n
+	return pipe
+}
+
+// Skip urls that their host's robots.txt disallows for the User-Agent from WithHeaders (or for all
+// agents), and space requests to each host by its Crawl-delay, for polite crawling of public sites.
+// Each host's robots.txt is fetched on its first download, like a download itself (same redirect
+// limit and RequestsPerSecond), and kept for the rest of the pipeline's runs; a host without one (a 4xx) allows everything. Skipped urls fail without retrying. While a
+// host's robots.txt is unreachable or answers with a 5xx its urls fail as download errors, and it's
+// fetched again for the next one. The delay is on top of WithMaxConcurrentHosts, which still caps how
+// many downloads from a host can wait on it at once
+func (pipe *RqPipeline) WithRobotsTxt(respect bool) *RqPipeline {
+	pipe.pool.robots = respect
+	return pipe
+}
+
+// Keep up to n idle connections to each host for reuse instead of the transport's default of 2, so
+// download workers hitting one host don't keep opening new connections (and looking it up again).
+// Set it to at least the number of download workers, or WithMaxConcurrentHosts if that's lower
+func (pipe *RqPipeline) WithMaxIdleConnsPerHost(n int) *RqPipeline {
+	pipe.pool.maxIdleConnsPerHost = n
+	return pipe
+}
+
+// Open at most n connections to each host at once, including idle ones; further requests wait for one
+// to free up. It can't be lower than WithMaxConcurrentHosts, whose downloads would then hold a slot
+// while waiting for a connection
+func (pipe *RqPipeline) WithMaxConnsPerHost(n int) *RqPipeline {
+	pipe.pool.maxConnsPerHost = n
+	return pipe
+}
+
+// Delay each download worker's first request by a random interval up to max, so they don't all hit
+// the same host at once when the run starts. 0 (the default) starts them together
+func (pipe *RqPipeline) WithStartupJitter(max time.Duration) *RqPipeline {
+	pipe.pool.startJitter = max
+	return pipe
+}
+
+// Add headers (e.g. User-Agent or Authorization) to every download request, including retries
+func (pipe *RqPipeline) WithHeaders(header http.Header) *RqPipeline {
+	pipe.pool.header = header
+	return pipe
+}
+
+// Authenticate downloads from each host in creds with its credential (see ReadCredentials), replacing
+// any Authorization header from WithHeaders; other hosts get no credentials
+// A credential is only sent to the host of the requested url, not to hosts it redirects to
+func (pipe *RqPipeline) WithCredentials(creds map[string]Credential) *RqPipeline {
+	pipe.pool.creds = creds
+	return pipe
+}
+
+// Read urls with the schemes of fetchers (e.g. "s3" for s3://bucket/key) with their Fetcher instead
+// of downloading them over http, e.g. from object storage. The rest of the pipeline treats them like
+// downloads: they're rate limited, capped per host (the bucket) and saved to a temp file or decoded in memory
+func (pipe *RqPipeline) WithFetchers(fetchers map[string]Fetcher) *RqPipeline {
+	pipe.pool.fetchers = fetchers
+	return pipe
+}
+
+// Keep cookies in jar (e.g. from net/http/cookiejar) and send them with downloads, for images that need
+// a session cookie; like WithProxy, this applies to a client set with WithClient without modifying it
+// Login fills the jar from a login endpoint before the run
+func (pipe *RqPipeline) WithCookieJar(jar http.CookieJar) *RqPipeline {
+	pipe.pool.jar = jar
+	return pipe
+}
+
+func (pipe *RqPipeline) WithDownloadConfig(cfg DownloadConfig) *RqPipeline {
+	pipe.pool.downloadCfg = cfg
+	return pipe
+}
+
 func (pipe *RqPipeline) WithOutput(out io.Writer) *RqPipeline {
 	pipe.outFile = out
 	return pipe
 }
 
+// Post each result as it finishes to webhookURL as a line of JSON (as in FormatJSONL, whatever the
+// output format), in addition to any output; nil uses a client with DefaultTimeout. Failed posts are
+// retried with backoff when the webhook is unreachable or responds with a 5xx or 429, and a result that
+// still can't be delivered is logged and written to the error output. Posts are sent in the background,
+// so a slow webhook only holds up the pipeline once 100 results are waiting, and a run returns once
+// they've all been sent
+func (pipe *RqPipeline) WithWebhook(webhookURL string, client *http.Client) *RqPipeline {
+	pipe.webhook = newWebhook(webhookURL, client)
+	return pipe
+}
+
+// Write results to every one of outs, each getting the same lines in the same format; every flush
+// flushes the outs with a Flush method too. Use WithResultChannel to write different formats
+func (pipe *RqPipeline) WithOutputs(outs ...io.Writer) *RqPipeline {
+	pipe.outFile = &multiOutput{outs: outs}
+	return pipe
+}
+
+// Write results to files in dir of linesPerFile lines each (results.000.csv, results.001.csv, ...)
+// instead of a single output; with a header, every file starts with it
+func (pipe *RqPipeline) WithRotatingOutput(dir string, linesPerFile int) *RqPipeline {
+	pipe.rotateDir = dir
+	pipe.rotateLines = linesPerFile
+	return pipe
+}
+
+// Keep the summary of each downloaded image in dir along with its ETag and Last-Modified headers, so
+// later runs with the same summarize config ask the server whether it changed and reuse the summary
+// instead of downloading and decoding it again when it hasn't
+func (pipe *RqPipeline) WithCache(dir string) *RqPipeline {
+	pipe.cacheDir = dir
+	return pipe
+}
+
+// Write a PNG swatch of each image's colors into dir as it's saved, a strip of DefaultSwatchSize squares
+// most prevalent first (see ColorSummary.Swatch), named after its url like WithKeepImages names images
+func (pipe *RqPipeline) WithSwatches(dir string) *RqPipeline {
+	pipe.swatchDir = dir
+	return pipe
+}
+
+// Hash the content of each downloaded image and reuse the summary of an earlier image with the same
+// content instead of decoding it again, e.g. when several urls point at the same CDN image
+// Duplicates downloaded while the first image is still being summarized are summarized again
+// Summaries are kept in memory for the whole run; images are hashed after they're saved to disk, so
+// this can't be used with in memory or dry run mode
+func (pipe *RqPipeline) WithContentDedup(enabled bool) *RqPipeline {
+	pipe.dedupContent = enabled
+	return pipe
+}
+
+// Send each result to results instead of writing it to an output, which then isn't needed
+// results must be read while the pipeline runs, and it's closed when the run ends; errors are still
+// written to the error output if there is one
+func (pipe *RqPipeline) WithResultChannel(results chan<- RqImage) *RqPipeline {
+	pipe.resultChn = results
+	return pipe
+}
+
+// Flush buffered results to the output every interval (DefaultFlushInterval by default), and when the run ends
+// An interval of 0 writes each result through as soon as it's done
+func (pipe *RqPipeline) WithFlushInterval(interval time.Duration) *RqPipeline {
+	pipe.flushInterval = interval
+	return pipe
+}
+
+// Sync the output to disk whenever results are flushed, if it has a Sync method like *os.File
+// Slower, but the results written so far survive the machine crashing, not just the process
+func (pipe *RqPipeline) WithSyncOutput(sync bool) *RqPipeline {
+	pipe.syncOutput = sync
+	return pipe
+}
+
+// Decide which failed jobs are retried; by default that's DefaultRetryPolicy
+func (pipe *RqPipeline) WithRetryPolicy(policy RetryPolicy) *RqPipeline {
+	pipe.retryPolicy = policy
+	return pipe
+}
+
+// Allow at most n retries across all the jobs of a run, so a systemic failure (say the DNS going down)
+// fails the remaining jobs quickly instead of retrying every one of them up to RqJobMaxFails times;
+// once it's used up, errors fail their jobs without being retried. Retries of HTTP requests within a
+// single download attempt (DownloadConfig.Retries) aren't counted. 0 (the default) doesn't limit them
+func (pipe *RqPipeline) WithRetryBudget(n int) *RqPipeline {
+	pipe.retryBudget = n
+	return pipe
+}
+
+// Wait before requeuing a failed job instead of retrying it immediately, doubling the delay with each
+// failure of the job up to max (a max of 0 keeps it constant). This is separate from the download
+// config's RetryDelay, which is between HTTP requests of a single download attempt
+func (pipe *RqPipeline) WithRetryDelay(delay time.Duration, max time.Duration) *RqPipeline {
+	pipe.retryDelay = delay
+	pipe.maxRetryDelay = max
+	return pipe
+}
+
+// Resume a previous run by skipping the urls that already have a result in its output, previous.
+// It's read when the run starts, before any results are written, so it can be the same file as the
+// output (see OpenResumeFile); the header isn't written again if it already has lines
+func (pipe *RqPipeline) WithResume(previous io.Reader) *RqPipeline {
+	pipe.resumeFrom = previous
+	return pipe
+}
+
+// Write the url and reason for every failed or unprocessed image to out as CSV lines of url,reason
+func (pipe *RqPipeline) WithErrorOutput(out io.Writer) *RqPipeline {
+	pipe.errOut = out
+	return pipe
+}
+
+// Stop the pipeline if it's still running after d; unfinished urls are written to the error output
+func (pipe *RqPipeline) WithDeadline(d time.Duration) *RqPipeline {
+	pipe.deadline = d
+	return pipe
+}
+
+// Call onStall if no image enters or leaves the pipeline for interval, e.g. because every download
+// worker is stuck on a hanging host; a nil onStall logs a warning instead. It's called once per stall,
+// and again only after progress resumes and stalls once more. The run isn't stopped (see WithDeadline)
+func (pipe *RqPipeline) WithWatchdog(interval time.Duration, onStall func(idle time.Duration)) *RqPipeline {
+	pipe.watchdog = &watchdog{interval: interval, onStall: onStall}
+	return pipe
+}
+
+// Send log messages to logger; by default nothing is logged
+func (pipe *RqPipeline) WithLogger(logger Logger) *RqPipeline {
+	pipe.logger = logger
+	return pipe
+}
+
+func (pipe *RqPipeline) WithFormat(format RqOutputFormat) *RqPipeline {
+	pipe.outFormat = format
+	return pipe
+}
+
+// Separate the fields of CSV results (and the header) with delimiter instead of a comma, e.g. '\t'
+// for TSV; fields containing it are still quoted. A resumed output must use the same delimiter, and
+// the error output is always comma separated
+func (pipe *RqPipeline) WithDelimiter(delimiter rune) *RqPipeline {
+	pipe.outputOpts.comma = delimiter
+	return pipe
+}
+
+// Report measurements to metrics as the pipeline runs (see Metrics)
+func (pipe *RqPipeline) WithMetrics(metrics Metrics) *RqPipeline {
+	pipe.metrics = metrics
+	return pipe
+}
+
+// Write colors in results using format; by default they're lowercase #rrggbb
+func (pipe *RqPipeline) WithHexFormat(format HexFormat) *RqPipeline {
+	pipe.outputOpts.hex = format
+	return pipe
+}
+
+// Also write each prevalent color as a CSS hsl string (e.g. hsl(0,100%,50%)), in CSV columns after the
+// hex colors or a JSONL "hsl" field
+func (pipe *RqPipeline) WithHSL(hsl bool) *RqPipeline {
+	pipe.outputOpts.hsl = hsl
+	return pipe
+}
+
+// Record how long each image spent downloading and summarizing, written as download_ms and
+// summarize_ms CSV columns after the rest or a JSONL "timings" field (not in a dry run), and available
+// from RqImage.Timings with a result channel. Either way they're logged along with each finished image
+func (pipe *RqPipeline) WithTimings(timings bool) *RqPipeline {
+	pipe.outputOpts.timings = timings
+	return pipe
+}
+
+// Write the size in bytes of each image as downloaded (or read from disk) as a size CSV column after
+// the height or a JSONL "size" field, e.g. to flag oversized images; it's available from RqImage.Size
+// with a result channel either way
+func (pipe *RqPipeline) WithSize(size bool) *RqPipeline {
+	pipe.outputOpts.size = size
+	return pipe
+}
+
+// Write the format each image was decoded from (as named by image.Decode, e.g. "jpeg" or "png") as a
+// format CSV column after the height and any size, or a JSONL "format" field, e.g. to audit what a
+// scraped dataset is made of; it's available from RqImage.Format with a result channel either way
+func (pipe *RqPipeline) WithImageFormat(imageFormat bool) *RqPipeline {
+	pipe.outputOpts.imageFormat = imageFormat
+	return pipe
+}
+
+// Write a header row naming the columns before any results (CSV output only)
+func (pipe *RqPipeline) WithHeader(header bool) *RqPipeline {
+	pipe.outHeader = header
+	return pipe
+}
+
+// Write results in the same order as the source, buffering up to size results that finish early
+// If the buffer fills up, the oldest missing result is written out of order whenever it finishes
+// A size of 0 writes results as they finish
+func (pipe *RqPipeline) WithOrderedOutput(size int) *RqPipeline {
+	pipe.orderSize = size
+	return pipe
+}
+
+func (pipe *RqPipeline) WithSummarizeConfig(cfg SummarizeConfig) *RqPipeline {
+	pipe.summarizeCfg = cfg
+	return pipe
+}
+
+// Summarize images with summarizer instead of counting their prevalent colors
+// The summarize config is still used to decode images (see SummarizeConfig.AllFrames and Orientation)
+func (pipe *RqPipeline) WithSummarizer(summarizer Summarizer) *RqPipeline {
+	pipe.summarizer = summarizer
+	return pipe
+}
+
+// Decode images in format with decode when the image package doesn't recognize them, so decoders for
+// formats like WebP or AVIF can be plugged in without registering them globally with image.RegisterFormat
+// Registered decoders are tried in order, and registering a format again replaces its decoder
+// Images in unrecognized formats are read into memory before trying the decoders
+func (pipe *RqPipeline) WithDecoder(format string, decode func(io.Reader) (image.Image, error)) *RqPipeline {
+	for i, d := range pipe.decoders {
+		if d.format == format {
+			pipe.decoders[i].decode = decode
+			return pipe
+		}
+	}
+	pipe.decoders = append(pipe.decoders, decoder{format: format, decode: decode})
+	return pipe
+}
+
 func (pipe *RqPipeline) Init() (*RqPipeline, error) {
 	pool := pipe.pool
 	if pool.nDownload <= 0 || pool.nSummarize <= 0 || pool.nCleanup <= 0 {
 		return pipe, errors.New("Pipeline config values for workers must be greater than 0")
 	}
-	if pipe.sourceURLs == nil {
+	if pool.cfg.DownloadBuffer < 0 || pool.cfg.SummarizeBuffer < 0 || pool.cfg.CleanupBuffer < 0 || pool.cfg.SaveBuffer < 0 {
+		return pipe, errors.New("Pipeline config values for buffers must not be negative")
+	}
+	if pool.downloadCfg.Retries < 0 || pool.downloadCfg.MaxBytes < 0 || pool.downloadCfg.MaxRedirects < 0 ||
+		pool.downloadCfg.RequestsPerSecond < 0 {
+		return pipe, errors.New("Download config values for Retries, MaxBytes, MaxRedirects and RequestsPerSecond must not be negative")
+	}
+	if err := pipe.summarizeCfg.validate(); err != nil {
+		return pipe, err
+	}
+	for _, d := range pipe.decoders {
+		if d.format == "" || d.decode == nil {
+			return pipe, errors.New("Pipeline decoders must have a format and decode function")
+		}
+	}
+	pipe.summarizeCfg.decoders = pipe.decoders
+	pipe.outputOpts.average = pipe.summarizeCfg.Average
+	if pipe.sourceURLs == nil && pipe.sourceDir == nil {
 		return pipe, errors.New("Pipeline has no source set. Use method WithSource to set it.")
 	}
+	if pipe.sourceDir != nil {
+		if _, err := filepath.Match(pipe.sourceDir.pattern, ""); err != nil {
+			return pipe, errors.New("Pipeline directory pattern is invalid: " + err.Error())
+		}
+	}
+	if pipe.limit < 0 {
+		return pipe, errors.New("Pipeline source limit must not be negative")
+	}
+	if pipe.maxLineLength < 0 {
+		return pipe, errors.New("Pipeline max line length must not be negative")
+	}
+	if pipe.sourceCSV != nil && pipe.sourceCSV.column < 0 {
+		return pipe, errors.New("Pipeline CSV source column must not be negative")
+	}
+	if pipe.retryPolicy == nil {
+		return pipe, errors.New("Pipeline retry policy must not be nil")
+	}
+	if pool.maxPerHost < 0 {
+		return pipe, errors.New("Pipeline max concurrent downloads per host must not be negative")
+	}
+	if pool.maxIdleConnsPerHost < 0 || pool.maxConnsPerHost < 0 {
+		return pipe, errors.New("Pipeline connections per host must not be negative")
+	}
+	if pool.maxConnsPerHost > 0 && pool.maxConnsPerHost < pool.maxPerHost {
+		return pipe, errors.New("Pipeline max connections per host must not be lower than max concurrent downloads per host")
+	}
+	if pipe.watchdog != nil && pipe.watchdog.interval <= 0 {
+		return pipe, errors.New("Pipeline watchdog interval must be positive")
+	}
+	if pipe.retryDelay < 0 || pipe.maxRetryDelay < 0 {
+		return pipe, errors.New("Pipeline retry delays must not be negative")
+	}
+	if pipe.retryBudget < 0 {
+		return pipe, errors.New("Pipeline retry budget must not be negative")
+	}
+	if pool.startJitter < 0 {
+		return pipe, errors.New("Pipeline startup jitter must not be negative")
+	}
+	if multi, ok := pipe.outFile.(*multiOutput); ok {
+		if len(multi.outs) == 0 {
+			return pipe, errors.New("Pipeline outputs must not be empty")
+		}
+		for _, out := range multi.outs {
+			if out == nil {
+				return pipe, errors.New("Pipeline outputs must not be nil")
+			}
+		}
+	}
+	if pipe.rotateDir != "" {
+		if pipe.rotateLines <= 0 {
+			return pipe, errors.New("Pipeline lines per output file must be positive")
+		}
+		if pipe.outFile != nil || pipe.resultChn != nil {
+			return pipe, errors.New("Pipeline rotating output can't be used with another output")
+		}
+		if pipe.resumeFrom != nil {
+			return pipe, errors.New("Pipeline rotating output can't be resumed")
+		}
+		ext := "csv"
+		if pipe.outFormat == FormatJSONL {
+			ext = "jsonl"
+		}
+		pipe.rotating = newRotatingWriter(pipe.rotateDir, ext, pipe.rotateLines)
+		pipe.outFile = pipe.rotating
+	}
+	if pipe.resultChn != nil {
+		if pipe.orderSize > 0 {
+			return pipe, errors.New("Pipeline ordered output can't be used with a result channel")
+		}
+		if pipe.outFile == nil {
+			// nothing is written, but the header and failed jobs still go through the output
+			pipe.outFile = ioutil.Discard
+		}
+	}
+	if pipe.webhook != nil {
+		u, err := url.Parse(pipe.webhook.url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return pipe, errors.New("Pipeline webhook must be an http or https url")
+		}
+		if pipe.outFile == nil {
+			// results only go to the webhook
+			pipe.outFile = ioutil.Discard
+		}
+	}
 	if pipe.outFile == nil {
-		return pipe, errors.New("Pipeline has no output file set. Use method WithSource to set it.")
+		return pipe, errors.New("Pipeline has no output file set. Use method WithOutput, WithResultChannel or WithWebhook to set it.")
+	}
+	if pipe.deadline < 0 {
+		return pipe, errors.New("Pipeline deadline must not be negative")
+	}
+	if pipe.outFormat != FormatCSV && pipe.outFormat != FormatJSONL {
+		return pipe, errors.New("Pipeline output format is invalid. Use FormatCSV or FormatJSONL.")
+	}
+	if !validDelimiter(pipe.outputOpts.comma) {
+		return pipe, errors.New("Pipeline delimiter must not be a quote, newline or invalid rune")
+	}
+	if pipe.orderSize < 0 {
+		return pipe, errors.New("Pipeline ordered output size must not be negative")
+	}
+	if pipe.flushInterval < 0 {
+		return pipe, errors.New("Pipeline flush interval must not be negative")
+	}
+	pipe.output = newFlushWriter(pipe.outFile, pipe.flushInterval, pipe.syncOutput)
+	if pipe.orderSize > 0 {
+		pipe.ordered = newOrderedWriter(pipe.output, pipe.orderSize)
 	}
 
-	return pipe, nil
-}
+	if pool.timeout != nil && *pool.timeout < 0 {
+		return pipe, errors.New("Pipeline timeout must not be negative")
+	}
+	if pool.downloadCfg.MaxTotalBytes < 0 {
+		return pipe, errors.New("Download config MaxTotalBytes must not be negative")
+	}
+	if pool.downloadCfg.ConnectTimeout < 0 || pool.downloadCfg.TLSHandshakeTimeout < 0 || pool.downloadCfg.ResponseHeaderTimeout < 0 {
+		return pipe, errors.New("Download config timeouts must not be negative")
+	}
 
-// Read lines of URLs into images and send into the downloadChn; NOT thread safe
-func (pipe *RqPipeline) readURLs() {
-	scanner := bufio.NewScanner(pipe.sourceURLs)
-	for scanner.Scan() {
-		imgURL := strings.TrimSpace(scanner.Text())
-		atomic.AddUint64(&pipe.imageCount, 1)
-		log.Printf("Starting %v", imgURL)
-		pipe.pool.downloadChn <- RqJob{
-			image:    NewRqImage(imgURL),
-			retryChn: nil,
-			nextChn:  nil,
+	if pool.proxy != nil {
+		client, err := withProxy(pool.client, pool.proxy)
+		if err != nil {
+			return pipe, err
 		}
+		pool.client = client
 	}
-	pipe.mux.Lock()
-	defer pipe.mux.Unlock()
-	pipe.readURLsDone = true
+	if pool.skipVerify || pool.rootCAs != nil {
+		client, err := withTLS(pool.client, pool.skipVerify, pool.rootCAs)
+		if err != nil {
+			return pipe, err
+		}
+		pool.client = client
+	}
+	client, err := withTransportTimeouts(pool.client, pool.downloadCfg)
+	if err != nil {
+		return pipe, err
+	}
+	client, err = withConnPool(client, pool.maxIdleConnsPerHost, pool.maxConnsPerHost)
+	if err != nil {
+		return pipe, err
+	}
+	if pool.timeout != nil {
+		timed := *client
+		timed.Timeout = *pool.timeout
+		client = &timed
+	}
+	if pool.jar != nil {
+		withJar := *client
+		withJar.Jar = pool.jar
+		client = &withJar
+	}
+	pool.client = client
+
+	pool.downloader = newDownloader(pool.client, pool.downloadCfg)
+	pool.downloader.header = pool.header
+	creds, err := newCredentialStore(pool.creds)
+	if err != nil {
+		return pipe, err
+	}
+	pool.downloader.creds = creds
+	if err := checkFetchers(pool.fetchers); err != nil {
+		return pipe, err
+	}
+	pool.downloader.fetchers = make(map[string]Fetcher, len(pool.fetchers))
+	for scheme, f := range pool.fetchers {
+		pool.downloader.fetchers[strings.ToLower(scheme)] = f
+	}
+	pool.downloader.logger = pipe.logger
+	pool.downloader.hosts = newHostLimiter(pool.maxPerHost)
+	if pool.robots {
+		pool.downloader.robots = newRobotsPolicy(pool.downloader.client, pool.header)
+		pool.downloader.robots.limiter = pool.downloader.limiter
+		pool.downloader.robots.logger = pipe.logger
+	}
+	pool.downloader.decodeCfg = pipe.summarizeCfg
+	pool.downloader.bytes = &pipe.stats.bytes
+	if pool.keepDir != "" {
+		if pool.inMemory || pool.dryRun {
+			return pipe, errors.New("Pipeline can't keep images in memory or dry run mode, which don't save them")
+		}
+		if err := os.MkdirAll(pool.keepDir, 0755); err != nil {
+			return pipe, errors.New("Failed to create directory for kept images: " + err.Error())
+		}
+	}
+	if pipe.swatchDir != "" {
+		if pipe.summarizer != nil || pool.dryRun {
+			return pipe, errors.New("Pipeline swatches are drawn from color summaries, so can't be made with a Summarizer or dry run")
+		}
+		if err := os.MkdirAll(pipe.swatchDir, 0755); err != nil {
+			return pipe, errors.New("Failed to create directory for swatches: " + err.Error())
+		}
+	}
+	if pipe.cacheDir != "" {
+		if pipe.summarizer != nil || pool.dryRun {
+			return pipe, errors.New("Pipeline cache only holds color summaries, so can't be used with a Summarizer or dry run")
+		}
+		if pipe.summarizeCfg.ColorModel != nil {
+			// the model isn't saved with the summaries, so they'd be reused for a different model
+			return pipe, errors.New("Pipeline cache can't be used with a summarize config ColorModel")
+		}
+		cache, err := newSummaryCache(pipe.cacheDir, pipe.summarizeCfg)
+		if err != nil {
+			return pipe, errors.New("Failed to create cache: " + err.Error())
+		}
+		pool.downloader.cache = cache
+	}
+	if pipe.dedupContent {
+		if pool.inMemory || pool.dryRun {
+			return pipe, errors.New("Pipeline can't deduplicate content in memory or dry run mode, which don't save images")
+		}
+		pool.downloader.contents = newContentCache()
+	}
+	return pipe, nil
 }
 
 // Write results from the saveChn to the output file; NOT thread safe
 func (pipe *RqPipeline) writeResults() {
+	// don't leave results in the buffer if writing stops early
+	defer pipe.output.Flush()
 	for job := range pipe.pool.saveChn {
-		line := []string{job.image.URL}
-		line = append(line, job.image.GetHexSummary()...)
-		_, err := pipe.outFile.Write([]byte(strings.Join(line, ",") + "\n"))
-		if err != nil {
-			pipe.pool.errorChn <- NewRqError(job, RqErrorNoRetry, err.Error())
-			continue
+		timings := job.timings()
+		if pipe.outputOpts.timings {
+			job.image.timings = &timings
+		}
+		if contents := pipe.pool.downloader.contents; contents != nil {
+			// before the result is out, so duplicates downloaded after it always reuse it
+			contents.store(job.image)
 		}
-		atomic.AddUint64(&pipe.imageCount, ^uint64(0))
+		if pipe.resultChn != nil {
+			select {
+			case pipe.resultChn <- job.image:
+			case <-pipe.pool.ctx.Done():
+				// the job is still in flight, so it's recorded as unprocessed
+				return
+			}
+		} else if err := pipe.writeFormatted(job); err != nil {
+			// the output is broken, so every remaining job would fail the same way
+			pipe.logger.Errorf("Failed to write result for %v: %v", job.image.URL, err)
+			pipe.abort(errors.New("Failed to write output: " + err.Error()))
+			return
+		}
+		if pipe.webhook != nil {
+			pipe.postResult(job)
+		}
+		if pipe.swatchDir != "" {
+			pipe.saveSwatch(job)
+		}
+		pipe.cacheResult(job.image)
+		pipe.finishJob(job.image.URL)
+		pipe.addImageCount(^uint64(0))
+		atomic.AddUint64(&pipe.stats.saved, 1)
 
-		log.Printf("Finished %v", job.image.URL)
+		pipe.logger.Debugf("Finished %v (download %v, summarize %v)", job.image.URL, timings.Download, timings.Summarize)
 
-		if pipe.isDone() {
-			log.Println("PIPELINE COMPLETE!")
-			pipe.pool.stopWorkers()
+		if pipe.stopIfDone() {
 			return
 		}
 	}
 }
 
+// Save a new summary to the cache, if there is one and the response can be revalidated
+func (pipe *RqPipeline) cacheResult(img RqImage) {
+	cache := pipe.pool.downloader.cache
+	if cache == nil || img.cached || img.validators.empty() {
+		return
+	}
+	if err := cache.store(img); err != nil {
+		// the image is just downloaded again next time
+		pipe.logger.Errorf("Failed to cache summary of %v: %v", img.URL, err)
+	}
+}
+
+// Format the result of a job and write it to the output
+func (pipe *RqPipeline) writeFormatted(job RqJob) error {
+	var line []byte
+	var err error
+	if pipe.pool.dryRun {
+		line, err = formatCheck(job.image, pipe.outFormat, pipe.outputOpts)
+	} else {
+		line, err = formatResult(job.image, pipe.outFormat, pipe.outputOpts)
+	}
+	if err != nil {
+		return err
+	}
+	return pipe.writeResult(job, line)
+}
+
+// Write the result line of a job, or with ordered output record that it failed if line is nil
+func (pipe *RqPipeline) writeResult(job RqJob, line []byte) error {
+	if pipe.ordered != nil {
+		return pipe.ordered.complete(job.index, line)
+	}
+	if line == nil {
+		return nil
+	}
+	_, err := pipe.output.Write(line)
+	return err
+}
+
 func (pipe *RqPipeline) handleErrors() {
 	defer pipe.pool.wg.Done()
 	for {
@@ -186,7 +1041,10 @@ func (pipe *RqPipeline) handleErrors() {
 		case jobError := <-pipe.pool.errorChn:
 			pipe.handleError(jobError)
 		case <-pipe.pool.doneChn:
-			log.Println("handleErrors exiting")
+			pipe.logger.Debugf("handleErrors exiting")
+			return
+		case <-pipe.pool.ctx.Done():
+			pipe.logger.Debugf("handleErrors cancelled")
 			return
 		}
 	}
@@ -194,58 +1052,291 @@ func (pipe *RqPipeline) handleErrors() {
 
 // Handles job errors by requeuing them or removing them from the pipeline
 func (pipe *RqPipeline) handleError(jobError RqError) {
-	if jobError.errorType == RqErrorNoRetry ||
-		jobError.job.nFails >= RqJobMaxFails ||
-		jobError.job.retryChn == nil {
-		log.Printf("Job Failed: %v\n", jobError.errorMsg)
+	pipe.stats.addError(jobError.errorType)
+	retry := jobError.errorType != RqErrorNoRetry &&
+		jobError.job.nFails < RqJobMaxFails &&
+		jobError.job.retryChn != nil &&
+		pipe.retryPolicy(jobError)
+	if retry && pipe.overRetryBudget() {
+		jobError.errorMsg += " (retry budget used up)"
+		retry = false
+	}
+	if !retry {
+		pipe.logger.Errorf("Job Failed: %v: %v", jobError.job.image.URL, jobError.errorMsg)
+		pipe.writeFailureDetails(jobError.job.image.URL, jobError.errorMsg, jobError.statusCode, jobError.finalURL)
+		if err := pipe.writeResult(jobError.job, nil); err != nil {
+			// results held back by this job failed to write
+			pipe.logger.Errorf("Failed to write results after %v: %v", jobError.job.image.URL, err)
+			pipe.abort(errors.New("Failed to write output: " + err.Error()))
+		}
 		// delete possible remaining image
 		os.Remove(jobError.job.image.filePath)
-		atomic.AddUint64(&pipe.imageCount, ^uint64(0))
-		if pipe.isDone() {
-			pipe.pool.stopWorkers()
+		pipe.finishJob(jobError.job.image.URL)
+		pipe.addImageCount(^uint64(0))
+		atomic.AddUint64(&pipe.stats.failed, 1)
+		pipe.stats.addFailure(jobError.errorType)
+		pipe.stopIfDone()
+		return
+	}
+	atomic.AddUint64(&pipe.stats.retried, 1)
+
+	// only failures are errors; a retried job may still succeed
+	pipe.logger.Debugf("Job Error(%v): %v: %v", jobError.errorType, jobError.job.image.URL, jobError.errorMsg)
+	delay := pipe.requeueDelay(jobError.job.nFails)
+	if delay <= 0 {
+		sendJob(pipe.pool.ctx, jobError.job.retryChn, jobError.job)
+		return
+	}
+	// wait in another goroutine so other errors are handled meanwhile; it's part of the pool so the
+	// channels stay open until the job is sent
+	pipe.pool.wg.Add(1)
+	go func(job RqJob) {
+		defer pipe.pool.wg.Done()
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			sendJob(pipe.pool.ctx, job.retryChn, job)
+		case <-pipe.pool.ctx.Done():
+			if job.image.filePath != "" {
+				os.Remove(job.image.filePath)
+			}
 		}
+	}(jobError.job)
+}
+
+// Delay before requeuing a job that has failed nFails times
+func (pipe *RqPipeline) requeueDelay(nFails int) time.Duration {
+	delay := pipe.retryDelay
+	if pipe.maxRetryDelay <= 0 {
+		return delay
+	}
+	for i := 1; i < nFails && delay < pipe.maxRetryDelay; i += 1 {
+		delay *= 2
+	}
+	if delay > pipe.maxRetryDelay {
+		delay = pipe.maxRetryDelay
+	}
+	return delay
+}
+
+// Stop the pipeline because of an unrecoverable error; Run returns the first error
+func (pipe *RqPipeline) abort(err error) {
+	pipe.mux.Lock()
+	if pipe.runErr == nil {
+		pipe.runErr = err
+	}
+	pipe.mux.Unlock()
+	pipe.cancel()
+}
+
+// Write a failed or unprocessed url to the error output, if there is one
+func (pipe *RqPipeline) writeFailure(imgURL string, reason string) {
+	pipe.writeFailureDetails(imgURL, reason, 0, "")
+}
+
+// Write a failure to the error output as CSV of url,reason,status_code,final_url
+// The status code and final url are left empty unless a download got a response
+func (pipe *RqPipeline) writeFailureDetails(imgURL string, reason string, statusCode int, finalURL string) {
+	if pipe.errOut == nil {
 		return
 	}
+	status := ""
+	if statusCode != 0 {
+		status = strconv.Itoa(statusCode)
+	}
+	pipe.errMux.Lock()
+	defer pipe.errMux.Unlock()
+	line := csvLine([]string{imgURL, reason, status, finalURL}, ',')
+	if _, err := pipe.errOut.Write(line); err != nil {
+		pipe.logger.Errorf("Failed to write error output: %v", err)
+	}
+}
+
+// Track a url entering the pipeline
+func (pipe *RqPipeline) startJob(imgURL string) {
+	pipe.mux.Lock()
+	defer pipe.mux.Unlock()
+	pipe.inFlight[imgURL] += 1
+}
+
+// Track a url leaving the pipeline (saved or failed)
+func (pipe *RqPipeline) finishJob(imgURL string) {
+	pipe.mux.Lock()
+	defer pipe.mux.Unlock()
+	if pipe.inFlight[imgURL] <= 1 {
+		delete(pipe.inFlight, imgURL)
+	} else {
+		pipe.inFlight[imgURL] -= 1
+	}
+}
+
+// Check if the job would start a download after the total download budget was used up
+// Local images and data: URIs aren't downloaded, so they're never over budget
+func (pipe *RqPipeline) overBudget(job RqJob) bool {
+	budget := pipe.pool.downloadCfg.MaxTotalBytes
+	if budget <= 0 || atomic.LoadUint64(&pipe.stats.bytes) < uint64(budget) {
+		return false
+	}
+	if _, ok := job.image.sourcePath(); ok || isDataURI(job.image.URL) {
+		return false
+	}
+	pipe.budgetOnce.Do(func() {
+		pipe.logger.Infof("Download budget of %v bytes reached, skipping the remaining downloads", budget)
+	})
+	return true
+}
+
+// Check if the run has used up its retry budget; errors are handled one at a time, so the count can't
+// change before the retry is counted
+func (pipe *RqPipeline) overRetryBudget() bool {
+	if pipe.retryBudget <= 0 || atomic.LoadUint64(&pipe.stats.retried) < uint64(pipe.retryBudget) {
+		return false
+	}
+	pipe.retryOnce.Do(func() {
+		pipe.logger.Infof("Retry budget of %v retries used up, failing jobs on their next error", pipe.retryBudget)
+	})
+	atomic.AddUint64(&pipe.stats.overRetryBudget, 1)
+	return true
+}
+
+// Remove a job from the pipeline without processing it, recording it as unprocessed for reason
+func (pipe *RqPipeline) skipJob(job RqJob, reason string) {
+	pipe.logger.Errorf("Unprocessed %v: %v", job.image.URL, reason)
+	pipe.writeFailure(job.image.URL, "unprocessed: "+reason)
+	if err := pipe.writeResult(job, nil); err != nil {
+		pipe.logger.Errorf("Failed to write results after %v: %v", job.image.URL, err)
+		pipe.abort(errors.New("Failed to write output: " + err.Error()))
+	}
+	pipe.finishJob(job.image.URL)
+	pipe.addImageCount(^uint64(0))
+	atomic.AddUint64(&pipe.stats.skipped, 1)
+	pipe.stopIfDone()
+}
 
-	log.Printf("Job Error(%v): %v: %v\n", jobError.errorType, jobError.job.image.URL, jobError.errorMsg)
-	jobError.job.retryChn <- jobError.job
+// Write urls that were still in the pipeline when it was cancelled to the error output
+func (pipe *RqPipeline) writeUnprocessed(reason error) {
+	pipe.mux.Lock()
+	defer pipe.mux.Unlock()
+	for imgURL, n := range pipe.inFlight {
+		pipe.logger.Errorf("Unprocessed %v: %v", imgURL, reason)
+		atomic.AddUint64(&pipe.stats.skipped, uint64(n))
+		for i := 0; i < n; i += 1 {
+			pipe.writeFailure(imgURL, "unprocessed: "+reason.Error())
+		}
+	}
+	pipe.inFlight = make(map[string]int)
+}
+
+// Change the number of images in the pipeline by delta (^uint64(0) to decrement), recording it as progress
+func (pipe *RqPipeline) addImageCount(delta uint64) {
+	atomic.AddUint64(&pipe.imageCount, delta)
+	atomic.StoreInt64(&pipe.lastProgress, time.Now().UnixNano())
 }
 
 // check if the pipeline is completed
 func (pipe *RqPipeline) isDone() bool {
 	pipe.mux.Lock()
 	defer pipe.mux.Unlock()
-	return pipe.readURLsDone && pipe.imageCount == 0
+	return pipe.readURLsDone && atomic.LoadUint64(&pipe.imageCount) == 0
 }
 
-// stop all workers
-func (pool *RqPool) stopWorkers() {
-	nWorkers := pool.nDownload + pool.nSummarize + pool.nCleanup + 1 // +1 for Error handler
+// Stop the workers if the pipeline is completed; returns true if it was
+// The reader and every finished job call this after their last change to the counts, so whichever of
+// them finishes last sees the pipeline completed, even when the last job finishes before the reader
+// marks the source as read
+func (pipe *RqPipeline) stopIfDone() bool {
+	if !pipe.isDone() {
+		return false
+	}
+	pipe.completeOnce.Do(func() {
+		pipe.logger.Infof("PIPELINE COMPLETE!")
+	})
+	pipe.pool.stopWorkers()
+	return true
+}
 
+// stop all workers; never blocks, so it's safe to call from a worker or the error handler
+func (pool *RqPool) stopWorkers() {
 	pool.stopOnce.Do(func() {
-		for i := 0; i < nWorkers; i += 1 {
-			pool.doneChn <- 1
-		}
+		close(pool.doneChn)
 	})
 }
 
+// Run a stage's work on a job, failing the job if the stage panics so one bad image can't crash the run
+// Returns true if the job was passed to the next stage
+func (pipe *RqPipeline) runStage(job RqJob, stage func() bool) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			pipe.logger.Errorf("Recovered panic on %v: %v", job.image.URL, r)
+			sendError(pipe.pool.ctx, pipe.pool.errorChn, NewRqError(job, RqErrorNoRetry, fmt.Sprintf("Panic: %v", r)))
+			ok = false
+		}
+	}()
+	return stage()
+}
+
 // worker function for downloading images
 func (pipe *RqPipeline) workDownload() {
 	defer pipe.pool.wg.Done()
 	pool := pipe.pool
+	if !pool.waitJitter() {
+		pipe.logger.Debugf("workDownload exiting")
+		return
+	}
 	for {
 		select {
 		case job := <-pool.downloadChn:
 			job.retryChn = pool.downloadChn
 			job.nextChn = pool.summarizeChn
-			downloadImage(job, pool.client, pool.errorChn)
+			if pipe.overBudget(job) {
+				pipe.skipJob(job, "download budget reached")
+				continue
+			}
+			if pool.dryRun {
+				// nothing to summarize or clean up
+				job.nextChn = pool.saveChn
+			}
+			job.downloadStart = time.Now()
+			ok := pipe.runStage(job, func() bool {
+				if pool.dryRun {
+					return checkImage(pool.ctx, job, pool.downloader, pool.errorChn)
+				} else if pool.inMemory {
+					return downloadImageInMemory(pool.ctx, job, pool.downloader, pool.errorChn)
+				}
+				return downloadImage(pool.ctx, job, pool.downloader, pool.errorChn)
+			})
+			if ok {
+				atomic.AddUint64(&pipe.stats.downloaded, 1)
+				pipe.logger.Debugf("Downloaded %v", job.image.URL)
+			}
 		case <-pool.doneChn:
-			log.Println("workDownload exiting")
+			pipe.logger.Debugf("workDownload exiting")
+			return
+		case <-pool.ctx.Done():
+			pipe.logger.Debugf("workDownload cancelled")
 			return
 		}
 	}
 }
 
+// Wait a random part of the startup jitter; false if the pipeline stopped meanwhile
+func (pool *RqPool) waitJitter() bool {
+	if pool.startJitter <= 0 {
+		return true
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(pool.startJitter))))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-pool.doneChn:
+		return false
+	case <-pool.ctx.Done():
+		return false
+	}
+}
+
 // worker function for summarizing images
 func (pipe *RqPipeline) workSummarize() {
 	defer pipe.pool.wg.Done()
@@ -255,9 +1346,26 @@ func (pipe *RqPipeline) workSummarize() {
 		case job := <-pool.summarizeChn:
 			job.retryChn = pool.summarizeChn
 			job.nextChn = pool.cleanupChn
-			summarizeImage(job, pool.errorChn)
+			if pool.inMemory {
+				// nothing to clean up
+				job.nextChn = pool.saveChn
+			}
+			job.summarizeStart = time.Now()
+			ok := pipe.runStage(job, func() bool {
+				return summarizeImage(pool.ctx, job, pipe.summarizeCfg, pipe.summarizer, pool.downloadChn, pool.errorChn)
+			})
+			if pipe.metrics != nil {
+				pipe.metrics.ObserveSummarize(time.Since(job.summarizeStart))
+			}
+			if ok {
+				atomic.AddUint64(&pipe.stats.summarized, 1)
+				pipe.logger.Debugf("Summarized %v", job.image.URL)
+			}
 		case <-pool.doneChn:
-			log.Println("workSummarize exiting")
+			pipe.logger.Debugf("workSummarize exiting")
+			return
+		case <-pool.ctx.Done():
+			pipe.logger.Debugf("workSummarize cancelled")
 			return
 		}
 	}
@@ -272,14 +1380,37 @@ func (pipe *RqPipeline) workCleanup() {
 		case job := <-pool.cleanupChn:
 			job.retryChn = pool.cleanupChn
 			job.nextChn = pool.saveChn
-			cleanupImage(job, pool.errorChn)
+			ok := pipe.runStage(job, func() bool {
+				if pool.keepDir != "" {
+					return keepImage(pool.ctx, job, pool.keepDir, pool.errorChn)
+				}
+				return cleanupImage(pool.ctx, job, pool.errorChn)
+			})
+			if ok {
+				pipe.logger.Debugf("Cleaned %v", job.image.URL)
+			}
 		case <-pool.doneChn:
-			log.Println("workCleanup exiting")
+			pipe.logger.Debugf("workCleanup exiting")
+			return
+		case <-pool.ctx.Done():
+			pipe.logger.Debugf("workCleanup cancelled")
 			return
 		}
 	}
 }
 
+// Make the channels for a run; the previous run's channels are closed when it ends
+func (pool *RqPool) makeChns() {
+	cfg := pool.cfg
+	pool.downloadChn = make(chan RqJob, bufferSize(cfg.DownloadBuffer))
+	pool.summarizeChn = make(chan RqJob, bufferSize(cfg.SummarizeBuffer))
+	pool.cleanupChn = make(chan RqJob, bufferSize(cfg.CleanupBuffer))
+	pool.saveChn = make(chan RqJob, bufferSize(cfg.SaveBuffer))
+	pool.errorChn = make(chan RqError, 1000)
+	pool.doneChn = make(chan struct{})
+	pool.stopOnce = sync.Once{}
+}
+
 // close all channels used by the pool
 func (pool *RqPool) closeChns() {
 	close(pool.downloadChn)
@@ -287,14 +1418,147 @@ func (pool *RqPool) closeChns() {
 	close(pool.cleanupChn)
 	close(pool.saveChn)
 	close(pool.errorChn)
-	close(pool.doneChn)
+	pool.stopWorkers()
+
+	// jobs left in buffered channels when the run stopped early won't be processed, so delete their downloads
+	for _, chn := range []chan RqJob{pool.summarizeChn, pool.cleanupChn} {
+		for job := range chn {
+			if job.image.filePath != "" {
+				os.Remove(job.image.filePath)
+			}
+		}
+	}
+}
+
+// Start a run with fresh channels and counters, so a pipeline can run again once its previous run ended
+// Results go to the output set when the run starts, and a header is only written once to each output
+func (pipe *RqPipeline) resetRun() error {
+	if pipe.resultChn != nil && pipe.resultChn == pipe.closedResults {
+		return errors.New("Pipeline result channel was closed by the previous run. Use method WithResultChannel to set a new one.")
+	}
+	pipe.pool.makeChns()
+	pipe.stats = rqStats{}
+	pipe.runErr = nil
+	pipe.imageCount = 0
+	pipe.inFlight = make(map[string]int)
+	pipe.readURLsDone = false
+	pipe.completeOnce = sync.Once{}
+	pipe.budgetOnce = sync.Once{}
+	pipe.retryOnce = sync.Once{}
+	pipe.nextIndex = 0
+	pipe.doneURLs = nil
+	if pipe.outFile != pipe.output.out {
+		// a new output since the last run
+		pipe.output = newFlushWriter(pipe.outFile, pipe.flushInterval, pipe.syncOutput)
+		pipe.wroteHeader = false
+	}
+	if pipe.orderSize > 0 {
+		pipe.ordered = newOrderedWriter(pipe.output, pipe.orderSize)
+	}
+	return nil
+}
+
+// Describe the settings that shape a run's results and speed, for logs to tie an output to them
+func (pipe *RqPipeline) settings() string {
+	pool := pipe.pool
+	timeout := "none"
+	if pool.client.Timeout > 0 {
+		timeout = pool.client.Timeout.String()
+	}
+	mode := "download"
+	if pool.dryRun {
+		mode = "dry run"
+	} else if pool.inMemory {
+		mode = "in memory"
+	}
+	summarize := "k " + strconv.Itoa(pipe.summarizeCfg.K)
+	if pipe.summarizer != nil {
+		summarize = "custom summarizer"
+	}
+	return fmt.Sprintf("workers download %v, summarize %v, cleanup %v; timeout %v; download retries %v; %v; format %v; %v",
+		pool.nDownload, pool.nSummarize, pool.nCleanup, timeout, pool.downloadCfg.Retries, mode, pipe.outFormat, summarize)
 }
 
 // Run the pipeline
-func (pipe *RqPipeline) Run() {
+func (pipe *RqPipeline) Run() (RunResult, error) {
+	return pipe.RunContext(context.Background())
+}
+
+// Run the pipeline until it completes, the context is cancelled, or it fails to write output
+// When stopped early, in-flight jobs are dropped and their temp files removed, they're counted as
+// skipped in the result, and the returned error says why
+// A pipeline can be run again for another batch once a run has returned (but not concurrently): set the
+// next source with WithSource, since a reader is used up, and a new result channel if there is one, since
+// it's closed. The output can be changed with WithOutput or kept, and counters start from 0 for each run
+func (pipe *RqPipeline) RunContext(ctx context.Context) (RunResult, error) {
+	if err := pipe.resetRun(); err != nil {
+		pipe.logger.Errorf("PIPELINE STOPPED: %v", err)
+		return RunResult{}, err
+	}
+	if pipe.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pipe.deadline)
+		defer cancel()
+	}
+	ctx, pipe.cancel = context.WithCancel(ctx)
+	defer pipe.cancel()
+	pipe.pool.ctx = ctx
+	pipe.logger.Infof("Starting run: %v", pipe.settings())
+
+	writeHeader := pipe.outHeader && !pipe.wroteHeader
+	if pipe.resumeFrom != nil {
+		done, nLines, err := readDoneURLs(pipe.resumeFrom, pipe.outFormat, pipe.outputOpts.comma)
+		if err != nil {
+			err = errors.New("Failed to read previous output: " + err.Error())
+			pipe.logger.Errorf("PIPELINE STOPPED: %v", err)
+			return RunResult{}, err
+		}
+		pipe.logger.Infof("Resuming after %v results", len(done))
+		pipe.doneURLs = done
+		writeHeader = writeHeader && nLines == 0
+	}
+
+	// results are written unordered, so the header must go out before any workers start
+	if writeHeader {
+		header := formatHeader(pipe.summarizeCfg, pipe.summarizer, pipe.outFormat, pipe.outputOpts)
+		if pipe.pool.dryRun {
+			header = formatCheckHeader(pipe.outFormat, pipe.outputOpts)
+		}
+		if pipe.rotating != nil {
+			// repeated at the top of each file instead
+			pipe.rotating.header = header
+		} else if _, err := pipe.output.Write(header); err != nil {
+			err = errors.New("Failed to write output: " + err.Error())
+			pipe.logger.Errorf("PIPELINE STOPPED: %v", err)
+			return RunResult{}, err
+		} else {
+			pipe.wroteHeader = true
+		}
+	}
+
 	// goroutines for the beginning and end of pipeline
-	go pipe.readURLs()
-	go pipe.writeResults()
+	pipe.pool.wg.Add(1)
+	if pipe.sourceDir != nil {
+		go pipe.readDirectory()
+	} else if pipe.sourceCSV != nil {
+		go pipe.readCSVURLs()
+	} else {
+		go pipe.readURLs()
+	}
+	stopFlushing := pipe.output.flushEvery()
+	if pipe.watchdog != nil {
+		atomic.StoreInt64(&pipe.lastProgress, time.Now().UnixNano())
+		go pipe.watch()
+	}
+	stopWebhook := func() {}
+	if pipe.webhook != nil {
+		stopWebhook = pipe.startWebhook()
+	}
+	writeDone := make(chan struct{})
+	go func() {
+		pipe.writeResults()
+		close(writeDone)
+	}()
 
 	// start error handling
 	pipe.pool.wg.Add(1)
@@ -320,71 +1584,280 @@ func (pipe *RqPipeline) Run() {
 
 	pipe.pool.wg.Wait()
 	pipe.pool.closeChns()
+	<-writeDone
+	// results are still posted after the last one is written
+	stopWebhook()
+	if pipe.resultChn != nil {
+		close(pipe.resultChn)
+		pipe.closedResults = pipe.resultChn
+	}
+	if pipe.ordered != nil {
+		// write whatever finished, even if the jobs before it didn't
+		if err := pipe.ordered.close(); err != nil {
+			pipe.logger.Errorf("Failed to write buffered results: %v", err)
+			pipe.abort(errors.New("Failed to write output: " + err.Error()))
+		}
+	}
+	stopFlushing()
+	if err := pipe.output.Flush(); err != nil {
+		pipe.logger.Errorf("Failed to flush results: %v", err)
+		pipe.abort(errors.New("Failed to write output: " + err.Error()))
+	}
+	if pipe.rotating != nil {
+		if err := pipe.rotating.Close(); err != nil {
+			pipe.logger.Errorf("Failed to close output file: %v", err)
+			pipe.abort(errors.New("Failed to write output: " + err.Error()))
+		}
+	}
+
+	pipe.mux.Lock()
+	err := pipe.runErr
+	pipe.mux.Unlock()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		pipe.logger.Errorf("PIPELINE STOPPED: %v", err)
+		pipe.writeUnprocessed(err)
+	}
+
+	stats := pipe.Stats()
+	result := RunResult{
+		Succeeded: stats.Saved,
+		Failed:    stats.Failed,
+		Skipped:   stats.Skipped,
+		Resumed:   stats.Resumed,
+		Errors:    stats.Errors,
+		Failures:  stats.Failures,
+		Retried:   stats.Retried,
+	}
+	pipe.logger.Infof("Errors: %v", result.ErrorSummary())
+	return result, err
 }
 
-// Download an image from its url
-func downloadImage(job RqJob, client *http.Client, errorChn chan<- RqError) {
+// Download an image from its url; returns true if the job was passed to the next stage
+// Images with local paths are read in place instead, and aren't deleted by cleanup
+func downloadImage(ctx context.Context, job RqJob, d *downloader, errorChn chan<- RqError) bool {
+	if path, ok := job.image.sourcePath(); ok {
+		f, err := openLocal(path)
+		if err != nil {
+			sendError(ctx, errorChn, NewRqError(job, RqErrorNoRetry, err.Error()))
+			return false
+		}
+		job.image.size = fileSize(f)
+		f.Close()
+		job.image.localPath = path
+		job.downloadEnd = time.Now()
+		return sendJob(ctx, job.nextChn, job)
+	}
+
 	tmpFile, err := ioutil.TempFile("", "*.tmpimg")
 	if err != nil {
-		errorChn <- NewRqError(job, RqErrorDownload, err.Error())
-		return
+		sendError(ctx, errorChn, NewRqError(job, RqErrorDownload, err.Error()))
+		return false
 	}
 	defer tmpFile.Close()
 
 	img := job.image
-	err = downloadToFile(img.URL, tmpFile, client)
+	entry, cached := d.loadCached(img.URL)
+	validators, err := d.downloadToFileIfModified(ctx, img.URL, tmpFile, entry.Validators)
+	if err == errNotModified && cached {
+		d.logger.Debugf("Not modified, using cached summary of %v", img.URL)
+		os.Remove(tmpFile.Name())
+		entry.apply(&job.image)
+		job.downloadEnd = time.Now()
+		return sendJob(ctx, job.nextChn, job)
+	}
 	if err != nil {
-		errorChn <- NewRqError(job, RqErrorDownload, err.Error())
-		return
+		// delete the partial download
+		os.Remove(tmpFile.Name())
+		errorType := RqErrorType(RqErrorDownload)
+		if err == errMaxBytes || err == errTooManyRedirects || err == errInvalidDataURI || err == errDisallowed {
+			// the image will never fit, be reached, be decoded or be allowed, retrying won't help
+			errorType = RqErrorNoRetry
+		}
+		sendError(ctx, errorChn, newDownloadRqError(job, errorType, err))
+		return false
 	}
 	job.image.filePath = tmpFile.Name()
+	job.image.validators = validators
+	job.image.size = fileSize(tmpFile)
+	if d.contents != nil {
+		duplicate, err := d.contents.lookup(&job.image, tmpFile)
+		if err != nil {
+			os.Remove(tmpFile.Name())
+			sendError(ctx, errorChn, NewRqError(job, RqErrorDownload, err.Error()))
+			return false
+		}
+		if duplicate {
+			d.logger.Debugf("Same content as an earlier image, using its summary for %v", img.URL)
+		}
+	}
 
-	log.Printf("Downloaded %v", job.image.URL)
-	job.nextChn <- job
+	job.downloadEnd = time.Now()
+	return sendJob(ctx, job.nextChn, job)
 }
 
-// Open an image and calculate the most frequent colors
-func summarizeImage(job RqJob, errorChn chan<- RqError) {
-	img := job.image
-	imgFile, err := os.Open(img.filePath)
+// Check an image's url is reachable and serves an image without downloading it
+// Returns true if the job was passed to the next stage
+func checkImage(ctx context.Context, job RqJob, d *downloader, errorChn chan<- RqError) bool {
+	var contentType string
+	var size int64
+	var err error
+	errorType := RqErrorType(RqErrorDownload)
+	if path, ok := job.image.sourcePath(); ok {
+		contentType, size, err = checkLocal(path)
+		errorType = RqErrorNoRetry
+	} else {
+		contentType, size, err = d.checkURL(ctx, job.image.URL)
+	}
+	if err == errNotImage || err == errMaxBytes || err == errTooManyRedirects || err == errInvalidDataURI || err == errDisallowed {
+		errorType = RqErrorNoRetry
+	}
+	if err == errNotImage {
+		err = errors.New(err.Error() + ": " + contentType)
+	}
 	if err != nil {
-		errorChn <- NewRqError(job, RqErrorSummarize, err.Error())
-		return
+		sendError(ctx, errorChn, newDownloadRqError(job, errorType, err))
+		return false
 	}
-	defer imgFile.Close()
+	job.image.contentType = contentType
+	job.image.size = int(size)
+
+	job.downloadEnd = time.Now()
+	return sendJob(ctx, job.nextChn, job)
+}
 
-	imgImage, _, err := image.Decode(imgFile)
+// Download and decode an image from its url without saving it to disk; returns true if the job was passed to the next stage
+func downloadImageInMemory(ctx context.Context, job RqJob, d *downloader, errorChn chan<- RqError) bool {
+	var decoded image.Image
+	var err error
+	if path, ok := job.image.sourcePath(); ok {
+		decoded, job.image.format, job.image.size, err = decodeLocal(path, d.decodeCfg)
+		if err != nil {
+			// the file won't change by retrying
+			sendError(ctx, errorChn, NewRqError(job, RqErrorNoRetry, err.Error()))
+			return false
+		}
+	} else {
+		entry, cached := d.loadCached(job.image.URL)
+		var validators validators
+		var size int64
+		decoded, job.image.format, size, validators, err = d.downloadToImageIfModified(ctx, job.image.URL, entry.Validators)
+		if err == errNotModified && cached {
+			d.logger.Debugf("Not modified, using cached summary of %v", job.image.URL)
+			entry.apply(&job.image)
+			job.downloadEnd = time.Now()
+			return sendJob(ctx, job.nextChn, job)
+		}
+		job.image.validators = validators
+		job.image.size = int(size)
+	}
+	if errors.Is(err, image.ErrFormat) || errors.Is(err, errFormatNotAllowed) || errors.Is(err, errTooManyPixels) ||
+		err == errMaxBytes || err == errTooManyRedirects || err == errInvalidDataURI || err == errDisallowed {
+		// no registered or allowed decoder for this format, the image is too big, or it can't be reached or decoded;
+		// retrying won't help
+		sendError(ctx, errorChn, NewRqError(job, RqErrorNoRetry, err.Error()))
+		return false
+	}
+	var decodeErr *decodeError
+	if errors.As(err, &decodeErr) {
+		// a corrupt image, reported like one that fails to decode from a downloaded file
+		sendError(ctx, errorChn, NewRqError(job, RqErrorSummarize, err.Error()))
+		return false
+	}
 	if err != nil {
-		errorChn <- NewRqError(job, RqErrorSummarize, err.Error())
-		return
+		sendError(ctx, errorChn, newDownloadRqError(job, RqErrorDownload, err))
+		return false
 	}
+	job.image.decoded = decoded
 
-	summary, err := getPrevalentColors(&imgImage)
-	if err != nil {
-		errorChn <- NewRqError(job, RqErrorSummarize, err.Error())
-		return
+	job.downloadEnd = time.Now()
+	return sendJob(ctx, job.nextChn, job)
+}
+
+// Open an image (unless it's already decoded) and calculate the most frequent colors
+// A downloaded image that has disappeared (e.g. removed by a temp directory cleaner) is sent back to
+// downloadChn as a download error, since summarizing again can't succeed; with a nil downloadChn it fails
+// Returns true if the job was passed to the next stage
+func summarizeImage(ctx context.Context, job RqJob, cfg SummarizeConfig, summarizer Summarizer, downloadChn chan RqJob, errorChn chan<- RqError) bool {
+	if job.image.cached || job.image.duplicate {
+		job.summarizeEnd = time.Now()
+		return sendJob(ctx, job.nextChn, job)
+	}
+	imgImage := job.image.decoded
+	if imgImage == nil {
+		path := job.image.filePath
+		if path == "" {
+			path = job.image.localPath
+		}
+		imgFile, err := os.Open(path)
+		if os.IsNotExist(err) {
+			if job.image.filePath == "" {
+				// a local image that's gone won't come back
+				sendError(ctx, errorChn, NewRqError(job, RqErrorNoRetry, err.Error()))
+				return false
+			}
+			job.image.filePath = ""
+			job.retryChn = downloadChn
+			sendError(ctx, errorChn, NewRqError(job, RqErrorDownload, "Downloaded image is missing: "+err.Error()))
+			return false
+		}
+		if err != nil {
+			sendError(ctx, errorChn, NewRqError(job, RqErrorSummarize, err.Error()))
+			return false
+		}
+		defer imgFile.Close()
+
+		imgImage, job.image.format, err = decodeImage(imgFile, cfg)
+		if err == image.ErrFormat || errors.Is(err, errFormatNotAllowed) || errors.Is(err, errTooManyPixels) {
+			// no registered or allowed decoder for this format, or too many pixels to decode; retrying won't help
+			sendError(ctx, errorChn, NewRqError(job, RqErrorNoRetry, err.Error()))
+			return false
+		}
+		if err != nil {
+			sendError(ctx, errorChn, NewRqError(job, RqErrorSummarize, err.Error()))
+			return false
+		}
+	}
+
+	if summarizer != nil {
+		result, err := summarizer.Summarize(imgImage)
+		if err != nil {
+			sendError(ctx, errorChn, NewRqError(job, RqErrorSummarize, err.Error()))
+			return false
+		}
+		job.image.result = result
+	} else {
+		summary, err := getPrevalentColors(&imgImage, cfg)
+		if err != nil {
+			sendError(ctx, errorChn, NewRqError(job, RqErrorSummarize, err.Error()))
+			return false
+		}
+		job.image.summary = summary
 	}
 
-	job.image.summary = summary
-	log.Printf("Summarized %v", job.image.URL)
-	job.nextChn <- job
+	bounds := imgImage.Bounds()
+	job.image.width = bounds.Dx()
+	job.image.height = bounds.Dy()
+	job.image.decoded = nil // release the pixels, only the summary is needed from here on
+	job.summarizeEnd = time.Now()
+	return sendJob(ctx, job.nextChn, job)
 }
 
-// Delete an image
-func cleanupImage(job RqJob, errorChn chan<- RqError) {
+// Delete an image; returns true if the job was passed to the next stage
+func cleanupImage(ctx context.Context, job RqJob, errorChn chan<- RqError) bool {
 	if job.image.filePath == "" {
-		// image wasn't downloaded
-		job.nextChn <- job
-		return
+		// image wasn't downloaded (or was read from a local path, which isn't ours to delete)
+		return sendJob(ctx, job.nextChn, job)
 	}
 
 	err := os.Remove(job.image.filePath)
 	if err != nil && errorChn != nil {
-		errorChn <- NewRqError(job, RqErrorCleanup, err.Error())
-		return
+		sendError(ctx, errorChn, NewRqError(job, RqErrorCleanup, err.Error()))
+		return false
 	}
 
 	job.image.filePath = ""
-	log.Printf("Cleaned %v", job.image.URL)
-	job.nextChn <- job
+	return sendJob(ctx, job.nextChn, job)
 }
@@ -1,13 +1,28 @@
-package main
+package rquent
 
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func stringInSlice(a string, list []string) bool {
@@ -42,7 +57,7 @@ func getErrorChn(errorChn <-chan RqError) (RqError, error) {
 	}
 }
 
-var testPipeConfig = PipeConfig{1, 1, 1}
+var testPipeConfig = PipeConfig{Download: 1, Summarize: 1, Cleanup: 1}
 
 func TestMakePipeline(t *testing.T) {
 	s := `test.com/valid`
@@ -60,6 +75,35 @@ func TestMakePipeline(t *testing.T) {
 	}
 }
 
+func TestMakePipelineInvalidFormat(t *testing.T) {
+	imageURLs := strings.NewReader(testImageURL200)
+	b := new(bytes.Buffer)
+	_, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(imageURLs).
+		WithOutput(b).
+		WithFormat(RqOutputFormat(-1)).
+		Init()
+
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestMakePipelineNegativeBuffer(t *testing.T) {
+	cfg := testPipeConfig
+	cfg.SummarizeBuffer = -1
+	_, err := NewPipeline(cfg).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(new(bytes.Buffer)).
+		Init()
+
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
 // func TestPipelineReadURLs(t *testing.T) {
 // 	s := []string{"web1.com", "web2.com", "web3.com", "web4.com"}
 // 	imageURLs := strings.NewReader(strings.Join(s, "\n"))
@@ -92,7 +136,7 @@ func TestPipelineDownloadImageOK(t *testing.T) {
 	}
 	errorChn := make(chan RqError, 10)
 	defer close(errorChn)
-	downloadImage(job, testClient, errorChn)
+	downloadImage(context.Background(), job, testDownloader, errorChn)
 
 	select {
 	case jobOut := <-outChn:
@@ -123,7 +167,7 @@ func TestPipelineDownloadImage404(t *testing.T) {
 		nextChn: outChn,
 	}
 	errorChn := make(chan RqError, 10)
-	downloadImage(job, testClient, errorChn)
+	downloadImage(context.Background(), job, testDownloader, errorChn)
 
 	select {
 	case jobOut := <-outChn:
@@ -137,11 +181,44 @@ func TestPipelineDownloadImage404(t *testing.T) {
 		if err.errorType != RqErrorDownload {
 			t.Errorf("Expected (%v) Got (%v)", RqErrorDownload, err.errorType)
 		}
+		if err.statusCode != 404 || err.finalURL != testImageURL404 {
+			t.Errorf("Expected (404 from %v) Got (%v from %v)", testImageURL404, err.statusCode, err.finalURL)
+		}
+		if err.errorMsg != "Url invalid (statusCode 404)" {
+			t.Errorf("Expected (Url invalid (statusCode 404)) Got (%v)", err.errorMsg)
+		}
 	default:
 		t.Error("Expected (error chn to have error) Got (empty chn)")
 	}
 }
 
+func TestPipelineDownloadImageInMemoryOK(t *testing.T) {
+	// Test that downloading in memory attaches a decoded image and doesn't set a file path
+	outChn := make(chan RqJob, 10)
+	job := RqJob{
+		image:   NewRqImage(testImageURL200),
+		nextChn: outChn,
+	}
+	errorChn := make(chan RqError, 10)
+	downloadImageInMemory(context.Background(), job, testDownloader, errorChn)
+
+	jobOut, err := getJobChn(outChn)
+	if err != nil {
+		t.Fatalf("Expected (job in chn) Got (%v)", err)
+	}
+	if jobOut.image.decoded == nil {
+		t.Errorf("Expected (decoded image) Got (nil)")
+	}
+	if jobOut.image.filePath != "" {
+		t.Errorf("Expected (empty file path) Got (%v)", jobOut.image.filePath)
+	}
+
+	errOut, err := getErrorChn(errorChn)
+	if err == nil {
+		t.Errorf("Expected (no RqError) Got (%v)", errOut.errorMsg)
+	}
+}
+
 func TestPipelineSummarizeImageOK(t *testing.T) {
 	// Test summarizing valid image put's job in next channel, the image summary is updated,
 	//   and there's nothing in the error channel
@@ -157,13 +234,13 @@ func TestPipelineSummarizeImageOK(t *testing.T) {
 
 	errorChn := make(chan RqError, 10)
 
-	summarizeImage(job, errorChn)
+	summarizeImage(context.Background(), job, testSummarizeConfig, nil, nil, errorChn)
 
 	jobOut, err := getJobChn(outChn)
 	if err != nil {
 		t.Errorf("Expected (job in chn) Got (%v)", err)
 	}
-	if len(jobOut.image.summary.colors) == 0 {
+	if len(jobOut.image.summary.Colors) == 0 {
 		t.Errorf("Expected (image to have summary) Got (image has no summary)")
 	}
 
@@ -176,9 +253,20 @@ func TestPipelineSummarizeImageOK(t *testing.T) {
 func TestPipelineSummarizeImageBad(t *testing.T) {
 	// Test that summarizing a bad image results in no job in the next channel, and an error in the
 	//   error channel
+	data, err := ioutil.ReadFile(testImagePathValid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "*.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(data[:len(data)/2])
+	f.Close()
 	invalidImage := RqImage{
 		URL:      testImageURL200,
-		filePath: testImagePathInvalid, // path to an INVALID local image
+		filePath: f.Name(), // path to a truncated, INVALID image
 	}
 	outChn := make(chan RqJob, 10)
 	job := RqJob{
@@ -188,14 +276,14 @@ func TestPipelineSummarizeImageBad(t *testing.T) {
 
 	errorChn := make(chan RqError, 10)
 
-	summarizeImage(job, errorChn)
+	summarizeImage(context.Background(), job, testSummarizeConfig, nil, nil, errorChn)
 
 	// there should NOT be a job in the output channel
 	jobOut, err := getJobChn(outChn)
 	if err == nil {
 		t.Errorf("Expected (job not in chn) Got (%v)", jobOut)
 	}
-	if len(jobOut.image.summary.colors) != 0 {
+	if len(jobOut.image.summary.Colors) != 0 {
 		t.Errorf("Expected (image summary not updated) Got (image summary updated)")
 	}
 
@@ -209,6 +297,161 @@ func TestPipelineSummarizeImageBad(t *testing.T) {
 	}
 }
 
+func TestPipelineSummarizeImageMissing(t *testing.T) {
+	// Test a downloaded image that disappeared is sent back to be downloaded again
+	downloadChn := make(chan RqJob)
+	job := RqJob{
+		image:    RqImage{URL: testImageURL200, filePath: testImagePathInvalid},
+		retryChn: make(chan RqJob),
+		nextChn:  make(chan RqJob, 1),
+	}
+	errorChn := make(chan RqError, 1)
+
+	if summarizeImage(context.Background(), job, testSummarizeConfig, nil, downloadChn, errorChn) {
+		t.Fatalf("Expected (job to fail) Got (job passed on)")
+	}
+	rqErr, err := getErrorChn(errorChn)
+	if err != nil {
+		t.Fatalf("Expected (RqError) Got (%v)", err)
+	}
+	if rqErr.errorType != RqErrorDownload || rqErr.job.retryChn != downloadChn || rqErr.job.image.filePath != "" {
+		t.Errorf("Expected (download error requeued to download) Got (%v, %v)", rqErr.errorType, rqErr.errorMsg)
+	}
+
+	// a missing local image can't be downloaded again
+	job.image = RqImage{URL: testImagePathInvalid, localPath: testImagePathInvalid}
+	summarizeImage(context.Background(), job, testSummarizeConfig, nil, downloadChn, errorChn)
+	if rqErr, err = getErrorChn(errorChn); err != nil || rqErr.errorType != RqErrorNoRetry {
+		t.Errorf("Expected (%v) Got (%v, %v)", RqErrorNoRetry, rqErr.errorType, err)
+	}
+}
+
+func TestPipelineSummarizeImageEmpty(t *testing.T) {
+	// Test an image with no pixels fails instead of being summarized as placeholders
+	job := RqJob{
+		image:   RqImage{URL: testImageURL200, decoded: image.NewRGBA(image.Rect(0, 0, 0, 0))},
+		nextChn: make(chan RqJob, 1),
+	}
+	errorChn := make(chan RqError, 1)
+
+	if summarizeImage(context.Background(), job, testSummarizeConfig, nil, nil, errorChn) {
+		t.Fatalf("Expected (job to fail) Got (job passed on)")
+	}
+	errOut, err := getErrorChn(errorChn)
+	if err != nil {
+		t.Fatalf("Expected (RqError) Got (%v)", err)
+	}
+	if errOut.errorType != RqErrorSummarize {
+		t.Errorf("Expected (%v) Got (%v)", RqErrorSummarize, errOut.errorType)
+	}
+}
+
+func TestPipelineSummarizeImageFormatNotAllowed(t *testing.T) {
+	// Test a registered but disallowed format fails without retrying
+	tmpFile, err := ioutil.TempFile("", "*.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if err := png.Encode(tmpFile, newColorsImage(10, 10, []colorFreq{colorFreq{red, 1}}, false)); err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Close()
+
+	job := RqJob{
+		image:   RqImage{URL: testImageURL200, filePath: tmpFile.Name()},
+		nextChn: make(chan RqJob, 1),
+	}
+	errorChn := make(chan RqError, 1)
+	cfg := testSummarizeConfig
+	cfg.AllowedFormats = []string{"jpeg"}
+
+	if summarizeImage(context.Background(), job, cfg, nil, nil, errorChn) {
+		t.Fatalf("Expected (job to fail) Got (job passed on)")
+	}
+	errOut, err := getErrorChn(errorChn)
+	if err != nil {
+		t.Fatalf("Expected (RqError) Got (%v)", err)
+	}
+	if errOut.errorType != RqErrorNoRetry {
+		t.Errorf("Expected (%v) Got (%v)", RqErrorNoRetry, errOut.errorType)
+	}
+}
+
+func TestPipelineSummarizeImageUnknownFormat(t *testing.T) {
+	// Test that summarizing a file with no registered decoder results in a non-retryable error
+	tmpFile, err := ioutil.TempFile("", "*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.WriteString("definitely not an image")
+	tmpFile.Close()
+
+	img := RqImage{
+		URL:      testImageURL200,
+		filePath: tmpFile.Name(), // path to a file that isn't an image
+	}
+	outChn := make(chan RqJob, 10)
+	job := RqJob{
+		image:   img,
+		nextChn: outChn,
+	}
+
+	errorChn := make(chan RqError, 10)
+
+	summarizeImage(context.Background(), job, testSummarizeConfig, nil, nil, errorChn)
+
+	jobOut, err := getJobChn(outChn)
+	if err == nil {
+		t.Errorf("Expected (job not in chn) Got (%v)", jobOut)
+	}
+
+	rqErr, err := getErrorChn(errorChn)
+	if err != nil {
+		t.Errorf("Expected (RqError in errorChn) Got (%v)", err)
+	}
+	if rqErr.errorType != RqErrorNoRetry {
+		t.Errorf("Expected (%v) Got (%v)", RqErrorNoRetry, rqErr.errorType)
+	}
+}
+
+func TestPipelineSummarizeImagePNG(t *testing.T) {
+	// Test that PNG images can be decoded and summarized
+	tmpFile, err := ioutil.TempFile("", "*.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	colorImg := newColorsImage(10, 10, []colorFreq{colorFreq{red, 1}}, false)
+	if err := png.Encode(tmpFile, colorImg); err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Close()
+
+	img := RqImage{
+		URL:      testImageURL200,
+		filePath: tmpFile.Name(),
+	}
+	outChn := make(chan RqJob, 10)
+	job := RqJob{
+		image:   img,
+		nextChn: outChn,
+	}
+
+	errorChn := make(chan RqError, 10)
+
+	summarizeImage(context.Background(), job, testSummarizeConfig, nil, nil, errorChn)
+
+	jobOut, err := getJobChn(outChn)
+	if err != nil {
+		t.Fatalf("Expected (job in chn) Got (%v)", err)
+	}
+	if jobOut.image.summary.Colors[0] != red {
+		t.Errorf("Expected (colors[0] == %v) Got (%v)", red, jobOut.image.summary.Colors)
+	}
+}
+
 func TestPipelineCleanupImageOK(t *testing.T) {
 	// Test cleanup image (in this case an empty file) put's job in next chn, the file is gone,
 	//   and there are no errors
@@ -231,7 +474,7 @@ func TestPipelineCleanupImageOK(t *testing.T) {
 
 	errorChn := make(chan RqError, 10)
 
-	cleanupImage(job, errorChn)
+	cleanupImage(context.Background(), job, errorChn)
 
 	_, err = getJobChn(outChn)
 	if err != nil {
@@ -261,7 +504,7 @@ func TestPipelineCleanupImageNoFilePath(t *testing.T) {
 
 	errorChn := make(chan RqError, 10)
 
-	cleanupImage(job, errorChn)
+	cleanupImage(context.Background(), job, errorChn)
 
 	_, err := getJobChn(outChn)
 	if err != nil {
@@ -288,7 +531,7 @@ func TestPipelineCleanupImageBadPath(t *testing.T) {
 
 	errorChn := make(chan RqError, 10)
 
-	cleanupImage(job, errorChn)
+	cleanupImage(context.Background(), job, errorChn)
 
 	jobOut, err := getJobChn(outChn)
 	if err == nil {
@@ -317,36 +560,1408 @@ func TestPipelineRunSimpleOK(t *testing.T) {
 		t.Errorf("Expected (nil) Got (%v)", err)
 	}
 
-	pipeline.Run()
+	if _, err := pipeline.Run(); err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
 	outString := b.String()
 	if len(outString) == 0 {
 		t.Errorf("Expected (bytesBuffered != 0), Got (0)")
 	}
+
+	// verify the dimensions of the image are written after the url
+	fields := strings.Split(strings.TrimSpace(outString), ",")
+	if len(fields) != 6 {
+		t.Fatalf("Expected (6 fields) Got (%v)", fields)
+	}
+	if fields[1] != "1400" || fields[2] != "790" {
+		t.Errorf("Expected (1400,790) Got (%v,%v)", fields[1], fields[2])
+	}
 }
 
-func benchmarkPipeline(nWorkers, nImages int, b *testing.B) {
-	// TODO: refactor - nWorkers is not being used
-	s := strings.Repeat(testImageURL200+"\n", nImages)
-	for n := 0; n < b.N; n++ {
-		buff := new(bytes.Buffer)
-		imageURLs := strings.NewReader(s)
-		pipeline, err := NewPipeline(testPipeConfig).
-			WithClient(testClient).
-			WithSource(imageURLs).
-			WithOutput(buff).
-			Init()
-		if err != nil {
-			b.Fatal(err)
+func TestPipelineRunInMemory(t *testing.T) {
+	// Test the pipeline produces the same output when decoding in memory
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(b).
+		WithInMemory(true).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	fields := strings.Split(strings.TrimSpace(b.String()), ",")
+	if len(fields) != 6 || fields[1] != "1400" || fields[2] != "790" {
+		t.Errorf("Expected (result for valid image) Got (%v)", fields)
+	}
+}
+
+func TestPipelineRunInMemoryCorrupt(t *testing.T) {
+	// Test an image that fails to decode in memory is a summarize error, which isn't downloaded again
+	data, err := ioutil.ReadFile(testImagePathValid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write(data[:len(data)/2])
+	}))
+	defer s.Close()
+
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader(s.URL + "/corrupt.jpg")).
+		WithOutput(new(bytes.Buffer)).
+		WithInMemory(true).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, _ := pipeline.Run()
+	if result.Failures[RqErrorSummarize] != 1 || result.Errors[RqErrorDownload] != 0 {
+		t.Errorf("Expected (1 summarize failure, no download errors) Got (%+v)", result)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected (1 request) Got (%v)", n)
+	}
+}
+
+func TestPipelineRunLastJobFails(t *testing.T) {
+	// Test the pipeline stops when the last job to finish fails, which stops the workers from the error handler
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200 + "\n" + testImageURL404)).
+		WithOutput(b).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	done := make(chan RunResult)
+	go func() {
+		result, _ := pipeline.Run()
+		done <- result
+	}()
+
+	select {
+	case result := <-done:
+		if result.Succeeded != 1 || result.Failed != 1 {
+			t.Errorf("Expected (1 succeeded, 1 failed) Got (%v succeeded, %v failed)", result.Succeeded, result.Failed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected (Run to return) Got (timeout)")
+	}
+}
+
+func TestPipelineRunContextCancel(t *testing.T) {
+	// Test that cancelling the context stops a pipeline that's stuck on slow downloads
+	s := strings.Repeat("http://www.test.com/slow\n", 10)
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(s)).
+		WithOutput(b).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		pipeline.RunContext(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected (RunContext to return after cancel) Got (timeout)")
+	}
+	if b.Len() != 0 {
+		t.Errorf("Expected (no results) Got (%v)", b.String())
+	}
+}
+
+func TestPipelineRunTimeout(t *testing.T) {
+	// Test the timeout set on the pipeline fails slow downloads, without changing the client it was given
+	errOut := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithTimeout(50 * time.Millisecond).
+		WithSource(strings.NewReader("http://www.test.com/slow")).
+		WithOutput(new(bytes.Buffer)).
+		WithErrorOutput(errOut).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	start := time.Now()
+	result, _ := pipeline.Run()
+	if result.Failed != 1 {
+		t.Errorf("Expected (1 failed) Got (%v)", result.Failed)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected (downloads to time out after 50ms) Got (%v)", elapsed)
+	}
+	if testClient.Timeout != DefaultTimeout {
+		t.Errorf("Expected (%v) Got (%v)", DefaultTimeout, testClient.Timeout)
+	}
+}
+
+func TestPipelineRunDeadline(t *testing.T) {
+	// Test that the deadline stops the pipeline and every url is recorded as unprocessed
+	const nURLs = 10
+	s := strings.Repeat("http://www.test.com/slow\n", nURLs)
+	b := new(bytes.Buffer)
+	errOut := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(s)).
+		WithOutput(b).
+		WithErrorOutput(errOut).
+		WithDeadline(100 * time.Millisecond).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	done := make(chan RunResult)
+	go func() {
+		result, err := pipeline.Run()
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected (%v) Got (%v)", context.DeadlineExceeded, err)
 		}
+		done <- result
+	}()
 
-		pipeline.Run()
+	select {
+	case result := <-done:
+		if result.Skipped != nURLs || result.Succeeded != 0 {
+			t.Errorf("Expected (%v skipped) Got (%+v)", nURLs, result)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected (Run to return after deadline) Got (timeout)")
+	}
+
+	lines := strings.Split(strings.TrimSpace(errOut.String()), "\n")
+	if len(lines) != nURLs {
+		t.Fatalf("Expected (%v unprocessed urls) Got (%v)", nURLs, lines)
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "http://www.test.com/slow,") {
+			t.Errorf("Expected (line for slow url) Got (%v)", line)
+		}
 	}
 }
 
-func BenchmarkPipeline_1Workers_10Images(b *testing.B) {
-	benchmarkPipeline(1, 10, b)
+func TestPipelineRunErrorOutput(t *testing.T) {
+	// Test that failed urls are written to the error output
+	b := new(bytes.Buffer)
+	errOut := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL404 + "\n" + testImageURL200)).
+		WithOutput(b).
+		WithErrorOutput(errOut).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	expected := testImageURL404 + ",Url invalid (statusCode 404),404," + testImageURL404 + "\n"
+	if errOut.String() != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, errOut.String())
+	}
 }
 
-func BenchmarkPipeline_3Workers_10Images(b *testing.B) {
-	benchmarkPipeline(1, 10, b)
+type failingWriter struct{}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestPipelineRunOutputFails(t *testing.T) {
+	// Test that a broken output stops the pipeline and the error is returned from Run
+	s := strings.Repeat(testImageURL200+"\n", 5)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(s)).
+		WithOutput(failingWriter{}).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := pipeline.Run()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "disk full") {
+			t.Errorf("Expected (write error) Got (%v)", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected (Run to return after write error) Got (timeout)")
+	}
+}
+
+func TestPipelineRunSkipsBlankAndCommentLines(t *testing.T) {
+	s := strings.Join([]string{
+		"# images to summarize",
+		"",
+		"   ",
+		"#" + testImageURL404,
+		"  " + testImageURL200 + "  ",
+		"",
+	}, "\n")
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(s)).
+		WithOutput(b).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, err := pipeline.Run()
+	if err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+	if result.Succeeded != 1 || result.Failed != 0 {
+		t.Errorf("Expected (1 succeeded, 0 failed) Got (%+v)", result)
+	}
+	if read := pipeline.Stats().Read; read != 1 {
+		t.Errorf("Expected (1 read) Got (%v)", read)
+	}
+}
+
+func TestPipelineRunLimit(t *testing.T) {
+	// Test comments don't count toward the limit and urls after it aren't processed
+	s := "# first\n" + strings.Repeat(testImageURL200+"\n", 3) + testImageURL404 + "\n"
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(s)).
+		WithOutput(b).
+		WithLimit(3).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, err := pipeline.Run()
+	if err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+	if result.Succeeded != 3 || result.Failed != 0 {
+		t.Errorf("Expected (3 succeeded, 0 failed) Got (%+v)", result)
+	}
+	if read := pipeline.Stats().Read; read != 3 {
+		t.Errorf("Expected (3 read) Got (%v)", read)
+	}
+}
+
+func TestPipelineRunLongLine(t *testing.T) {
+	// Test lines longer than the scanner's default 64KB are read, and a line over the maximum fails the run
+	long := testImageURL200 + "?q=" + strings.Repeat("a", 70*1024)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200 + "\n" + long + "\n")).
+		WithOutput(new(bytes.Buffer)).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, err := pipeline.Run()
+	if err != nil || result.Succeeded != 2 {
+		t.Errorf("Expected (2 succeeded) Got (%+v, %v)", result, err)
+	}
+
+	pipeline.WithSource(strings.NewReader(testImageURL200 + "\n" + long + "\n" + testImageURL200 + "\n")).
+		WithMaxLineLength(64 * 1024)
+	result, err = pipeline.Run()
+	if err == nil || !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("Expected (%v) Got (%v)", bufio.ErrTooLong, err)
+	}
+	if result.Succeeded != 1 {
+		t.Errorf("Expected (1 succeeded before the long line) Got (%+v)", result)
+	}
+}
+
+func TestPipelineRunCSVSourceReadError(t *testing.T) {
+	// Test a CSV source that fails partway through fails the run after the rows before it are done
+	readErr := errors.New("connection reset")
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithCSVSource(io.MultiReader(strings.NewReader(testImageURL200+"\n"), iotest.ErrReader(readErr)), 0, false).
+		WithOutput(new(bytes.Buffer)).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, err := pipeline.Run()
+	if !errors.Is(err, readErr) {
+		t.Errorf("Expected (%v) Got (%v)", readErr, err)
+	}
+	if result.Succeeded != 1 {
+		t.Errorf("Expected (1 succeeded before the error) Got (%+v)", result)
+	}
+}
+
+func TestMakePipelineNegativeLimit(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithLimit(-1).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestMakePipelineConnsBelowPerHost(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithMaxConcurrentHosts(4).
+		WithMaxConnsPerHost(2).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestPipelineRunCSVSource(t *testing.T) {
+	// Test reading urls from a CSV column, where bad rows are rejected without stalling the pipeline
+	s := strings.Join([]string{
+		"id,name,url",
+		"1,blank,",
+		"2,short",
+		"3,valid," + testImageURL200,
+	}, "\n")
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithCSVSource(strings.NewReader(s), 2, true).
+		WithOutput(b).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], testImageURL200+",") {
+		t.Errorf("Expected (1 result for %v) Got (%v)", testImageURL200, lines)
+	}
+}
+
+// Run nImages distinct urls through a pipeline with nWorkers download workers, against a server that
+// takes benchmarkLatency to answer each request like a remote host would. There's a summarize worker per
+// CPU, so the download workers are what's being varied
+func benchmarkPipeline(nWorkers, nImages int, b *testing.B) {
+	s := newImageServer(b, benchmarkLatency)
+	defer s.Close()
+	urls := new(strings.Builder)
+	for i := 0; i < nImages; i++ {
+		fmt.Fprintf(urls, "%v/%v.jpg\n", s.URL, i)
+	}
+	cfg := PipeConfig{Download: nWorkers, Summarize: runtime.NumCPU(), Cleanup: 1}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		buff := new(bytes.Buffer)
+		pipeline, err := NewPipeline(cfg).
+			WithSource(strings.NewReader(urls.String())).
+			WithOutput(buff).
+			Init()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if result, err := pipeline.Run(); err != nil || result.Succeeded != uint64(nImages) {
+			b.Fatalf("Expected (%v succeeded) Got (%+v, %v)", nImages, result, err)
+		}
+	}
+}
+
+const benchmarkLatency = 20 * time.Millisecond
+
+func BenchmarkPipeline_1Workers_10Images(b *testing.B) {
+	benchmarkPipeline(1, 10, b)
+}
+
+func BenchmarkPipeline_3Workers_10Images(b *testing.B) {
+	benchmarkPipeline(3, 10, b)
+}
+
+func BenchmarkPipeline_10Workers_10Images(b *testing.B) {
+	benchmarkPipeline(10, 10, b)
+}
+
+func BenchmarkPipeline_1Workers_50Images(b *testing.B) {
+	benchmarkPipeline(1, 50, b)
+}
+
+func BenchmarkPipeline_3Workers_50Images(b *testing.B) {
+	benchmarkPipeline(3, 50, b)
+}
+
+func BenchmarkPipeline_10Workers_50Images(b *testing.B) {
+	benchmarkPipeline(10, 50, b)
+}
+
+func BenchmarkPipeline_25Workers_50Images(b *testing.B) {
+	benchmarkPipeline(25, 50, b)
+}
+
+func TestPipelineRunHeader(t *testing.T) {
+	// Test the header is written once before any results
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL404 + "\n" + testImageURL200)).
+		WithOutput(b).
+		WithHeader(true).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected (header and 1 result) Got (%v)", lines)
+	}
+	if lines[0] != "url,width,height,color1,color2,color3" {
+		t.Errorf("Expected (url,width,height,color1,color2,color3) Got (%v)", lines[0])
+	}
+}
+
+func TestPipelineRunDelimiter(t *testing.T) {
+	// Test the header and results are tab separated
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(b).
+		WithHeader(true).
+		WithDelimiter('\t').
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected (header and 1 result) Got (%v)", lines)
+	}
+	if lines[0] != "url\twidth\theight\tcolor1\tcolor2\tcolor3" {
+		t.Errorf("Expected (tab separated header) Got (%q)", lines[0])
+	}
+	if fields := strings.Split(lines[1], "\t"); len(fields) != 6 || fields[0] != testImageURL200 {
+		t.Errorf("Expected (6 tab separated fields) Got (%q)", lines[1])
+	}
+}
+
+func TestMakePipelineBadDelimiter(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithOutput(new(bytes.Buffer)).
+		WithDelimiter('"').
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestPipelineRunOrderedOutput(t *testing.T) {
+	// Test results are written in source order even with many workers
+	urls := []string{}
+	for i := 0; i < 8; i += 1 {
+		urls = append(urls, testImageURL200+"?"+strconv.Itoa(i))
+	}
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(PipeConfig{Download: 4, Summarize: 4, Cleanup: 2}).
+		WithClient(testClient).
+		WithSource(strings.NewReader(strings.Join(urls, "\n"))).
+		WithOutput(b).
+		WithOrderedOutput(len(urls)).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != len(urls) {
+		t.Fatalf("Expected (%v results) Got (%v)", len(urls), lines)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, urls[i]+",") {
+			t.Errorf("Expected (%v first) Got (%v)", urls[i], line)
+		}
+	}
+}
+
+func TestPipelineDownloadImageLocalPath(t *testing.T) {
+	// Test that local paths (bare or file://) are read in place rather than downloaded
+	abs, err := filepath.Abs(testImagePathValid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, imgURL := range []string{testImagePathValid, "file://" + filepath.ToSlash(abs)} {
+		outChn := make(chan RqJob, 1)
+		errorChn := make(chan RqError, 1)
+		job := RqJob{image: NewRqImage(imgURL), nextChn: outChn}
+		downloadImage(context.Background(), job, testDownloader, errorChn)
+
+		jobOut, err := getJobChn(outChn)
+		if err != nil {
+			t.Fatalf("Expected (job in out chn for %v) Got (%v)", imgURL, err)
+		}
+		if jobOut.image.filePath != "" || jobOut.image.localPath == "" {
+			t.Errorf("Expected (local path only) Got (filePath %q localPath %q)", jobOut.image.filePath, jobOut.image.localPath)
+		}
+
+		// cleanup must leave files it didn't create
+		cleanupChn := make(chan RqJob, 1)
+		jobOut.nextChn = cleanupChn
+		cleanupImage(context.Background(), jobOut, errorChn)
+		if !fileExists(testImagePathValid) {
+			t.Fatalf("Expected (%v to still exist) Got (removed)", testImagePathValid)
+		}
+	}
+}
+
+func TestPipelineDownloadImageLocalPathMissing(t *testing.T) {
+	outChn := make(chan RqJob, 1)
+	errorChn := make(chan RqError, 1)
+	job := RqJob{image: NewRqImage(testImagePathInvalid), nextChn: outChn}
+	downloadImage(context.Background(), job, testDownloader, errorChn)
+
+	rqErr, err := getErrorChn(errorChn)
+	if err != nil {
+		t.Fatalf("Expected (error in error chn) Got (%v)", err)
+	}
+	if rqErr.errorType != RqErrorNoRetry {
+		t.Errorf("Expected (%v) Got (%v)", RqErrorNoRetry, rqErr.errorType)
+	}
+}
+
+func TestPipelineRunLocalPath(t *testing.T) {
+	for _, inMemory := range []bool{false, true} {
+		b := new(bytes.Buffer)
+		pipeline, err := NewPipeline(testPipeConfig).
+			WithClient(testClient).
+			WithSource(strings.NewReader(testImagePathValid)).
+			WithOutput(b).
+			WithInMemory(inMemory).
+			Init()
+
+		if err != nil {
+			t.Fatalf("Expected (nil) Got (%v)", err)
+		}
+
+		pipeline.Run()
+		fields := strings.Split(strings.TrimSpace(b.String()), ",")
+		if len(fields) != 6 || fields[1] != "1400" || fields[2] != "790" {
+			t.Errorf("Expected (result for local image, inMemory %v) Got (%v)", inMemory, fields)
+		}
+	}
+	if !fileExists(testImagePathValid) {
+		t.Errorf("Expected (%v to still exist) Got (removed)", testImagePathValid)
+	}
+}
+
+func TestPipelineRunDirectory(t *testing.T) {
+	// Test images under a directory are summarized in place with their relative paths as urls
+	dir, err := ioutil.TempDir("", "rquent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content, err := ioutil.ReadFile(testImagePathValid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	for _, name := range []string{"a.jpg", "sub/b.jpg", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithDirectory(dir, "*.jpg").
+		WithOutput(b).
+		WithOrderedOutput(10).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "a.jpg,1400,790,") || !strings.HasPrefix(lines[1], "sub/b.jpg,1400,790,") {
+		t.Errorf("Expected (results for a.jpg and sub/b.jpg) Got (%v)", lines)
+	}
+	if !fileExists(filepath.Join(dir, "sub", "b.jpg")) {
+		t.Errorf("Expected (sub/b.jpg to still exist) Got (removed)")
+	}
+}
+
+func TestPipelineRunDirectoryMissing(t *testing.T) {
+	// Test a root directory that can't be read fails the run
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithDirectory(filepath.Join(os.TempDir(), "rquent-missing-dir"), "").
+		WithOutput(new(bytes.Buffer)).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, err := pipeline.Run()
+	if !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("Expected (not exist error) Got (%v)", err)
+	}
+	if result.Succeeded != 0 {
+		t.Errorf("Expected (0 succeeded) Got (%v)", result.Succeeded)
+	}
+}
+
+func TestMakePipelineDirectoryBadPattern(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithDirectory(".", "[").
+		WithOutput(new(bytes.Buffer)).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestPipelineRunDryRun(t *testing.T) {
+	// Test a dry run writes a line for reachable images and fails the rest
+	b := new(bytes.Buffer)
+	errs := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImagePathInvalid + "\n" + testImageURL200)).
+		WithOutput(b).
+		WithErrorOutput(errs).
+		WithDryRun(true).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, _ := pipeline.Run()
+	if result.Succeeded != 1 || result.Failed != 1 {
+		t.Errorf("Expected (1 succeeded 1 failed) Got (%+v)", result)
+	}
+	if !strings.HasPrefix(b.String(), testImageURL200+",image/jpeg,") {
+		t.Errorf("Expected (content type for %v) Got (%v)", testImageURL200, b.String())
+	}
+	if !strings.HasPrefix(errs.String(), testImagePathInvalid+",") {
+		t.Errorf("Expected (failure for %v) Got (%v)", testImagePathInvalid, errs.String())
+	}
+}
+
+func TestPipelineRunBuffered(t *testing.T) {
+	// Test the pipeline completes when stages are buffered
+	urls := []string{}
+	for i := 0; i < 4; i += 1 {
+		urls = append(urls, testImageURL200+"?"+strconv.Itoa(i))
+	}
+	cfg := PipeConfig{
+		Download:        2,
+		Summarize:       1,
+		Cleanup:         1,
+		DownloadBuffer:  4,
+		SummarizeBuffer: 2,
+		CleanupBuffer:   2,
+		SaveBuffer:      2,
+	}
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(cfg).
+		WithClient(testClient).
+		WithSource(strings.NewReader(strings.Join(urls, "\n"))).
+		WithOutput(b).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, err := pipeline.Run()
+	if err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+	if result.Succeeded != uint64(len(urls)) {
+		t.Errorf("Expected (%v succeeded) Got (%v)", len(urls), result.Succeeded)
+	}
+}
+
+func TestPipelineRetryPolicy(t *testing.T) {
+	// Test summarize errors fail fast by default, and a custom policy can retry them
+	for _, test := range []struct {
+		policy  RetryPolicy
+		retried bool
+	}{
+		{DefaultRetryPolicy, false},
+		{RetryAll, true},
+	} {
+		pipeline := NewPipeline(testPipeConfig).WithRetryPolicy(test.policy)
+		retryChn := make(chan RqJob, 1)
+		job := RqJob{image: NewRqImage(testImageURL200), retryChn: retryChn}
+		pipeline.handleError(NewRqError(job, RqErrorSummarize, "bad image"))
+
+		_, err := getJobChn(retryChn)
+		if retried := err == nil; retried != test.retried {
+			t.Errorf("Expected (retried %v) Got (%v)", test.retried, retried)
+		}
+		if failed := pipeline.Stats().Failed; failed != 1 && !test.retried {
+			t.Errorf("Expected (1 failed) Got (%v)", failed)
+		}
+	}
+}
+
+// summarizer that reports the color of the top-left pixel
+type cornerSummarizer struct{}
+
+type cornerSummary struct {
+	Corner string `json:"corner"`
+}
+
+func (s cornerSummary) Fields() []string {
+	return []string{s.Corner}
+}
+
+func (cornerSummarizer) Summarize(img image.Image) (Summary, error) {
+	bounds := img.Bounds()
+	c := color.NRGBAModel.Convert(img.At(bounds.Min.X, bounds.Min.Y)).(color.NRGBA)
+	return cornerSummary{hexify(c)}, nil
+}
+
+func (cornerSummarizer) Columns() []string {
+	return []string{"corner"}
+}
+
+func TestPipelineRunSummarizer(t *testing.T) {
+	// Test a custom summarizer replaces the prevalent colors in the output
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(b).
+		WithHeader(true).
+		WithSummarizer(cornerSummarizer{}).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected (header and 1 result) Got (%v)", lines)
+	}
+	if lines[0] != "url,width,height,corner" {
+		t.Errorf("Expected (url,width,height,corner) Got (%v)", lines[0])
+	}
+	fields := strings.Split(lines[1], ",")
+	if len(fields) != 4 || !strings.HasPrefix(fields[3], "#") {
+		t.Errorf("Expected (url,width,height,#corner) Got (%v)", lines[1])
+	}
+}
+
+// summarizer that panics, like a decoder choking on a corrupt file
+type panicSummarizer struct{ cornerSummarizer }
+
+func (panicSummarizer) Summarize(img image.Image) (Summary, error) {
+	panic("corrupt image")
+}
+
+func TestPipelineRunRecoversPanic(t *testing.T) {
+	// Test a panic while summarizing fails the job without retrying instead of crashing the run
+	b := new(bytes.Buffer)
+	errOut := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(b).
+		WithErrorOutput(errOut).
+		WithSummarizer(panicSummarizer{}).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	stats := pipeline.Stats()
+	if stats.Failed != 1 || stats.Errors[RqErrorNoRetry] != 1 {
+		t.Errorf("Expected (1 failed without retrying) Got (%v failed, errors %v)", stats.Failed, stats.Errors)
+	}
+	if !strings.Contains(errOut.String(), "corrupt image") {
+		t.Errorf("Expected (panic in error output) Got (%v)", errOut.String())
+	}
+}
+
+func TestPipelineStopsWhenLastJobFinishesBeforeReader(t *testing.T) {
+	// Test the reader stops the workers if the last job finished before the source was marked as read
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithOutput(new(bytes.Buffer)).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	// the job is enqueued and finishes while the reader is still going
+	atomic.AddUint64(&pipeline.imageCount, 1)
+	atomic.AddUint64(&pipeline.imageCount, ^uint64(0))
+	if pipeline.stopIfDone() {
+		t.Fatalf("Expected (not done before the source is read) Got (done)")
+	}
+
+	pipeline.pool.wg.Add(1)
+	pipeline.finishReadURLs()
+	select {
+	case <-pipeline.pool.doneChn:
+	default:
+		t.Errorf("Expected (workers stopped) Got (doneChn open)")
+	}
+}
+
+func TestPipelineRunResultChannel(t *testing.T) {
+	// Test results are sent on the channel instead of being written, and the channel is closed at the end
+	results := make(chan RqImage)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL404 + "\n" + testImageURL200)).
+		WithResultChannel(results).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	go pipeline.Run()
+	var received []RqImage
+	for img := range results {
+		received = append(received, img)
+	}
+	if len(received) != 1 {
+		t.Fatalf("Expected (1 result) Got (%v)", len(received))
+	}
+	img := received[0]
+	if img.URL != testImageURL200 || img.Width() != 1400 || img.Height() != 790 || len(img.Summary().Colors) != 3 {
+		t.Errorf("Expected (summarized valid image) Got (%v %vx%v %v)", img.URL, img.Width(), img.Height(), img.Summary())
+	}
+}
+
+func TestPipelineRunAgain(t *testing.T) {
+	// Test a pipeline runs a second batch with fresh counters, without repeating the header
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(b).
+		WithHeader(true).
+		WithOrderedOutput(2).
+		Init()
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	if result, err := pipeline.Run(); err != nil || result.Succeeded != 1 {
+		t.Errorf("Expected (1 succeeded) Got (%+v, %v)", result, err)
+	}
+	result, err := pipeline.WithSource(strings.NewReader(testImageURL200 + "\n" + testImageURL404)).Run()
+	if err != nil || result.Succeeded != 1 || result.Failed != 1 {
+		t.Errorf("Expected (1 succeeded, 1 failed) Got (%+v, %v)", result, err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "url,") || !strings.HasPrefix(lines[2], testImageURL200+",") {
+		t.Errorf("Expected (header and 2 results) Got (%v)", lines)
+	}
+
+	// a new output gets its own header
+	b2 := new(bytes.Buffer)
+	pipeline.WithOutput(b2).WithSource(strings.NewReader(testImageURL200)).Run()
+	if lines := strings.Split(strings.TrimSpace(b2.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "url,") {
+		t.Errorf("Expected (header and 1 result) Got (%v)", lines)
+	}
+}
+
+func TestPipelineRunAgainResultChannel(t *testing.T) {
+	// Test the closed result channel has to be replaced to run again
+	run := func(pipeline *RqPipeline, results chan RqImage) (int, error) {
+		n := 0
+		done := make(chan struct{})
+		go func() {
+			for range results {
+				n += 1
+			}
+			close(done)
+		}()
+		_, err := pipeline.Run()
+		if err == nil {
+			<-done
+		}
+		return n, err
+	}
+	results := make(chan RqImage)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithResultChannel(results).
+		Init()
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if n, err := run(pipeline, results); n != 1 || err != nil {
+		t.Errorf("Expected (1 result) Got (%v, %v)", n, err)
+	}
+
+	pipeline.WithSource(strings.NewReader(testImageURL200))
+	if _, err := pipeline.Run(); err == nil {
+		t.Errorf("Expected (error for closed result channel) Got (nil)")
+	}
+	results = make(chan RqImage)
+	if n, err := run(pipeline.WithResultChannel(results), results); n != 1 || err != nil {
+		t.Errorf("Expected (1 result) Got (%v, %v)", n, err)
+	}
+}
+
+func TestMakePipelineResultChannelOrdered(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithResultChannel(make(chan RqImage)).
+		WithOrderedOutput(10).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestPipelineRunDownloadBudget(t *testing.T) {
+	// Test downloads stop once the budget is used up and the remaining urls are recorded as unprocessed
+	s := strings.Repeat(testImageURL200+"\n", 3)
+	b := new(bytes.Buffer)
+	errOut := new(bytes.Buffer)
+	cfg := DefaultDownloadConfig
+	cfg.MaxTotalBytes = 1
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(s)).
+		WithOutput(b).
+		WithErrorOutput(errOut).
+		WithDownloadConfig(cfg).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, _ := pipeline.Run()
+	if result.Succeeded != 1 || result.Skipped != 2 {
+		t.Errorf("Expected (1 succeeded, 2 skipped) Got (%+v)", result)
+	}
+	if n := strings.Count(errOut.String(), "unprocessed: download budget reached"); n != 2 {
+		t.Errorf("Expected (2 unprocessed urls) Got (%v)", errOut.String())
+	}
+}
+
+func TestPipelineRunRotatingOutput(t *testing.T) {
+	// Test results are split across files with the header at the top of each
+	dir, err := ioutil.TempDir("", "rquent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := strings.Repeat(testImageURL200+"\n", 5)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(s)).
+		WithRotatingOutput(dir, 2).
+		WithHeader(true).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, _ := pipeline.Run()
+	if result.Succeeded != 5 {
+		t.Errorf("Expected (5 succeeded) Got (%+v)", result)
+	}
+	expectedLines := []int{3, 3, 2}
+	for i, expected := range expectedLines {
+		content, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("results.%03d.csv", i)))
+		if err != nil {
+			t.Fatalf("Expected (nil) Got (%v)", err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		if len(lines) != expected || !strings.HasPrefix(lines[0], "url,") {
+			t.Errorf("Expected (header and %v results in file %v) Got (%v)", expected-1, i, lines)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "results.003.csv")); !os.IsNotExist(err) {
+		t.Errorf("Expected (3 files) Got (%v)", err)
+	}
+}
+
+func TestPipelineRunOutputs(t *testing.T) {
+	// Test every output gets the same results, including one that buffers on its own
+	s := strings.Repeat(testImageURL200+"\n", 3)
+	first := new(bytes.Buffer)
+	second := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(s)).
+		WithOutputs(first, bufio.NewWriter(second)).
+		WithHeader(true).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, _ := pipeline.Run()
+	if result.Succeeded != 3 {
+		t.Errorf("Expected (3 succeeded) Got (%+v)", result)
+	}
+	if lines := strings.Count(first.String(), "\n"); lines != 4 {
+		t.Errorf("Expected (header and 3 results) Got (%q)", first.String())
+	}
+	if first.String() != second.String() {
+		t.Errorf("Expected (%q) Got (%q)", first.String(), second.String())
+	}
+}
+
+func TestMakePipelineNoOutputs(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithOutputs().
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+	_, err = NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithOutputs(new(bytes.Buffer), nil).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestMakePipelineRotatingOutputBadLines(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithRotatingOutput(os.TempDir(), 0).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestPipelineRunStartupJitter(t *testing.T) {
+	// Test staggered workers still process every url
+	s := strings.Repeat(testImageURL200+"\n", 4)
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(s)).
+		WithOutput(b).
+		WithStartupJitter(50 * time.Millisecond).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, _ := pipeline.Run()
+	if result.Succeeded != 4 {
+		t.Errorf("Expected (4 succeeded) Got (%+v)", result)
+	}
+}
+
+func TestMakePipelineNegativeStartupJitter(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithOutput(new(bytes.Buffer)).
+		WithStartupJitter(-time.Second).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestRequeueDelay(t *testing.T) {
+	for _, test := range []struct {
+		delay    time.Duration
+		max      time.Duration
+		nFails   int
+		expected time.Duration
+	}{
+		{0, 0, 1, 0},
+		{time.Second, 0, 3, time.Second},
+		{time.Second, 10 * time.Second, 1, time.Second},
+		{time.Second, 10 * time.Second, 3, 4 * time.Second},
+		{time.Second, 10 * time.Second, 9, 10 * time.Second},
+	} {
+		pipeline := NewPipeline(testPipeConfig).WithRetryDelay(test.delay, test.max)
+		if got := pipeline.requeueDelay(test.nFails); got != test.expected {
+			t.Errorf("Expected (%v) Got (%v)", test.expected, got)
+		}
+	}
+}
+
+func TestPipelineRetryDelay(t *testing.T) {
+	// Test a failed job is requeued after the delay without blocking the error handler
+	pipeline := NewPipeline(testPipeConfig).WithRetryDelay(50*time.Millisecond, 0)
+	pipeline.pool.ctx = context.Background()
+	retryChn := make(chan RqJob)
+	job := RqJob{image: NewRqImage(testImageURL200), retryChn: retryChn}
+	start := time.Now()
+	pipeline.handleError(NewRqError(job, RqErrorDownload, "connection reset"))
+
+	select {
+	case <-retryChn:
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("Expected (requeued after 50ms) Got (%v)", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected (job requeued) Got (nothing)")
+	}
+	pipeline.pool.wg.Wait()
+}
+
+func TestPipelineRunTimings(t *testing.T) {
+	// Test each finished image has the time it spent in each stage
+	results := make(chan RqImage)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithResultChannel(results).
+		WithTimings(true).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	go pipeline.Run()
+	for img := range results {
+		timings, ok := img.Timings()
+		if !ok || timings.Download <= 0 || timings.Summarize <= 0 {
+			t.Errorf("Expected (positive timings) Got (%+v, %v)", timings, ok)
+		}
+	}
+}
+
+func TestPipelineRunDecoder(t *testing.T) {
+	// Test images in a format the image package doesn't recognize are decoded with a registered decoder
+	f, err := ioutil.TempFile("", "rquent-*.fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("FAKE\x00\x00\xff")
+	f.Close()
+
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(f.Name())).
+		WithOutput(b).
+		WithSummarizeConfig(SummarizeConfig{K: 1}).
+		WithDecoder("fake", func(io.Reader) (image.Image, error) { return nil, errors.New("replaced") }).
+		WithDecoder("fake", decodeFake).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	expected := f.Name() + ",3,2,#0000ff\n"
+	if b.String() != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, b.String())
+	}
+}
+
+func TestPipelineRunMaxPixels(t *testing.T) {
+	// Test an image declaring too many pixels fails without being retried, saved or in memory
+	uri := "data:image/png;base64," + base64.StdEncoding.EncodeToString(newOversizedPNG(100000, 100000))
+	for _, inMemory := range []bool{false, true} {
+		pipeline, err := NewPipeline(testPipeConfig).
+			WithSource(strings.NewReader(uri)).
+			WithOutput(ioutil.Discard).
+			WithInMemory(inMemory).
+			WithSummarizeConfig(SummarizeConfig{K: 1, MaxPixels: 1 << 24}).
+			Init()
+		if err != nil {
+			t.Fatalf("Expected (nil) Got (%v)", err)
+		}
+
+		result, _ := pipeline.Run()
+		if result.Failed != 1 || result.Errors[RqErrorNoRetry] != 1 || result.Retried != 0 {
+			t.Errorf("Expected (1 failed without retrying, inMemory %v) Got (%+v)", inMemory, result)
+		}
+	}
+}
+
+func TestMakePipelineNilDecoder(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithDecoder("fake", nil).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
+
+func TestPipelineRunSize(t *testing.T) {
+	// Test each image's size is its downloaded bytes, whether it's saved, decoded in memory or local
+	info, err := os.Stat(testImagePathValid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range []string{testImageURL200, testImagePathValid} {
+		for _, inMemory := range []bool{false, true} {
+			b := new(bytes.Buffer)
+			pipeline, err := NewPipeline(testPipeConfig).
+				WithClient(testClient).
+				WithSource(strings.NewReader(source)).
+				WithOutput(b).
+				WithInMemory(inMemory).
+				WithSize(true).
+				Init()
+			if err != nil {
+				t.Fatalf("Expected (nil) Got (%v)", err)
+			}
+
+			pipeline.Run()
+			fields := strings.Split(b.String(), ",")
+			if len(fields) < 4 || fields[3] != strconv.FormatInt(info.Size(), 10) {
+				t.Errorf("Expected (size %v for %v, inMemory %v) Got (%v)", info.Size(), source, inMemory, b.String())
+			}
+		}
+	}
+}
+
+func TestPipelineRunImageFormat(t *testing.T) {
+	// Test the decoded format is recorded whether the image is saved or decoded in memory
+	for _, inMemory := range []bool{false, true} {
+		b := new(bytes.Buffer)
+		pipeline, err := NewPipeline(testPipeConfig).
+			WithClient(testClient).
+			WithSource(strings.NewReader(testImageURL200)).
+			WithOutput(b).
+			WithInMemory(inMemory).
+			WithImageFormat(true).
+			Init()
+		if err != nil {
+			t.Fatalf("Expected (nil) Got (%v)", err)
+		}
+
+		pipeline.Run()
+		fields := strings.Split(b.String(), ",")
+		if len(fields) < 4 || fields[3] != "jpeg" {
+			t.Errorf("Expected (format jpeg, inMemory %v) Got (%v)", inMemory, b.String())
+		}
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	for _, test := range []struct {
+		url      string
+		expected string // "" if invalid
+	}{
+		{"http://a.com/x.jpg", "http://a.com/x.jpg"},
+		{"HTTPS://a.com/x.jpg?sig=a,b", "HTTPS://a.com/x.jpg?sig=a,b"},
+		{"www.example.com/x.jpg", "https://www.example.com/x.jpg"},
+		{"www.example.com:8080/x.jpg", "https://www.example.com:8080/x.jpg"},
+		{"images/x.jpg", "images/x.jpg"},
+		{"x.jpg", "x.jpg"},
+		{"/tmp/x.jpg", "/tmp/x.jpg"},
+		{"file:///tmp/x.jpg", "file:///tmp/x.jpg"},
+		{`C:\images\x.jpg`, `C:\images\x.jpg`},
+		{"data:image/png;base64,AAAA", "data:image/png;base64,AAAA"},
+		{"http:///x.jpg", ""},
+		{"ftp://a.com/x.jpg", ""},
+		{"http://a.com/%zz", ""},
+	} {
+		got, err := normalizeURL(test.url)
+		if test.expected == "" && err == nil {
+			t.Errorf("Expected (error for %v) Got (%v)", test.url, got)
+		} else if test.expected != "" && got != test.expected {
+			t.Errorf("Expected (%v) Got (%v, %v)", test.expected, got, err)
+		}
+	}
+}
+
+func TestPipelineRunInvalidURLs(t *testing.T) {
+	// Test invalid urls are recorded as unprocessed without being downloaded
+	s := "ftp://a.com/x.jpg\n" + testImageURL200 + "\nhttp:///x.jpg\n"
+	b := new(bytes.Buffer)
+	errOut := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(s)).
+		WithOutput(b).
+		WithErrorOutput(errOut).
+		WithOrderedOutput(10).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, _ := pipeline.Run()
+	if result.Succeeded != 1 || result.Skipped != 2 || pipeline.Stats().Downloaded != 1 {
+		t.Errorf("Expected (1 succeeded, 2 skipped, 1 downloaded) Got (%+v, %+v)", result, pipeline.Stats())
+	}
+	if n := strings.Count(errOut.String(), "unprocessed: invalid url"); n != 2 {
+		t.Errorf("Expected (2 invalid urls) Got (%v)", errOut.String())
+	}
 }
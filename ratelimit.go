@@ -0,0 +1,125 @@
+package rquent
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spaces out events so they happen at most a fixed number of times per second; safe for concurrent use
+// A nil limiter never waits
+type rateLimiter struct {
+	mux      sync.Mutex
+	interval time.Duration
+	next     time.Time // earliest time the next event may happen
+}
+
+// Create a limiter allowing perSecond events per second; returns nil (no limit) if perSecond <= 0
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / perSecond),
+	}
+}
+
+// Block until the next event is allowed or the context is done
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+
+	// reserve the next slot
+	l.mux.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mux.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Caps the number of simultaneous downloads from each host; safe for concurrent use
+// A nil limiter never waits
+type hostLimiter struct {
+	mux   sync.Mutex
+	max   int
+	hosts map[string]*hostSlots
+}
+
+// Semaphore for one host, removed once nothing holds or waits on it
+type hostSlots struct {
+	slots chan struct{}
+	users int
+}
+
+// Create a limiter allowing max simultaneous downloads per host; returns nil (no limit) if max <= 0
+func newHostLimiter(max int) *hostLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &hostLimiter{
+		max:   max,
+		hosts: make(map[string]*hostSlots),
+	}
+}
+
+// Block until there's a free slot for the host of rawURL or the context is done
+// The returned function releases the slot and must be called once the download is finished
+func (l *hostLimiter) Acquire(ctx context.Context, rawURL string) (func(), error) {
+	if l == nil {
+		return func() {}, ctx.Err()
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		// not a url with a host, so there's nothing to be polite to
+		return func() {}, ctx.Err()
+	}
+	host := strings.ToLower(u.Host)
+
+	l.mux.Lock()
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostSlots{slots: make(chan struct{}, l.max)}
+		l.hosts[host] = h
+	}
+	h.users += 1
+	l.mux.Unlock()
+
+	select {
+	case h.slots <- struct{}{}:
+		return func() {
+			<-h.slots
+			l.leave(host, h)
+		}, nil
+	case <-ctx.Done():
+		l.leave(host, h)
+		return nil, ctx.Err()
+	}
+}
+
+// Stop tracking a host once it has no users
+func (l *hostLimiter) leave(host string, h *hostSlots) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	h.users -= 1
+	if h.users == 0 {
+		delete(l.hosts, host)
+	}
+}
@@ -0,0 +1,88 @@
+package rquent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterNoLimit(t *testing.T) {
+	limiter := newRateLimiter(0)
+	if limiter != nil {
+		t.Fatalf("Expected (nil limiter) Got (%v)", limiter)
+	}
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+}
+
+func TestRateLimiterSpacesEvents(t *testing.T) {
+	limiter := newRateLimiter(100) // 10ms between events
+	start := time.Now()
+	for i := 0; i < 6; i += 1 {
+		if err := limiter.Wait(context.Background()); err != nil {
+			t.Fatalf("Expected (nil) Got (%v)", err)
+		}
+	}
+
+	// the first event is immediate, the other 5 are spaced out
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected (at least 50ms) Got (%v)", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	limiter := newRateLimiter(0.1) // 10s between events
+	limiter.Wait(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx); err == nil {
+		t.Errorf("Expected (context error) Got (nil)")
+	}
+}
+
+func TestHostLimiterNoLimit(t *testing.T) {
+	limiter := newHostLimiter(0)
+	if limiter != nil {
+		t.Fatalf("Expected (nil limiter) Got (%v)", limiter)
+	}
+	release, err := limiter.Acquire(context.Background(), testImageURL200)
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	release()
+}
+
+func TestHostLimiterPerHost(t *testing.T) {
+	limiter := newHostLimiter(1)
+	release, err := limiter.Acquire(context.Background(), "http://a.com/1.jpg")
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	// the same host has to wait
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Acquire(ctx, "http://A.com/2.jpg"); err != context.DeadlineExceeded {
+		t.Errorf("Expected (%v) Got (%v)", context.DeadlineExceeded, err)
+	}
+
+	// other hosts don't
+	releaseOther, err := limiter.Acquire(context.Background(), "http://b.com/1.jpg")
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	releaseOther()
+
+	release()
+	release, err = limiter.Acquire(context.Background(), "http://a.com/2.jpg")
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	release()
+
+	if len(limiter.hosts) != 0 {
+		t.Errorf("Expected (unused hosts to be removed) Got (%v)", limiter.hosts)
+	}
+}
@@ -0,0 +1,78 @@
+package rquent
+
+import (
+	"image"
+	"image/color"
+)
+
+// Shrink an image so neither side is longer than maxDim, averaging the pixels each output pixel covers
+// Images that already fit (or a maxDim of 0) are returned as is
+func downscale(img image.Image, maxDim int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if maxDim <= 0 || (w <= maxDim && h <= maxDim) {
+		return img
+	}
+
+	nw, nh := maxDim, maxDim
+	if w > h {
+		nh = max1(h * maxDim / w)
+	} else {
+		nw = max1(w * maxDim / h)
+	}
+
+	out := image.NewRGBA64(image.Rect(0, 0, nw, nh))
+	for oy := 0; oy < nh; oy += 1 {
+		y0, y1 := bounds.Min.Y+oy*h/nh, bounds.Min.Y+(oy+1)*h/nh
+		for ox := 0; ox < nw; ox += 1 {
+			x0, x1 := bounds.Min.X+ox*w/nw, bounds.Min.X+(ox+1)*w/nw
+
+			// sum premultiplied values so transparent pixels don't darken the average
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y += 1 {
+				for x := x0; x < x1; x += 1 {
+					pr, pg, pb, pa := img.At(x, y).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n += 1
+				}
+			}
+			out.SetRGBA64(ox, oy, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return out
+}
+
+// Image limited to a region of another image
+type croppedImage struct {
+	image.Image
+	rect image.Rectangle
+}
+
+func (img *croppedImage) Bounds() image.Rectangle {
+	return img.rect
+}
+
+// Crop an image to the centered rectangle covering fraction of its width and height (so 0.5 keeps
+// the center quarter of the pixels); a fraction of 0 or 1 returns the image as is
+func centerCrop(img image.Image, fraction float64) image.Image {
+	if fraction <= 0 || fraction >= 1 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	cw, ch := max1(int(float64(w)*fraction)), max1(int(float64(h)*fraction))
+	min := bounds.Min.Add(image.Pt((w-cw)/2, (h-ch)/2))
+	return &croppedImage{Image: img, rect: image.Rectangle{Min: min, Max: min.Add(image.Pt(cw, ch))}}
+}
+
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,76 @@
+package rquent
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDownscaleFits(t *testing.T) {
+	img := newColorsImage(10, 5, []colorFreq{colorFreq{red, 1}}, false)
+	if downscale(img, 10) != img || downscale(img, 0) != img {
+		t.Errorf("Expected (image that fits to be unchanged) Got (resized)")
+	}
+}
+
+func TestDownscaleSize(t *testing.T) {
+	img := newColorsImage(100, 10, []colorFreq{colorFreq{red, 1}}, false)
+	bounds := downscale(img, 20).Bounds()
+	if bounds.Dx() != 20 || bounds.Dy() != 2 {
+		t.Errorf("Expected (20x2) Got (%vx%v)", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestDownscaleAverages(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, red)
+	img.Set(1, 0, blue)
+
+	c := color.NRGBAModel.Convert(downscale(img, 1).At(0, 0)).(color.NRGBA)
+	expected := color.NRGBA{127, 0, 127, 255}
+	if c != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, c)
+	}
+}
+
+func TestGetPrevalentColorsMaxDimension(t *testing.T) {
+	colorImg := newColorsImage(1000, 100, []colorFreq{colorFreq{red, .7}, colorFreq{blue, .3}}, false)
+	summary, _ := getPrevalentColors(&colorImg, SummarizeConfig{K: 2, MaxDimension: 100})
+	if summary.Colors[0] != red || summary.Colors[1] != blue {
+		t.Errorf("Expected ([%v %v]) Got (%v)", red, blue, summary.Colors)
+	}
+}
+
+func TestCenterCrop(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(10, 10, 110, 60))
+	if centerCrop(img, 0) != image.Image(img) || centerCrop(img, 1) != image.Image(img) {
+		t.Errorf("Expected (image to be unchanged) Got (cropped)")
+	}
+	expected := image.Rect(35, 22, 85, 47)
+	if bounds := centerCrop(img, .5).Bounds(); bounds != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, bounds)
+	}
+}
+
+func TestGetPrevalentColorsCropFraction(t *testing.T) {
+	// a red square in the middle of a white background covering most of the image
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	for x := 0; x < 100; x += 1 {
+		for y := 0; y < 100; y += 1 {
+			img.Set(x, y, white)
+			if x >= 30 && x < 70 && y >= 30 && y < 70 {
+				img.Set(x, y, red)
+			}
+		}
+	}
+	var colorImg image.Image = img
+
+	summary, _ := getPrevalentColors(&colorImg, SummarizeConfig{K: 1})
+	if summary.Colors[0] != white {
+		t.Errorf("Expected (%v) Got (%v)", white, summary.Colors[0])
+	}
+	summary, _ = getPrevalentColors(&colorImg, SummarizeConfig{K: 2, CropFraction: .4})
+	if summary.Colors[0] != red || summary.Colors[1] != PlaceholderColor {
+		t.Errorf("Expected (only %v) Got (%v)", red, summary.Colors)
+	}
+}
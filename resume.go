@@ -0,0 +1,110 @@
+package rquent
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+)
+
+// Read the urls of the results in a previous run's output, so a resumed run can skip them
+// A final line without a newline was cut off mid-write, so it isn't counted as done
+// Also returns the number of complete lines, including any header; CSV fields are separated by comma
+func readDoneURLs(previous io.Reader, format RqOutputFormat, comma rune) (map[string]bool, int, error) {
+	done := make(map[string]bool)
+	reader := bufio.NewReader(previous)
+	nLines := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// anything left is a truncated line
+			return done, nLines, nil
+		}
+		if err != nil {
+			return nil, nLines, err
+		}
+		nLines += 1
+
+		line = strings.TrimRight(line, "\r\n")
+		if imgURL, ok := resultURL(line, format, comma); ok {
+			done[imgURL] = true
+		}
+	}
+}
+
+// Get the url from a line of output; returns false for headers and lines that can't be parsed
+func resultURL(line string, format RqOutputFormat, comma rune) (string, bool) {
+	switch format {
+	case FormatCSV:
+		if strings.HasPrefix(line, "url"+string(comma)) {
+			return "", false
+		}
+		reader := csv.NewReader(strings.NewReader(line))
+		reader.Comma = comma
+		record, err := reader.Read()
+		if err != nil || len(record) == 0 || record[0] == "" {
+			return "", false
+		}
+		return record[0], true
+	case FormatJSONL:
+		var result struct {
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal([]byte(line), &result); err != nil || result.URL == "" {
+			return "", false
+		}
+		return result.URL, true
+	default:
+		return "", false
+	}
+}
+
+// Open (or create) a previous run's output file to resume it
+// A final line cut off by a crash is removed, and the file is positioned at the start so it can be
+// given to both WithResume and WithOutput; new results are appended once it has been read
+func OpenResumeFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := trimPartialLine(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Truncate a file after its last newline
+func trimPartialLine(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+	buf := make([]byte, 4096)
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return err
+		}
+		if i := strings.LastIndexByte(string(chunk), '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if end == info.Size() {
+		return nil
+	}
+	return f.Truncate(end)
+}
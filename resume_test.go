@@ -0,0 +1,118 @@
+package rquent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadDoneURLs(t *testing.T) {
+	previous := "url,width,height,color1\n" +
+		"http://a.com/1.jpg,1,1,#ffffff\n" +
+		"\"http://a.com/2,3.jpg\",1,1,#ffffff\n" +
+		"http://a.com/4.jpg,1,1,#ff" // cut off mid-write
+	done, nLines, err := readDoneURLs(strings.NewReader(previous), FormatCSV, ',')
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if nLines != 3 {
+		t.Errorf("Expected (3 lines) Got (%v)", nLines)
+	}
+	if len(done) != 2 || !done["http://a.com/1.jpg"] || !done["http://a.com/2,3.jpg"] {
+		t.Errorf("Expected (2 complete urls) Got (%v)", done)
+	}
+}
+
+func TestReadDoneURLsDelimiter(t *testing.T) {
+	previous := "url\twidth\n" + "http://a.com/1,2.jpg\t1\n"
+	done, _, err := readDoneURLs(strings.NewReader(previous), FormatCSV, '\t')
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if len(done) != 1 || !done["http://a.com/1,2.jpg"] {
+		t.Errorf("Expected (1 complete url) Got (%v)", done)
+	}
+}
+
+func TestReadDoneURLsJSONL(t *testing.T) {
+	previous := `{"url":"http://a.com/1.jpg","width":1}` + "\n" + `{"url":"http://a.com/2.jp`
+	done, _, err := readDoneURLs(strings.NewReader(previous), FormatJSONL, ',')
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if len(done) != 1 || !done["http://a.com/1.jpg"] {
+		t.Errorf("Expected (1 complete url) Got (%v)", done)
+	}
+}
+
+func TestOpenResumeFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "*.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("a,1\nb,2\nc,")
+	f.Close()
+
+	resumed, err := OpenResumeFile(f.Name())
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	defer resumed.Close()
+	b, _ := ioutil.ReadAll(resumed)
+	if string(b) != "a,1\nb,2\n" {
+		t.Errorf("Expected (%q) Got (%q)", "a,1\nb,2\n", string(b))
+	}
+}
+
+func TestPipelineRunResume(t *testing.T) {
+	// Test urls with results in the previous output are skipped
+	done := testImageURL200 + "?done"
+	previous := done + ",1400,790,#ffffff,#000000,#f3c300\n"
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(done + "\n" + testImageURL200)).
+		WithOutput(b).
+		WithResume(strings.NewReader(previous)).
+		WithHeader(true).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, err := pipeline.Run()
+	if err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+	if result.Succeeded != 1 || result.Resumed != 1 {
+		t.Errorf("Expected (1 succeeded 1 resumed) Got (%+v)", result)
+	}
+	// the previous output already has lines, so there's no second header
+	if !strings.HasPrefix(b.String(), testImageURL200+",") || strings.Count(b.String(), "\n") != 1 {
+		t.Errorf("Expected (only a result for %v) Got (%v)", testImageURL200, b.String())
+	}
+}
+
+func TestPipelineRunResumeAllDone(t *testing.T) {
+	// Test the run completes when every url is already done
+	previous := testImageURL200 + ",1400,790,#ffffff,#000000,#f3c300\n"
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(new(bytes.Buffer)).
+		WithResume(strings.NewReader(previous)).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, err := pipeline.Run()
+	if err != nil || result.Resumed != 1 {
+		t.Errorf("Expected (1 resumed, nil) Got (%+v, %v)", result, err)
+	}
+}
@@ -0,0 +1,275 @@
+package rquent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned for urls that a host's robots.txt disallows
+var errDisallowed = errors.New("Disallowed by robots.txt")
+
+// Returned for every url of a host whose robots.txt can't be fetched (a network error or 5xx), which
+// disallows them all until it can be
+var errRobotsUnavailable = errors.New("Disallowed while robots.txt is unavailable")
+
+// Largest robots.txt that's read; the rest of a longer file is ignored
+const maxRobotsBytes = 500 * 1024
+
+// Rules from the group of a robots.txt that applies to us
+type robotsRules struct {
+	allow      []string
+	disallow   []string
+	crawlDelay time.Duration
+}
+
+// Rules that allow everything, for hosts without a robots.txt
+var allowAll = robotsRules{}
+
+// Fetches and caches each host's robots.txt, skipping the urls it disallows and spacing requests to
+// the host by its crawl-delay; safe for concurrent use
+// A nil policy allows everything without waiting
+type robotsPolicy struct {
+	client  *http.Client
+	header  http.Header  // sent when fetching robots.txt, including the User-Agent
+	agent   string       // product token matched against the User-agent lines, lowercase
+	limiter *rateLimiter // waited on before each fetch, like a download; nil doesn't limit them
+	logger  Logger
+	mux     sync.Mutex
+	hosts   map[string]*robotsHost // by scheme and host
+}
+
+// A host's rules, fetched by whichever request gets there first and kept once they're fetched
+type robotsHost struct {
+	mux     sync.Mutex // held while fetching, so other requests to the host wait for the rules
+	fetched bool
+	rules   robotsRules
+	limiter *rateLimiter // spaces requests by the crawl-delay, nil if there isn't one
+}
+
+// Create a policy fetching robots.txt with client, which should be the downloader's so its redirect
+// limit applies; the agent is taken from header's User-Agent
+func newRobotsPolicy(client *http.Client, header http.Header) *robotsPolicy {
+	return &robotsPolicy{
+		client: client,
+		header: header,
+		agent:  agentToken(header.Get("User-Agent")),
+		logger: nopLogger{},
+		hosts:  make(map[string]*robotsHost),
+	}
+}
+
+// The product token of a User-Agent ("mybot" for "MyBot/1.0 (+https://example.com)"), lowercase
+func agentToken(userAgent string) string {
+	token := strings.TrimSpace(userAgent)
+	if i := strings.IndexAny(token, "/ "); i >= 0 {
+		token = token[:i]
+	}
+	return strings.ToLower(token)
+}
+
+// Block until the crawl-delay of rawURL's host allows another request, or fail with errDisallowed
+// if its robots.txt doesn't allow the url. The host's robots.txt is fetched on its first request, and
+// again on later ones for as long as fetching it fails with errRobotsUnavailable
+func (p *robotsPolicy) Wait(ctx context.Context, rawURL string) error {
+	if p == nil {
+		return ctx.Err()
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		// let the request report the bad url
+		return ctx.Err()
+	}
+
+	key := strings.ToLower(u.Scheme + "://" + u.Host)
+	p.mux.Lock()
+	h, ok := p.hosts[key]
+	if !ok {
+		h = &robotsHost{}
+		p.hosts[key] = h
+	}
+	p.mux.Unlock()
+
+	h.mux.Lock()
+	if !h.fetched {
+		rules, err := p.fetch(ctx, key+"/robots.txt")
+		if err != nil {
+			// not kept, so a later request fetches it again
+			h.mux.Unlock()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			p.logger.Debugf("Failed to fetch %v/robots.txt, disallowing its urls: %v", key, err)
+			return errRobotsUnavailable
+		}
+		h.rules, h.fetched = rules, true
+		if rules.crawlDelay > 0 {
+			h.limiter = &rateLimiter{interval: rules.crawlDelay}
+		}
+	}
+	rules, limiter := h.rules, h.limiter
+	h.mux.Unlock()
+
+	if !rules.allowed(u.RequestURI()) {
+		return errDisallowed
+	}
+	return limiter.Wait(ctx)
+}
+
+// Fetch and parse a robots.txt, following RFC 9309: a 4xx response (e.g. no robots.txt) allows
+// everything, while a network error or any other status is an error
+func (p *robotsPolicy) fetch(ctx context.Context, robotsURL string) (robotsRules, error) {
+	if err := p.limiter.Wait(ctx); err != nil {
+		return robotsRules{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL, nil)
+	if err != nil {
+		return robotsRules{}, err
+	}
+	for name, values := range p.header {
+		req.Header[name] = values
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return robotsRules{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		p.logger.Debugf("No robots.txt at %v (statusCode %v), allowing all urls", robotsURL, resp.StatusCode)
+		return allowAll, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return robotsRules{}, fmt.Errorf("statusCode %v", resp.StatusCode)
+	}
+	rules := parseRobots(io.LimitReader(resp.Body, maxRobotsBytes), p.agent)
+	if rules.crawlDelay > 0 {
+		p.logger.Debugf("Waiting %v between requests to match %v", rules.crawlDelay, robotsURL)
+	}
+	return rules, nil
+}
+
+// Parse the rules of the group in a robots.txt that applies to agent, or of the * group if none does
+// A group applies when one of its User-agent lines is a prefix of agent, ignoring case
+func parseRobots(r io.Reader, agent string) robotsRules {
+	var matched, wildcard robotsRules
+	var foundMatch, foundWildcard bool
+	// whether the current group applies to agent or to everyone
+	var inMatch, inWildcard bool
+	// consecutive User-agent lines start one group, the first rule after them ends the list
+	inAgents := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		if field == "user-agent" {
+			if !inAgents {
+				inMatch, inWildcard = false, false
+				inAgents = true
+			}
+			name := strings.ToLower(value)
+			if name == "*" {
+				inWildcard = true
+				foundWildcard = true
+			} else if name != "" && agent != "" && strings.HasPrefix(agent, name) {
+				inMatch = true
+				foundMatch = true
+			}
+			continue
+		}
+		inAgents = false
+
+		var groups []*robotsRules
+		if inMatch {
+			groups = append(groups, &matched)
+		}
+		if inWildcard {
+			groups = append(groups, &wildcard)
+		}
+		for _, g := range groups {
+			switch field {
+			case "allow":
+				if value != "" {
+					g.allow = append(g.allow, value)
+				}
+			case "disallow":
+				// an empty Disallow allows everything, same as no rule
+				if value != "" {
+					g.disallow = append(g.disallow, value)
+				}
+			case "crawl-delay":
+				if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+					g.crawlDelay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		}
+	}
+
+	if foundMatch {
+		return matched
+	}
+	if foundWildcard {
+		return wildcard
+	}
+	return allowAll
+}
+
+// Whether path may be fetched: the longest matching rule wins, and Allow wins a tie
+// path includes any query, as in "/search?q=x"
+func (rules robotsRules) allowed(path string) bool {
+	longest := func(patterns []string) int {
+		n := -1
+		for _, pattern := range patterns {
+			if len(pattern) > n && matchRobotsPattern(pattern, path) {
+				n = len(pattern)
+			}
+		}
+		return n
+	}
+	disallow := longest(rules.disallow)
+	return disallow < 0 || longest(rules.allow) >= disallow
+}
+
+// Match a robots.txt path pattern against the start of path; * matches any characters and a
+// trailing $ anchors the pattern to the end of path
+func matchRobotsPattern(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = strings.TrimSuffix(pattern, "$")
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for _, part := range parts[1:] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	if !anchored || rest == "" {
+		return true
+	}
+	// a pattern ending in * matches whatever is left; otherwise the last part must end the path
+	last := parts[len(parts)-1]
+	return len(parts) > 1 && (last == "" || strings.HasSuffix(path, last))
+}
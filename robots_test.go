@@ -0,0 +1,252 @@
+package rquent
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRobots = `# comment
+User-agent: *
+Disallow: /private/
+Allow: /private/public.jpg
+Disallow: /*.gif$
+
+User-agent: otherbot
+User-agent: rquentbot
+Disallow: /
+Allow: /bots/
+Crawl-delay: 1.5
+`
+
+func TestParseRobots(t *testing.T) {
+	tests := []struct {
+		agent   string
+		path    string
+		allowed bool
+	}{
+		{"", "/a.jpg", true},
+		{"", "/private/a.jpg", false},
+		{"", "/private/public.jpg", true},
+		{"", "/a.gif", false},
+		{"", "/a.gif?size=2", true},
+		{"mozilla", "/private/a.jpg", false},
+		{"rquentbot", "/a.jpg", false},
+		{"rquentbot", "/bots/a.jpg", true},
+	}
+	for _, tt := range tests {
+		rules := parseRobots(strings.NewReader(testRobots), tt.agent)
+		if allowed := rules.allowed(tt.path); allowed != tt.allowed {
+			t.Errorf("Expected (%v allowed %v for %q) Got (%v)", tt.path, tt.allowed, tt.agent, allowed)
+		}
+	}
+
+	if rules := parseRobots(strings.NewReader(testRobots), "rquentbot"); rules.crawlDelay != 1500*time.Millisecond {
+		t.Errorf("Expected (1.5s crawl-delay) Got (%v)", rules.crawlDelay)
+	}
+	if rules := parseRobots(strings.NewReader(testRobots), ""); rules.crawlDelay != 0 {
+		t.Errorf("Expected (no crawl-delay) Got (%v)", rules.crawlDelay)
+	}
+}
+
+func TestAgentToken(t *testing.T) {
+	if token := agentToken("RquentBot/1.0 (+https://example.com)"); token != "rquentbot" {
+		t.Errorf("Expected (rquentbot) Got (%v)", token)
+	}
+	if token := agentToken(""); token != "" {
+		t.Errorf("Expected () Got (%v)", token)
+	}
+}
+
+func TestMatchRobotsPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/a", "/a/b.jpg", true},
+		{"/a$", "/a/b.jpg", false},
+		{"/a$", "/a", true},
+		{"/*.jpg$", "/a/b.jpg", true},
+		{"/*.jpg$", "/a.jpg/b.png", false},
+		{"/*.jpg$", "/a.jpg/b.jpg", true},
+		{"/a*", "/b", false},
+	}
+	for _, tt := range tests {
+		if match := matchRobotsPattern(tt.pattern, tt.path); match != tt.match {
+			t.Errorf("Expected (%v matching %v is %v) Got (%v)", tt.pattern, tt.path, tt.match, match)
+		}
+	}
+}
+
+// create a server with a robots.txt, serving testing/valid.jpg for any other path and counting the
+// requests for robots.txt
+func robotsServer(robots string, robotsRequests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			atomic.AddInt32(robotsRequests, 1)
+			if robots == "" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(robots))
+			return
+		}
+		data, _ := ioutil.ReadFile(testImagePathValid)
+		w.Write(data)
+	}))
+}
+
+func TestRobotsPolicyCrawlDelay(t *testing.T) {
+	var robotsRequests int32
+	s := robotsServer("User-agent: *\nCrawl-delay: 0.05\n", &robotsRequests)
+	defer s.Close()
+
+	p := newRobotsPolicy(s.Client(), http.Header{})
+	start := time.Now()
+	for i := 0; i < 3; i += 1 {
+		if err := p.Wait(context.Background(), s.URL+"/a.jpg"); err != nil {
+			t.Fatalf("Expected (nil) Got (%v)", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected (at least 100ms) Got (%v)", elapsed)
+	}
+	if robotsRequests != 1 {
+		t.Errorf("Expected (robots.txt fetched once) Got (%v)", robotsRequests)
+	}
+}
+
+func TestRobotsPolicyMissing(t *testing.T) {
+	var robotsRequests int32
+	s := robotsServer("", &robotsRequests)
+	defer s.Close()
+
+	p := newRobotsPolicy(s.Client(), http.Header{})
+	if err := p.Wait(context.Background(), s.URL+"/private/a.jpg"); err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+}
+
+func TestRobotsPolicyUnavailable(t *testing.T) {
+	// Test a robots.txt failing with a 5xx disallows everything, and is fetched again next time
+	var robotsRequests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&robotsRequests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("User-agent: *\nDisallow: /private/\n"))
+	}))
+	defer s.Close()
+
+	p := newRobotsPolicy(s.Client(), http.Header{})
+	if err := p.Wait(context.Background(), s.URL+"/a.jpg"); err != errRobotsUnavailable {
+		t.Errorf("Expected (%v) Got (%v)", errRobotsUnavailable, err)
+	}
+	if err := p.Wait(context.Background(), s.URL+"/a.jpg"); err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+	if err := p.Wait(context.Background(), s.URL+"/private/a.jpg"); err != errDisallowed {
+		t.Errorf("Expected (%v) Got (%v)", errDisallowed, err)
+	}
+	if robotsRequests != 2 {
+		t.Errorf("Expected (robots.txt fetched twice) Got (%v)", robotsRequests)
+	}
+}
+
+func TestRobotsPolicyUnreachable(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	unreachable := s.URL
+	s.Close()
+
+	p := newRobotsPolicy(http.DefaultClient, http.Header{})
+	if err := p.Wait(context.Background(), unreachable+"/a.jpg"); err != errRobotsUnavailable {
+		t.Errorf("Expected (%v) Got (%v)", errRobotsUnavailable, err)
+	}
+}
+
+func TestPipelineRunRobotsTxt(t *testing.T) {
+	var robotsRequests int32
+	s := robotsServer(testRobots, &robotsRequests)
+	defer s.Close()
+
+	errOut := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader(s.URL + "/a.jpg\n" + s.URL + "/private/a.jpg")).
+		WithOutput(new(bytes.Buffer)).
+		WithErrorOutput(errOut).
+		WithRobotsTxt(true).
+		Init()
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, _ := pipeline.Run()
+	if result.Succeeded != 1 || result.Failed != 1 {
+		t.Errorf("Expected (1 succeeded, 1 failed) Got (%+v)", result)
+	}
+	if !strings.HasPrefix(errOut.String(), s.URL+"/private/a.jpg,"+errDisallowed.Error()) {
+		t.Errorf("Expected (disallowed url in error output) Got (%q)", errOut.String())
+	}
+	if robotsRequests != 1 {
+		t.Errorf("Expected (robots.txt fetched once) Got (%v)", robotsRequests)
+	}
+}
+
+func TestPipelineRunRobotsTxtRedirectLoop(t *testing.T) {
+	// Test robots.txt is fetched with the download client, so its redirect limit applies
+	var robotsRequests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&robotsRequests, 1)
+		http.Redirect(w, r, "/robots.txt", http.StatusFound)
+	}))
+	defer s.Close()
+
+	cfg := DefaultDownloadConfig
+	cfg.MaxRedirects = 2
+	errOut := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader(s.URL + "/a.jpg")).
+		WithOutput(new(bytes.Buffer)).
+		WithErrorOutput(errOut).
+		WithDownloadConfig(cfg).
+		WithRobotsTxt(true).
+		Init()
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, _ := pipeline.Run()
+	if result.Failed != 1 || !strings.Contains(errOut.String(), errRobotsUnavailable.Error()) {
+		t.Errorf("Expected (url failed with %v) Got (%+v, %q)", errRobotsUnavailable, result, errOut.String())
+	}
+	// fetched again for each attempt at the url, stopping after 2 redirects each time
+	if robotsRequests != 3*RqJobMaxFails {
+		t.Errorf("Expected (%v requests) Got (%v)", 3*RqJobMaxFails, robotsRequests)
+	}
+}
+
+func TestRobotsPolicyRateLimit(t *testing.T) {
+	// Test fetching robots.txt waits on the limiter like a download
+	var robotsRequests int32
+	s := robotsServer("", &robotsRequests)
+	defer s.Close()
+
+	p := newRobotsPolicy(s.Client(), http.Header{})
+	p.limiter = &rateLimiter{interval: 100 * time.Millisecond}
+	p.limiter.Wait(context.Background())
+	start := time.Now()
+	if err := p.Wait(context.Background(), s.URL+"/a.jpg"); err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected (at least 50ms) Got (%v)", elapsed)
+	}
+}
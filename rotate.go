@@ -0,0 +1,103 @@
+package rquent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Writes lines to a numbered series of files in dir (results.000.csv, results.001.csv, ...), starting a
+// new file once the current one has linesPerFile lines; each file starts with header if it's set
+// Lines may be split across writes. NOT thread safe
+type rotatingWriter struct {
+	dir          string
+	ext          string
+	linesPerFile int
+	header       []byte
+	file         *os.File // nil until the next line is written
+	nFiles       int
+	lines        int // lines written to file, not counting the header
+}
+
+func newRotatingWriter(dir string, ext string, linesPerFile int) *rotatingWriter {
+	return &rotatingWriter{dir: dir, ext: ext, linesPerFile: linesPerFile}
+}
+
+// Path of the nth file
+func (w *rotatingWriter) path(n int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("results.%03d.%v", n, w.ext))
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.file == nil {
+			if err := w.open(); err != nil {
+				return written, err
+			}
+		}
+		// write up to the end of the file's last line
+		remaining := w.linesPerFile - w.lines
+		end := 0
+		for i := 0; i < remaining; i += 1 {
+			newline := bytes.IndexByte(p[end:], '\n')
+			if newline < 0 {
+				end = len(p)
+				break
+			}
+			end += newline + 1
+			w.lines += 1
+		}
+		n, err := w.file.Write(p[:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[end:]
+		if w.lines >= w.linesPerFile {
+			// the next line starts a new file
+			err := w.file.Close()
+			w.file = nil
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Start the next file
+func (w *rotatingWriter) open() error {
+	f, err := os.Create(w.path(w.nFiles))
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.nFiles += 1
+	w.lines = 0
+	if len(w.header) > 0 {
+		if _, err := f.Write(w.header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync the current file to disk
+func (w *rotatingWriter) Sync() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+// Close the current file
+func (w *rotatingWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
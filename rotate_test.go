@@ -0,0 +1,40 @@
+package rquent
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRotatingWriterSplitsLines(t *testing.T) {
+	// Test lines are counted across writes that don't line up with them
+	dir, err := ioutil.TempDir("", "rquent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := newRotatingWriter(dir, "jsonl", 2)
+	w.header = []byte("h\n")
+	for _, chunk := range []string{"a\nb", "\nc\nd\ne", "\n"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Expected (nil) Got (%v)", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	expected := []string{"h\na\nb\n", "h\nc\nd\n", "h\ne\n"}
+	for i, content := range expected {
+		got, err := ioutil.ReadFile(w.path(i))
+		if err != nil {
+			t.Fatalf("Expected (nil) Got (%v)", err)
+		}
+		if string(got) != content {
+			t.Errorf("Expected (%q) Got (%q)", content, got)
+		}
+	}
+	if w.nFiles != 3 {
+		t.Errorf("Expected (3) Got (%v)", w.nFiles)
+	}
+}
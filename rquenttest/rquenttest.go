@@ -0,0 +1,38 @@
+// Package rquenttest provides utilities for testing summarizers and code that uses rquent.
+package rquenttest
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// A color and the fraction of an image's width it should cover
+type ColorFreq struct {
+	Color color.Color
+	Freq  float64
+}
+
+// Generate an image of vertical columns of colors, left to right in the order given
+// Each column is Freq * width pixels wide (rounded to the nearest pixel), so the fraction of the image
+// each color covers is known, making a deterministic fixture for summarizers
+// Any width not covered by the columns is left transparent
+func GenerateColorColumns(width, height int, colors []ColorFreq) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	var xStart, xEnd int
+	// for each color, calculate the start and end x positions, then fill in the column
+	for _, c := range colors {
+		xStart = xEnd
+		xEnd = xStart + int(math.Round(c.Freq*float64(width)))
+		if xEnd > width {
+			xEnd = width
+		}
+
+		for x := xStart; x < xEnd; x++ {
+			for y := 0; y < height; y++ {
+				img.Set(x, y, c.Color)
+			}
+		}
+	}
+	return img
+}
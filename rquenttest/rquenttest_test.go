@@ -0,0 +1,27 @@
+package rquenttest
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestGenerateColorColumns(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	blue := color.NRGBA{0, 0, 255, 255}
+	img := GenerateColorColumns(10, 2, []ColorFreq{{red, .7}, {blue, .5}})
+
+	if b := img.Bounds(); b.Dx() != 10 || b.Dy() != 2 {
+		t.Fatalf("Expected (10x2) Got (%v)", b)
+	}
+	for x := 0; x < 10; x++ {
+		expected := color.Color(red)
+		if x >= 7 {
+			expected = blue
+		}
+		r, g, b, a := img.At(x, 1).RGBA()
+		er, eg, eb, ea := expected.RGBA()
+		if r != er || g != eg || b != eb || a != ea {
+			t.Errorf("Expected (%v at x=%v) Got (%v)", expected, x, img.At(x, 1))
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package rquent
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Settings for reading URLs from a CSV source
+type csvSource struct {
+	column     int
+	skipHeader bool
+}
+
+// Settings for reading images from a directory tree
+type dirSource struct {
+	root    string
+	pattern string // matched against file names; "" matches every file
+}
+
+// Returned to stop walking the source directory early
+var errStopWalk = errors.New("Stopped reading source directory")
+
+// Returns true if the reader should keep going; it stops at the limit, and after the pipeline is
+// cancelled the rest of the source is only read if there's an error output to record the unprocessed urls
+func (pipe *RqPipeline) keepReading() bool {
+	if pipe.limit > 0 && atomic.LoadUint64(&pipe.stats.read) >= uint64(pipe.limit) {
+		return false
+	}
+	return pipe.pool.ctx.Err() == nil || pipe.errOut != nil
+}
+
+// Add an image URL to the pipeline
+// If the pipeline was cancelled the url is recorded as unprocessed instead, and urls done by the run
+// being resumed are skipped
+func (pipe *RqPipeline) enqueueURL(imgURL string) {
+	pipe.enqueueImage(NewRqImage(imgURL))
+}
+
+// Add an image to the pipeline, as with enqueueURL
+func (pipe *RqPipeline) enqueueImage(img RqImage) {
+	imgURL := img.URL
+	if err := pipe.pool.ctx.Err(); err != nil {
+		atomic.AddUint64(&pipe.stats.read, 1)
+		atomic.AddUint64(&pipe.stats.skipped, 1)
+		pipe.writeFailure(imgURL, "unprocessed: "+err.Error())
+		return
+	}
+
+	if pipe.doneURLs[imgURL] {
+		atomic.AddUint64(&pipe.stats.read, 1)
+		atomic.AddUint64(&pipe.stats.resumed, 1)
+		pipe.logger.Debugf("Already done %v", imgURL)
+		return
+	}
+
+	pipe.startJob(imgURL)
+	pipe.addImageCount(1)
+	atomic.AddUint64(&pipe.stats.read, 1)
+	pipe.logger.Debugf("Starting %v", imgURL)
+	job := RqJob{
+		image:    img,
+		index:    pipe.nextIndex,
+		retryChn: nil,
+		nextChn:  nil,
+	}
+	pipe.nextIndex += 1
+	// if cancelled while waiting, the url is still in flight and recorded when the run ends
+	sendJob(pipe.pool.ctx, pipe.pool.downloadChn, job)
+}
+
+// Report a source entry that can't be processed; it's counted like an image so isDone stays correct
+func (pipe *RqPipeline) rejectURL(imgURL string, message string) {
+	if pipe.pool.ctx.Err() != nil {
+		atomic.AddUint64(&pipe.stats.read, 1)
+		atomic.AddUint64(&pipe.stats.failed, 1)
+		pipe.writeFailure(imgURL, message)
+		return
+	}
+
+	pipe.startJob(imgURL)
+	pipe.addImageCount(1)
+	atomic.AddUint64(&pipe.stats.read, 1)
+	job := RqJob{image: NewRqImage(imgURL), index: pipe.nextIndex}
+	pipe.nextIndex += 1
+	if !sendError(pipe.pool.ctx, pipe.pool.errorChn, NewRqError(job, RqErrorNoRetry, message)) {
+		pipe.finishJob(imgURL)
+		pipe.addImageCount(^uint64(0))
+		atomic.AddUint64(&pipe.stats.failed, 1)
+		pipe.writeFailure(imgURL, message)
+	}
+}
+
+// Record a source url that won't be processed, like skipJob (without it taking a worker's time)
+func (pipe *RqPipeline) skipURL(imgURL string, reason string) {
+	if pipe.pool.ctx.Err() != nil {
+		atomic.AddUint64(&pipe.stats.read, 1)
+		atomic.AddUint64(&pipe.stats.skipped, 1)
+		pipe.writeFailure(imgURL, "unprocessed: "+reason)
+		return
+	}
+
+	pipe.startJob(imgURL)
+	pipe.addImageCount(1)
+	atomic.AddUint64(&pipe.stats.read, 1)
+	job := RqJob{image: NewRqImage(imgURL), index: pipe.nextIndex}
+	pipe.nextIndex += 1
+	pipe.skipJob(job, reason)
+}
+
+// Matches the start of a url missing its scheme, e.g. www.example.com/ in www.example.com/x.jpg
+var schemelessHost = regexp.MustCompile(`^[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+(:[0-9]+)?/`)
+
+// Check a url from the source can be downloaded or read, adding https:// to one that's missing a
+// scheme but starts with a host rather than being a local file. Local paths are returned as they are
+func normalizeURL(imgURL string) (string, error) {
+	if isDataURI(imgURL) {
+		return imgURL, nil
+	}
+	if schemelessHost.MatchString(imgURL) {
+		// checked before parsing, which would take a host with a port for a scheme
+		if _, err := os.Stat(imgURL); os.IsNotExist(err) {
+			return normalizeURL("https://" + imgURL)
+		}
+		return imgURL, nil
+	}
+	u, err := url.Parse(imgURL)
+	if err != nil {
+		return "", err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "file":
+		return imgURL, nil
+	case "http", "https":
+		if u.Host == "" {
+			return "", errors.New("missing host")
+		}
+		return imgURL, nil
+	default:
+		if len(u.Scheme) == 1 {
+			// a windows drive letter, e.g. C:\images\x.jpg
+			return imgURL, nil
+		}
+		return "", fmt.Errorf("unsupported scheme %v", u.Scheme)
+	}
+}
+
+// Add a url from a list of urls to the pipeline, or skip it if it's invalid
+func (pipe *RqPipeline) enqueueSourceURL(imgURL string) {
+	if _, ok := pipe.pool.downloader.fetcher(imgURL); ok {
+		// the fetcher checks its own urls
+		pipe.enqueueURL(imgURL)
+		return
+	}
+	normalized, err := normalizeURL(imgURL)
+	if err != nil {
+		pipe.skipURL(imgURL, "invalid url: "+err.Error())
+		return
+	}
+	pipe.enqueueURL(normalized)
+}
+
+// Mark the source as fully read
+func (pipe *RqPipeline) finishReadURLs() {
+	defer pipe.pool.wg.Done()
+	pipe.mux.Lock()
+	pipe.readURLsDone = true
+	pipe.mux.Unlock()
+
+	// the last job may have finished before the source was marked as read (or there were no jobs at
+	// all, e.g. every url was already done), in which case no job will stop the workers
+	pipe.stopIfDone()
+}
+
+// Longest line of a list of urls unless the pipeline is given another, e.g. a long signed url or data URI
+const DefaultMaxLineLength = 1024 * 1024
+
+// Read lines of URLs into images and send into the downloadChn; NOT thread safe
+// Blank lines and lines starting with # are skipped, and invalid urls are recorded as unprocessed
+// A line longer than the maximum stops the reading, failing the run once the urls before it are done
+func (pipe *RqPipeline) readURLs() {
+	maxLine := pipe.maxLineLength
+	if maxLine == 0 {
+		maxLine = DefaultMaxLineLength
+	}
+	scanner := bufio.NewScanner(pipe.sourceURLs)
+	scanner.Buffer(nil, maxLine)
+	for pipe.keepReading() && scanner.Scan() {
+		imgURL := strings.TrimSpace(scanner.Text())
+		if imgURL == "" || strings.HasPrefix(imgURL, "#") {
+			continue
+		}
+		pipe.enqueueSourceURL(imgURL)
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			err = fmt.Errorf("%w (lines can be at most %v bytes)", err, maxLine)
+		}
+		pipe.sourceFailed(err)
+	}
+	pipe.finishReadURLs()
+}
+
+// Fail the run because the source couldn't be read to the end; the urls already read are still
+// done, but the run didn't cover the whole source
+func (pipe *RqPipeline) sourceFailed(err error) {
+	pipe.logger.Errorf("Failed to read source: %v", err)
+	pipe.mux.Lock()
+	if pipe.runErr == nil {
+		pipe.runErr = fmt.Errorf("Failed to read source: %w", err)
+	}
+	pipe.mux.Unlock()
+}
+
+// Read URLs from a column of CSV rows into images and send into the downloadChn; NOT thread safe
+// Malformed rows are rejected, while an error reading the source stops the reading and fails the run
+func (pipe *RqPipeline) readCSVURLs() {
+	defer pipe.finishReadURLs()
+
+	reader := csv.NewReader(pipe.sourceURLs)
+	reader.FieldsPerRecord = -1 // row lengths are checked against the column below
+	column := pipe.sourceCSV.column
+	for row := 1; pipe.keepReading(); row += 1 {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			// the reader can continue past malformed rows
+			pipe.rejectURL("", fmt.Sprintf("Malformed source row %v: %v", row, err))
+			continue
+		}
+		if err != nil {
+			pipe.sourceFailed(err)
+			return
+		}
+
+		if row == 1 && pipe.sourceCSV.skipHeader {
+			continue
+		}
+		if column >= len(record) {
+			pipe.rejectURL("", fmt.Sprintf("Malformed source row %v: no column %v", row, column))
+			continue
+		}
+		imgURL := strings.TrimSpace(record[column])
+		if imgURL == "" {
+			pipe.rejectURL("", fmt.Sprintf("Empty url in source row %v", row))
+			continue
+		}
+		pipe.enqueueSourceURL(imgURL)
+	}
+}
+
+// Walk the source directory sending images with matching names into the downloadChn; NOT thread safe
+// Images are read in place, and their paths relative to the directory are used as their urls
+func (pipe *RqPipeline) readDirectory() {
+	defer pipe.finishReadURLs()
+
+	root := pipe.sourceDir.root
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if !pipe.keepReading() {
+			return errStopWalk
+		}
+		rel, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			rel = path
+		}
+		rel = filepath.ToSlash(rel)
+		if err != nil {
+			if path == root {
+				return err
+			}
+			// skip what can't be read and keep walking
+			pipe.rejectURL(rel, "Failed to read source directory: "+err.Error())
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if pipe.sourceDir.pattern != "" {
+			if ok, _ := filepath.Match(pipe.sourceDir.pattern, info.Name()); !ok {
+				return nil
+			}
+		}
+
+		img := NewRqImage(rel)
+		img.localPath = path
+		pipe.enqueueImage(img)
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		// only the root can fail the walk, e.g. a directory that doesn't exist
+		pipe.sourceFailed(err)
+	}
+}
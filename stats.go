@@ -0,0 +1,115 @@
+package rquent
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Receives the measurements of a run that its counters (see Stats) don't cover, e.g. to export them to a
+// monitoring system; the counters can be read with Stats while the pipeline runs
+// Methods are called concurrently by the workers, so they must be safe for concurrent use
+type Metrics interface {
+	// How long a summarize worker spent on a job, including decoding it and whether or not it succeeded
+	ObserveSummarize(d time.Duration)
+}
+
+// Snapshot of a pipeline's progress
+type RqStats struct {
+	Read            uint64                 // entries read from the source (including rejected ones)
+	Downloaded      uint64                 // images downloaded
+	Bytes           uint64                 // bytes downloaded (compressed, if the response was), including failed and retried downloads
+	Summarized      uint64                 // images summarized
+	Saved           uint64                 // results written to the output
+	Failed          uint64                 // jobs removed from the pipeline after an error
+	Skipped         uint64                 // urls left unprocessed because the run stopped early
+	Resumed         uint64                 // urls skipped because the resumed run already has their results
+	Errors          map[RqErrorType]uint64 // errors by type, including ones that were retried
+	Failures        map[RqErrorType]uint64 // failed jobs by the type of the error they failed with
+	Retried         uint64                 // errors after which the job was retried
+	OverRetryBudget uint64                 // errors that failed their job because the retry budget was used up
+}
+
+const nErrorTypes = RqErrorNoRetry + 1
+
+// Counters updated by the pipeline; only accessed with atomic operations
+type rqStats struct {
+	read            uint64
+	downloaded      uint64
+	bytes           uint64
+	summarized      uint64
+	saved           uint64
+	failed          uint64
+	skipped         uint64
+	resumed         uint64
+	errors          [nErrorTypes]uint64
+	failures        [nErrorTypes]uint64
+	retried         uint64
+	overRetryBudget uint64 // errors not retried because of the retry budget
+}
+
+func (stats *rqStats) addError(errorType RqErrorType) {
+	if i := int(errorType); i >= 0 && i < len(stats.errors) {
+		atomic.AddUint64(&stats.errors[i], 1)
+	}
+}
+
+func (stats *rqStats) addFailure(errorType RqErrorType) {
+	if i := int(errorType); i >= 0 && i < len(stats.failures) {
+		atomic.AddUint64(&stats.failures[i], 1)
+	}
+}
+
+// Totals for a completed (or stopped) run
+type RunResult struct {
+	Succeeded uint64 // images summarized and written to the output
+	Failed    uint64 // images that failed or were rejected from the source
+	Skipped   uint64 // urls left unprocessed because the run stopped early
+	Resumed   uint64 // urls skipped because the resumed run already has their results
+	// Errors and failed jobs by error type, and how many errors were retried (see RqStats), e.g. to
+	// tell whether a batch is failing on the network or on decoding
+	Errors   map[RqErrorType]uint64
+	Failures map[RqErrorType]uint64
+	Retried  uint64
+}
+
+// Breakdown of the errors of a run, e.g. "download 5 (1 failed), summarize 0, save 0, cleanup 0, no_retry 2 (2 failed); 4 retried"
+func (result RunResult) ErrorSummary() string {
+	b := new(strings.Builder)
+	for i := RqErrorType(0); i < nErrorTypes; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(b, "%v %v", i, result.Errors[i])
+		if failed := result.Failures[i]; failed > 0 {
+			fmt.Fprintf(b, " (%v failed)", failed)
+		}
+	}
+	fmt.Fprintf(b, "; %v retried", result.Retried)
+	return b.String()
+}
+
+// Get a snapshot of the pipeline's counters for the current (or last) run; safe to call while it's running
+func (pipe *RqPipeline) Stats() RqStats {
+	stats := &pipe.stats
+	snapshot := RqStats{
+		Read:            atomic.LoadUint64(&stats.read),
+		Downloaded:      atomic.LoadUint64(&stats.downloaded),
+		Bytes:           atomic.LoadUint64(&stats.bytes),
+		Summarized:      atomic.LoadUint64(&stats.summarized),
+		Saved:           atomic.LoadUint64(&stats.saved),
+		Failed:          atomic.LoadUint64(&stats.failed),
+		Resumed:         atomic.LoadUint64(&stats.resumed),
+		Skipped:         atomic.LoadUint64(&stats.skipped),
+		Errors:          make(map[RqErrorType]uint64, len(stats.errors)),
+		Failures:        make(map[RqErrorType]uint64, len(stats.failures)),
+		Retried:         atomic.LoadUint64(&stats.retried),
+		OverRetryBudget: atomic.LoadUint64(&stats.overRetryBudget),
+	}
+	for i := range stats.errors {
+		snapshot.Errors[RqErrorType(i)] = atomic.LoadUint64(&stats.errors[i])
+		snapshot.Failures[RqErrorType(i)] = atomic.LoadUint64(&stats.failures[i])
+	}
+	return snapshot
+}
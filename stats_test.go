@@ -0,0 +1,133 @@
+package rquent
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPipelineStats(t *testing.T) {
+	// Test the counters after running one failing and one valid image through the pipeline
+	s := testImageURL404 + "\n" + testImageURL200
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(s)).
+		WithOutput(b).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, err := pipeline.Run()
+	if err != nil {
+		t.Errorf("Expected (nil) Got (%v)", err)
+	}
+	if result.Succeeded != 1 || result.Failed != 1 || result.Skipped != 0 {
+		t.Errorf("Expected (1 succeeded, 1 failed) Got (%+v)", result)
+	}
+	stats := pipeline.Stats()
+	if stats.Read != 2 {
+		t.Errorf("Expected (2 read) Got (%v)", stats.Read)
+	}
+	if stats.Downloaded != 1 || stats.Summarized != 1 || stats.Saved != 1 {
+		t.Errorf("Expected (1 downloaded, summarized, saved) Got (%+v)", stats)
+	}
+	if stats.Failed != 1 {
+		t.Errorf("Expected (1 failed) Got (%v)", stats.Failed)
+	}
+	if stats.Errors[RqErrorDownload] != RqJobMaxFails {
+		t.Errorf("Expected (%v download errors) Got (%v)", RqJobMaxFails, stats.Errors[RqErrorDownload])
+	}
+	if stats.Errors[RqErrorSummarize] != 0 {
+		t.Errorf("Expected (0 summarize errors) Got (%v)", stats.Errors[RqErrorSummarize])
+	}
+	if stats.Failures[RqErrorDownload] != 1 || stats.Retried != RqJobMaxFails-1 {
+		t.Errorf("Expected (1 download failure, %v retried) Got (%v, %v)", RqJobMaxFails-1, stats.Failures, stats.Retried)
+	}
+	if result.Failures[RqErrorDownload] != 1 || result.Errors[RqErrorDownload] != RqJobMaxFails || result.Retried != RqJobMaxFails-1 {
+		t.Errorf("Expected (result with the error counts) Got (%+v)", result)
+	}
+}
+
+func TestStatsRetryBudget(t *testing.T) {
+	// Test errors stop being retried once the run's retries are used up
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL404 + "\n" + testImageURL404)).
+		WithOutput(new(bytes.Buffer)).
+		WithRetryBudget(1).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	result, _ := pipeline.Run()
+	if result.Failed != 2 || result.Retried != 1 {
+		t.Errorf("Expected (2 failed, 1 retried) Got (%+v)", result)
+	}
+	if stats := pipeline.Stats(); stats.OverRetryBudget != 2 || stats.Errors[RqErrorDownload] != 3 {
+		t.Errorf("Expected (2 over the retry budget of 3 errors) Got (%+v)", stats)
+	}
+}
+
+func TestRunResultErrorSummary(t *testing.T) {
+	result := RunResult{
+		Errors:   map[RqErrorType]uint64{RqErrorDownload: 5, RqErrorNoRetry: 2},
+		Failures: map[RqErrorType]uint64{RqErrorDownload: 1, RqErrorNoRetry: 2},
+		Retried:  4,
+	}
+	expected := "download 5 (1 failed), summarize 0, save 0, cleanup 0, no_retry 2 (2 failed); 4 retried"
+	if summary := result.ErrorSummary(); summary != expected {
+		t.Errorf("Expected (%v) Got (%v)", expected, summary)
+	}
+}
+
+// metrics that count the summarize observations
+type countingMetrics struct {
+	mux        sync.Mutex
+	summarized int
+}
+
+func (m *countingMetrics) ObserveSummarize(d time.Duration) {
+	m.mux.Lock()
+	m.summarized += 1
+	m.mux.Unlock()
+}
+
+func TestPipelineStatsBytesAndMetrics(t *testing.T) {
+	info, err := os.Stat(testImagePathValid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := new(countingMetrics)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(new(bytes.Buffer)).
+		WithMetrics(metrics).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	pipeline.Run()
+	if n := pipeline.Stats().Bytes; n != uint64(info.Size()) {
+		t.Errorf("Expected (%v bytes) Got (%v)", info.Size(), n)
+	}
+	if metrics.summarized != 1 {
+		t.Errorf("Expected (1 summarize observed) Got (%v)", metrics.summarized)
+	}
+}
+
+func TestRqErrorTypeString(t *testing.T) {
+	if name := RqErrorType(RqErrorNoRetry).String(); name != "no_retry" {
+		t.Errorf("Expected (no_retry) Got (%v)", name)
+	}
+}
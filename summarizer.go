@@ -0,0 +1,19 @@
+package rquent
+
+import "image"
+
+// Analyzes each image in the summarize stage in place of counting prevalent colors
+// Summarize is called concurrently by the summarize workers, so it must be safe for concurrent use
+type Summarizer interface {
+	// Summarize a decoded image; an error fails the image like other summarize errors, which aren't
+	// retried unless WithRetryPolicy allows it
+	Summarize(img image.Image) (Summary, error)
+	// Names of the CSV columns filled by Summary.Fields, written after url, width and height
+	Columns() []string
+}
+
+// Result of a Summarizer, serialized by the output writer
+// CSV output writes Fields after the url and size; JSONL output marshals the Summary as "summary"
+type Summary interface {
+	Fields() []string
+}
@@ -0,0 +1,48 @@
+package rquent
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+)
+
+// Side in pixels of each color's square in the swatches written by WithSwatches
+const DefaultSwatchSize = 32
+
+// Render the prevalent colors as a strip of size x size squares, most prevalent on the left
+// Placeholder colors of images with fewer than k colors are left transparent
+func (summary ColorSummary) Swatch(size int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, size*len(summary.Colors), size))
+	for i, c := range summary.Colors {
+		square := image.Rect(i*size, 0, (i+1)*size, size)
+		draw.Draw(img, square, image.NewUniform(color.Color(c)), image.Point{}, draw.Src)
+	}
+	return img
+}
+
+// Write the swatch of an image's colors as a PNG in dir, named after its url like a kept image
+func writeSwatch(dir string, img RqImage, size int) error {
+	stem, _ := keptStem(img.URL)
+	out, err := os.Create(filepath.Join(dir, stem+".png"))
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(out, img.summary.Swatch(size)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Write the swatch of a finished job to the pipeline's swatch directory, once its result is written
+// Failing to write it (e.g. a full disk) doesn't fail the image; the error goes to the log and to the
+// error output with a "swatch: " prefix
+func (pipe *RqPipeline) saveSwatch(job RqJob) {
+	if err := writeSwatch(pipe.swatchDir, job.image, DefaultSwatchSize); err != nil {
+		pipe.logger.Errorf("Failed to write swatch for %v: %v", job.image.URL, err)
+		pipe.writeFailure(job.image.URL, "swatch: "+err.Error())
+	}
+}
@@ -0,0 +1,73 @@
+package rquent
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSwatch(t *testing.T) {
+	summary := ColorSummary{Colors: []color.NRGBA{red, blue, PlaceholderColor}}
+	swatch := summary.Swatch(4)
+
+	if b := swatch.Bounds(); b.Dx() != 12 || b.Dy() != 4 {
+		t.Fatalf("Expected (12x4) Got (%v)", b)
+	}
+	for i, expected := range summary.Colors {
+		if c := color.NRGBAModel.Convert(swatch.At(i*4+3, 3)); c != expected {
+			t.Errorf("Expected (%v in square %v) Got (%v)", expected, i, c)
+		}
+	}
+}
+
+func TestPipelineRunSwatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rquent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(new(bytes.Buffer)).
+		WithSwatches(dir).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	if result, _ := pipeline.Run(); result.Succeeded != 1 {
+		t.Errorf("Expected (1 succeeded) Got (%+v)", result)
+	}
+	stem, _ := keptStem(testImageURL200)
+	f, err := os.Open(filepath.Join(dir, stem+".png"))
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	defer f.Close()
+	swatch, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if b := swatch.Bounds(); b.Dx() != 3*DefaultSwatchSize || b.Dy() != DefaultSwatchSize {
+		t.Errorf("Expected (%vx%v) Got (%v)", 3*DefaultSwatchSize, DefaultSwatchSize, b)
+	}
+}
+
+func TestMakePipelineSwatchesDryRun(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithOutput(new(bytes.Buffer)).
+		WithDryRun(true).
+		WithSwatches(os.TempDir()).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
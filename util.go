@@ -1,46 +1,72 @@
-package main
+package rquent
 
 import (
-	"errors"
+	"bytes"
+	"encoding/csv"
 	"fmt"
 	"image/color"
-	"io"
-	"net/http"
-	"os"
-	"time"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
+// How colors are written as hex strings; the zero value gives lowercase #rrggbb
+type HexFormat struct {
+	Uppercase bool // use uppercase digits (e.g. #FF0000)
+	Alpha     bool // append the alpha channel (e.g. #ff0000ff); PlaceholderColor is #00000000
+}
+
 // Get NRGBA color as hex string
 func hexify(c color.NRGBA) string {
-	return fmt.Sprintf("#%.2x%.2x%.2x", c.R, c.G, c.B)
+	return HexFormat{}.Format(c)
 }
 
-const defaultTimeout = time.Duration(5 * time.Second)
-
-func newClient(timeout time.Duration) *http.Client {
-	return &http.Client{
-		Timeout: timeout,
+// Get NRGBA color as a hex string in this format
+func (f HexFormat) Format(c color.NRGBA) string {
+	verb := "%.2x"
+	if f.Uppercase {
+		verb = "%.2X"
 	}
+	if f.Alpha {
+		return fmt.Sprintf("#"+verb+verb+verb+verb, c.R, c.G, c.B, c.A)
+	}
+	return fmt.Sprintf("#"+verb+verb+verb, c.R, c.G, c.B)
 }
 
-// Download an file from a url and save to fd
-func downloadToFile(url string, localFile *os.File, client *http.Client) error {
-	// Ref: https://golangcode.com/download-a-file-from-a-url/
-	resp, err := client.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+// Check a rune can separate CSV fields, as encoding/csv requires
+func validDelimiter(r rune) bool {
+	return r != 0 && r != '"' && r != '\r' && r != '\n' && utf8.ValidRune(r) && r != utf8.RuneError
+}
 
-	if resp.StatusCode >= 400 {
-		return errors.New(fmt.Sprintf("Url invalid (statusCode %v", resp.StatusCode))
+// Parse a hex color written as #rrggbb or #rrggbbaa (the # is optional); without alpha it's opaque
+func ParseHexColor(input string) (color.NRGBA, error) {
+	s := strings.TrimPrefix(input, "#")
+	if len(s) != 6 && len(s) != 8 {
+		return color.NRGBA{}, fmt.Errorf("Invalid hex color %q: must be #rrggbb or #rrggbbaa", input)
 	}
-
-	_, err = io.Copy(localFile, resp.Body)
+	if len(s) == 6 {
+		s += "ff"
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
 	if err != nil {
-		return err
+		return color.NRGBA{}, fmt.Errorf("Invalid hex color %q: %v", input, err)
 	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// Format a fraction with two decimal places (e.g. 0.62)
+func formatFraction(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
 
-	_, err = localFile.Seek(0, 0)
-	return err
+// Format fields as a single CSV record (including the trailing newline) separated by comma, quoting
+// any that contain the delimiter, a quote, or a newline
+func csvLine(fields []string, comma rune) []byte {
+	b := new(bytes.Buffer)
+	w := csv.NewWriter(b)
+	w.Comma = comma
+	// only fails if b does, which it doesn't
+	w.Write(fields)
+	w.Flush()
+	return b.Bytes()
 }
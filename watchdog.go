@@ -0,0 +1,46 @@
+package rquent
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Reports a pipeline that has stopped making progress
+type watchdog struct {
+	interval time.Duration
+	onStall  func(idle time.Duration) // logs a warning if nil
+}
+
+// Check for a stall until the pipeline stops; the run starts counting as progress
+func (pipe *RqPipeline) watch() {
+	dog := pipe.watchdog
+	// check often enough to notice a stall soon after interval passes
+	tick := dog.interval / 4
+	if tick <= 0 {
+		tick = dog.interval
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	var reported int64 // lastProgress of the stall already reported
+	for {
+		select {
+		case <-ticker.C:
+			last := atomic.LoadInt64(&pipe.lastProgress)
+			idle := time.Since(time.Unix(0, last))
+			if idle < dog.interval || last == reported {
+				continue
+			}
+			reported = last
+			if dog.onStall != nil {
+				dog.onStall(idle)
+			} else {
+				pipe.logger.Errorf("PIPELINE STALLED: no progress for %v", idle.Round(time.Second))
+			}
+		case <-pipe.pool.doneChn:
+			return
+		case <-pipe.pool.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package rquent
+
+import (
+	"bytes"
+	"image"
+	"strings"
+	"testing"
+	"time"
+)
+
+// summarizer that blocks until release is closed, like a worker stuck on a hanging host
+type blockingSummarizer struct {
+	cornerSummarizer
+	release chan struct{}
+}
+
+func (s blockingSummarizer) Summarize(img image.Image) (Summary, error) {
+	<-s.release
+	return s.cornerSummarizer.Summarize(img)
+}
+
+func TestPipelineWatchdog(t *testing.T) {
+	// Test a stall is reported once, and the run finishes when the stuck job does
+	release := make(chan struct{})
+	stalls := make(chan time.Duration, 10)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithOutput(new(bytes.Buffer)).
+		WithSummarizer(blockingSummarizer{release: release}).
+		WithWatchdog(20*time.Millisecond, func(idle time.Duration) { stalls <- idle }).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	done := make(chan RunResult)
+	go func() {
+		result, _ := pipeline.Run()
+		done <- result
+	}()
+	select {
+	case idle := <-stalls:
+		if idle < 20*time.Millisecond {
+			t.Errorf("Expected (idle at least 20ms) Got (%v)", idle)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected (stall reported) Got (nothing)")
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if result := <-done; result.Succeeded != 1 {
+		t.Errorf("Expected (1 succeeded) Got (%+v)", result)
+	}
+	if len(stalls) != 0 {
+		t.Errorf("Expected (1 stall) Got (%v more)", len(stalls))
+	}
+}
+
+func TestMakePipelineWatchdogBadInterval(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithOutput(new(bytes.Buffer)).
+		WithWatchdog(0, nil).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}
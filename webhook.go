@@ -0,0 +1,128 @@
+package rquent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Retries and backoff for delivering a result to a webhook; the delay doubles with each attempt, with
+// jitter, and a Retry-After from the webhook is honored up to MaxRetryDelay
+var webhookRetryConfig = DownloadConfig{
+	Retries:       3,
+	RetryDelay:    500 * time.Millisecond,
+	MaxRetryDelay: 10 * time.Second,
+}
+
+// Results waiting to be posted before saving another one blocks, so a slow webhook only holds up the
+// pipeline once this many have piled up
+const webhookQueueSize = 100
+
+// Posts each result as JSON to a url
+type webhook struct {
+	url    string
+	client *http.Client
+	cfg    DownloadConfig   // only the retry settings are used
+	queue  chan webhookPost // results of the current run waiting to be posted
+}
+
+// A result waiting to be posted to the webhook
+type webhookPost struct {
+	imgURL string
+	body   []byte
+}
+
+func newWebhook(url string, client *http.Client) *webhook {
+	if client == nil {
+		client = newClient(DefaultTimeout)
+	}
+	return &webhook{url: url, client: client, cfg: webhookRetryConfig}
+}
+
+// Post a result, retrying network errors and retryable status codes (5xx and 429) with backoff
+// Any 2xx response is a success
+func (w *webhook) post(ctx context.Context, body []byte) error {
+	for attempt := 0; ; attempt += 1 {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		var retryAfter time.Duration
+		resp, err := w.client.Do(req)
+		if err == nil {
+			// drain the body so the connection can be reused
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("Webhook responded with %v", resp.Status)
+			if !retryableStatus(resp.StatusCode) {
+				return err
+			}
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		if ctx.Err() != nil || attempt >= w.cfg.Retries {
+			return err
+		}
+
+		select {
+		case <-time.After(retryDelay(w.cfg, attempt, retryAfter)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Start posting the queued results of a run in the background
+// The returned function waits until every queued result has been posted (or failed)
+func (pipe *RqPipeline) startWebhook() func() {
+	w := pipe.webhook
+	w.queue = make(chan webhookPost, webhookQueueSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for post := range w.queue {
+			if err := w.post(pipe.pool.ctx, post.body); err != nil {
+				pipe.webhookFailed(post.imgURL, err)
+			}
+		}
+	}()
+	return func() {
+		close(w.queue)
+		<-done
+	}
+}
+
+// Queue the result of a job to be posted to the pipeline's webhook as a line of JSONL, whatever the
+// output format; only blocks when the queue is full
+func (pipe *RqPipeline) postResult(job RqJob) {
+	var body []byte
+	var err error
+	if pipe.pool.dryRun {
+		body, err = formatCheck(job.image, FormatJSONL, pipe.outputOpts)
+	} else {
+		body, err = formatResult(job.image, FormatJSONL, pipe.outputOpts)
+	}
+	if err != nil {
+		pipe.webhookFailed(job.image.URL, err)
+		return
+	}
+	select {
+	case pipe.webhook.queue <- webhookPost{imgURL: job.image.URL, body: body}:
+	case <-pipe.pool.ctx.Done():
+		pipe.webhookFailed(job.image.URL, pipe.pool.ctx.Err())
+	}
+}
+
+// A result that can't be delivered is logged and written to the error output, but still counts as saved
+func (pipe *RqPipeline) webhookFailed(imgURL string, err error) {
+	pipe.logger.Errorf("Failed to post result for %v to webhook: %v", imgURL, err)
+	pipe.writeFailure(imgURL, "webhook: "+err.Error())
+}
@@ -0,0 +1,174 @@
+package rquent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// create a server that responds with statusCode for the first nFails posts, then records their bodies
+func webhookServer(statusCode int, nFails int32, requests *int32, bodies *[]string, mux *sync.Mutex) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(requests, 1) <= nFails {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(statusCode)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		*bodies = append(*bodies, string(body))
+		mux.Unlock()
+	}))
+}
+
+func TestWebhookPostRetries(t *testing.T) {
+	var requests int32
+	var bodies []string
+	s := webhookServer(http.StatusServiceUnavailable, 2, &requests, &bodies, new(sync.Mutex))
+	defer s.Close()
+
+	w := newWebhook(s.URL, nil)
+	w.cfg = testRetryConfig
+	if err := w.post(context.Background(), []byte(`{"url":"a"}`)); err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+	if requests != 3 || len(bodies) != 1 || bodies[0] != `{"url":"a"}` {
+		t.Errorf("Expected (3 requests, 1 delivered) Got (%v requests, %v)", requests, bodies)
+	}
+}
+
+func TestWebhookPostFails(t *testing.T) {
+	// Test client errors aren't retried
+	var requests int32
+	var bodies []string
+	s := webhookServer(http.StatusBadRequest, 5, &requests, &bodies, new(sync.Mutex))
+	defer s.Close()
+
+	w := newWebhook(s.URL, nil)
+	w.cfg = testRetryConfig
+	if err := w.post(context.Background(), []byte("{}")); err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+	if requests != 1 {
+		t.Errorf("Expected (1 request) Got (%v)", requests)
+	}
+}
+
+func TestPipelineRunWebhook(t *testing.T) {
+	// Test each result is posted as JSON alongside the CSV output
+	var requests int32
+	var bodies []string
+	mux := new(sync.Mutex)
+	s := webhookServer(http.StatusOK, 0, &requests, &bodies, mux)
+	defer s.Close()
+
+	b := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200+"\n"+testImageURL404)).
+		WithOutput(b).
+		WithWebhook(s.URL, nil).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	if result, _ := pipeline.Run(); result.Succeeded != 1 {
+		t.Errorf("Expected (1 succeeded) Got (%+v)", result)
+	}
+	if !strings.HasPrefix(b.String(), testImageURL200+",") {
+		t.Errorf("Expected (CSV result) Got (%q)", b.String())
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if len(bodies) != 1 {
+		t.Fatalf("Expected (1 post) Got (%v)", bodies)
+	}
+	var result jsonResult
+	if err := json.Unmarshal([]byte(bodies[0]), &result); err != nil || result.URL != testImageURL200 || len(result.Colors) != 3 {
+		t.Errorf("Expected (JSON result) Got (%v, %v)", bodies[0], err)
+	}
+}
+
+func TestPipelineRunWebhookFails(t *testing.T) {
+	// Test undelivered results are written to the error output, and still succeed
+	var requests int32
+	s := webhookServer(http.StatusBadRequest, 1, &requests, new([]string), new(sync.Mutex))
+	defer s.Close()
+
+	errOut := new(bytes.Buffer)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(testImageURL200)).
+		WithWebhook(s.URL, nil).
+		WithErrorOutput(errOut).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	if result, _ := pipeline.Run(); result.Succeeded != 1 {
+		t.Errorf("Expected (1 succeeded) Got (%+v)", result)
+	}
+	if !strings.HasPrefix(errOut.String(), testImageURL200+",webhook: ") {
+		t.Errorf("Expected (webhook failure) Got (%q)", errOut.String())
+	}
+}
+
+func TestPipelineRunWebhookSlow(t *testing.T) {
+	// Test results are saved while the webhook is stuck, and posted before the run returns
+	release := make(chan struct{})
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer s.Close()
+
+	results := make(chan RqImage)
+	pipeline, err := NewPipeline(testPipeConfig).
+		WithClient(testClient).
+		WithSource(strings.NewReader(strings.Repeat(testImageURL200+"\n", 3))).
+		WithResultChannel(results).
+		WithWebhook(s.URL, nil).
+		Init()
+
+	if err != nil {
+		t.Fatalf("Expected (nil) Got (%v)", err)
+	}
+
+	done := make(chan RunResult)
+	go func() {
+		result, _ := pipeline.Run()
+		done <- result
+	}()
+	for i := 0; i < 3; i += 1 {
+		<-results
+	}
+	close(release)
+	if result := <-done; result.Succeeded != 3 {
+		t.Errorf("Expected (3 succeeded) Got (%+v)", result)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Expected (3 posts) Got (%v)", n)
+	}
+}
+
+func TestMakePipelineWebhookBadURL(t *testing.T) {
+	_, err := NewPipeline(testPipeConfig).
+		WithSource(strings.NewReader("")).
+		WithWebhook("example.com/hook", nil).
+		Init()
+	if err == nil {
+		t.Errorf("Expected (error) Got (nil)")
+	}
+}